@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// LdapAccount is a service account of the directory.
+type LdapAccount struct {
+	BindDN           string `yaml:"bind_dn"`
+	BindPassword     string `yaml:"bind_password"`
+	BindPasswordNext string `yaml:"bind_password_next"`
+}
+
+func (a *LdapAccount) set() bool {
+	return a.BindDN != ""
+}
+
+func (a *LdapAccount) apply(cred *LdapCredential) {
+	cred.bindDn, cred.bindPwd, cred.bindPwdNext = a.BindDN, a.BindPassword, a.BindPasswordNext
+}
+
+// LdapDomainConfig gives the logins of a domain their own service accounts
+// in place of the X-Ldap-BindDN and X-Ldap-BindPass headers:
+//
+//	ldap:
+//	  domains:
+//	    example.com:
+//	      search: {bind_dn: "cn=search,dc=example,dc=com", bind_password: ...}
+//	      attributes: {bind_dn: "cn=reader,dc=example,dc=com", bind_password: ...}
+//
+// Search finds the entry of the user. Attributes, when set, reads the
+// attributes for the response and the policy only once the password
+// checked out, so the search account needs to see no more than DNs.
+type LdapDomainConfig struct {
+	Search     LdapAccount `yaml:"search"`
+	Attributes LdapAccount `yaml:"attributes"`
+}
+
+func (c *LdapConfig) validateDomains() error {
+	domains := make(map[string]LdapDomainConfig, len(c.Domains))
+	for domain, d := range c.Domains {
+		if !d.Search.set() && !d.Attributes.set() {
+			return fmt.Errorf("ldap.domains.%s needs a search or attributes bind_dn", domain)
+		}
+		domains[strings.ToLower(domain)] = d
+	}
+	c.Domains = domains
+	return nil
+}
+
+// applyDomain switches cred to the service accounts of its domain.
+func (c *LdapConfig) applyDomain(cred *LdapCredential) {
+	d, ok := c.Domains[strings.ToLower(cred.domain)]
+	if !ok {
+		return
+	}
+	if d.Search.set() {
+		d.Search.apply(cred)
+	}
+	if d.Attributes.set() {
+		cred.attrs = &d.Attributes
+	}
+}
+
+// searchAttrs are the attributes read with the user's entry before the
+// password check: all of them, unless the domain has an attributes account.
+func searchAttrs(cred *LdapCredential) []string {
+	if cred.attrs == nil {
+		return entryAttrs()
+	}
+	return append([]string{"dn"}, currentConfig().Ldap.FailedLogins.attributes()...)
+}
+
+// authorizedEntry returns the entry of the authenticated user with all its
+// attributes, reading them as the attributes account if entry was found
+// without them.
+func authorizedEntry(cred *LdapCredential, entry *ldap.Entry) *ldap.Entry {
+	if cred.attrs == nil {
+		return entry
+	}
+	return readEntry(cred, entry.DN, entryAttrs()[1:])
+}
+
+// readEntry reads attrs of dn on a service connection, as the attributes
+// account when there is one, after the user's password was checked on a
+// connection of its own. Failures leave the entry without attributes.
+func readEntry(cred *LdapCredential, dn string, attrs []string) *ldap.Entry {
+	if len(attrs) == 0 {
+		return &ldap.Entry{DN: dn}
+	}
+	reader := cred
+	if cred.attrs != nil {
+		c := *cred
+		cred.attrs.apply(&c)
+		reader = &c
+	}
+	sreq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", attrs, nil)
+	var sresp *ldap.SearchResult
+	start := time.Now()
+	err := servicePool(reader).doUntil(cred.deadline, func(l *pooledConn) (err error) {
+		sresp, err = l.Search(sreq)
+		return err
+	})
+	cred.timings.add("attributes", start)
+	if err != nil || len(sresp.Entries) != 1 {
+		log.Printf("Unable to read attributes of %s as %s: %v", dn, reader.bindDn, err)
+		return &ldap.Entry{DN: dn}
+	}
+	return sresp.Entries[0]
+}
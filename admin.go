@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	adminAddr   = flag.String("admin-addr", "localhost:5001", "address serving /metrics, /debug/vars, /healthz, /readyz and the admin API, kept apart from the auth port. Empty disables it.")
+	enablePprof = flag.Bool("pprof", false, "expose net/http/pprof profiles under /debug/pprof/ on the admin listener.")
+)
+
+// adminMux holds the operational endpoints. It is never served on the port
+// nginx talks to.
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.Handle("/metrics", promhttp.Handler())
+	adminMux.HandleFunc("/healthz", handleHealthz)
+	adminMux.HandleFunc("/readyz", handleReadyz)
+	adminMux.HandleFunc("/admin/config", handleConfig)
+	adminMux.HandleFunc("/admin/debug", handleDebug)
+	adminMux.HandleFunc("/admin/users/", handleUserStats)
+	adminMux.HandleFunc("/admin/failures", handleFailures)
+	adminMux.HandleFunc("/admin/sessions", handleSessions)
+	adminMux.HandleFunc("/admin/unlock", handleUnlock)
+	adminMux.HandleFunc("/admin/blocklist/refresh", handleBlocklistRefresh)
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	expvar.Publish("runtime", expvar.Func(runtimeVars))
+}
+
+// runtimeVars summarizes the Go runtime for /debug/vars, for a quick look
+// where no Prometheus scrapes the admin listener.
+func runtimeVars() interface{} {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return map[string]interface{}{
+		"goroutines":      runtime.NumGoroutine(),
+		"heap_alloc":      m.HeapAlloc,
+		"heap_inuse":      m.HeapInuse,
+		"heap_objects":    m.HeapObjects,
+		"sys":             m.Sys,
+		"num_gc":          m.NumGC,
+		"gc_pause_last":   time.Duration(m.PauseNs[(m.NumGC+255)%256]).String(),
+		"gc_pause_total":  time.Duration(m.PauseTotalNs).String(),
+		"gc_cpu_fraction": m.GCCPUFraction,
+	}
+}
+
+// AdminConfig protects the /admin/ API. With a Token, requests must carry it
+// as "Authorization: Bearer <token>"; metrics and health checks stay open.
+type AdminConfig struct {
+	Token string `yaml:"token"`
+}
+
+func requireAdminToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().Admin.Token
+		if token != "" && strings.HasPrefix(r.URL.Path, "/admin/") {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				log.Printf("Rejected admin request for %s from %s without a valid token.", r.URL.Path, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func registerPprof() {
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
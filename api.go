@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+)
+
+const apiAuthPath = "/api/v1/auth"
+
+// apiAuthRequest is the body of a POST to /api/v1/auth, for callers other
+// than nginx. The directory is still chosen with the X-Ldap-* headers, and
+// ClientIP names the client, both only from server.trusted_proxies.
+//
+// With Mechanism SCRAM-SHA-256, Response is the base64 client-first message
+// and then, with the Session of the answer, the client-final message. NTLM
+// works alike with the NEGOTIATE and AUTHENTICATE messages.
+type apiAuthRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Protocol  string `json:"protocol"`
+	ClientIP  string `json:"client_ip"`
+	Mechanism string `json:"mechanism"`
+	Response  string `json:"response"`
+	Session   string `json:"session"`
+}
+
+// apiAuthResponse is the decision. Headers holds the success headers, such as
+// Auth-Server, or, on a failure, Auth-Error-Code. Code is the error code of
+// a failure, e.g. ERR_INVALID_CREDENTIALS. SASL exchanges answer
+// Status "continue" with a Session and the base64 server-first (or NTLM
+// CHALLENGE) message, and the server-final one on success.
+type apiAuthResponse struct {
+	Authenticated bool              `json:"authenticated"`
+	Status        string            `json:"status"`
+	Code          string            `json:"code,omitempty"`
+	Wait          int               `json:"wait,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Challenge     string            `json:"challenge,omitempty"`
+	Session       string            `json:"session,omitempty"`
+}
+
+// apiHandler turns the JSON request into an auth_http request for h and its
+// answer back into JSON, so both go through the same checks.
+func apiHandler(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var req apiAuthRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Protocol == "" {
+			req.Protocol = "http"
+		}
+		req.ClientIP = trustCaller(r, req.ClientIP)
+		var ar *http.Request
+		var sasl *saslExchange
+		if req.Mechanism != "" && !strings.EqualFold(req.Mechanism, "PLAIN") {
+			msg, err := base64.StdEncoding.DecodeString(req.Response)
+			if err != nil {
+				http.Error(w, "Invalid SASL response: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if ar, sasl, err = saslRequest(r, req.Mechanism, req.Session, msg, req.Protocol, req.ClientIP); err != nil {
+				code := http.StatusBadRequest
+				if _, ok := err.(saslUnavailable); ok {
+					code = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			defer sasl.release()
+		} else {
+			ar = authHttpRequest(r, req.Username, req.Password, req.Protocol, req.ClientIP)
+		}
+
+		rec := httptest.NewRecorder()
+		out := &authOutcome{}
+		if ar != nil {
+			ar, out = withOutcome(ar)
+			h(rec, ar)
+		}
+
+		resp := apiAuthResponse{Status: rec.Header().Get(AuthStatus), Code: string(out.code.public())}
+		resp.Authenticated = resp.Status == "OK"
+		if sasl != nil && (sasl.id != "" || resp.Authenticated) {
+			if sasl.id != "" {
+				resp.Status, resp.Session = "continue", sasl.id
+			}
+			resp.Challenge = base64.StdEncoding.EncodeToString([]byte(sasl.challenge))
+		}
+		resp.Wait, _ = strconv.Atoi(rec.Header().Get(AuthWait))
+		for k, v := range rec.Header() {
+			switch k {
+			case AuthStatus, AuthWait:
+				continue
+			case Traceparent, Tracestate:
+				w.Header()[k] = v
+				continue
+			}
+			if resp.Headers == nil {
+				resp.Headers = make(map[string]string)
+			}
+			resp.Headers[k] = v[0]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// trustCaller returns the address of the client of an API or gRPC call r:
+// clientIp when r comes from server.trusted_proxies and names one, and else
+// the peer. It drops the X-Ldap-* headers of other callers, which could
+// otherwise point the daemon at a directory of their own.
+func trustCaller(r *http.Request, clientIp string) string {
+	conf := &currentConfig().Server
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if inNetworks(conf.trustedNets, net.ParseIP(peer)) {
+		if clientIp != "" {
+			return clientIp
+		}
+		return peer
+	}
+	for k := range r.Header {
+		if strings.HasPrefix(k, "X-Ldap-") {
+			r.Header.Del(k)
+		}
+	}
+	return peer
+}
+
+// authHttpRequest copies r, keeping its X-Ldap-* and client authentication
+// headers but not Authorization, into the auth_http request for a plain
+// login. Auth-Server and Auth-Port are taken from the Host header.
+func authHttpRequest(r *http.Request, user, pass, protocol, clientIp string) *http.Request {
+	host, hostPort, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, hostPort = r.Host, *port
+	}
+	ar := r.Clone(r.Context())
+	ar.Method = http.MethodGet
+	ar.Body = http.NoBody
+	ar.ContentLength = 0
+	ar.Header.Del("Authorization")
+	ar.Header.Set(AuthMethod, "plain")
+	ar.Header.Set(AuthUser, user)
+	ar.Header.Set(AuthPass, pass)
+	ar.Header.Set(AuthProtocol, protocol)
+	ar.Header.Set(ClientIP, clientIp)
+	ar.Header.Set(AuthServer, host)
+	ar.Header.Set(AuthPort, hostPort)
+	return ar
+}
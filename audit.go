@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"gopkg.in/ldap.v3"
+	"gopkg.in/yaml.v2"
+)
+
+// AuditConfig configures the stream of per-login audit events.
+type AuditConfig struct {
+	// File receives one event per line, empty disables it.
+	File string `yaml:"file"`
+	// Rotate rotates File and enforces the retention of its backups.
+	Rotate RotateConfig `yaml:"rotate"`
+	// Format is json, cef or leef.
+	Format auditFormat `yaml:"format"`
+	Kafka  KafkaConfig `yaml:"kafka"`
+	// Attributes of the user entry are added to the events of successful
+	// logins, e.g. department or employeeID.
+	Attributes []AuditAttributeConfig `yaml:"attributes"`
+	// HmacKey keys the hash redaction, so pseudonyms can't be reversed by
+	// hashing guesses but stay the same across restarts.
+	HmacKey string `yaml:"hmac_key"`
+}
+
+// AuditAttributeConfig names an attribute for audit events. Redact is empty
+// to keep the values, hash to replace them by a keyed pseudonym that events
+// can still be correlated by, or mask to hide all but the last four
+// characters.
+type AuditAttributeConfig struct {
+	Name   string `yaml:"name"`
+	Redact string `yaml:"redact"`
+}
+
+func (c *AuditConfig) validate() error {
+	if err := c.Rotate.validate("audit.rotate"); err != nil {
+		return err
+	}
+	for _, a := range c.Attributes {
+		if a.Name == "" {
+			return fmt.Errorf("audit.attributes need a name")
+		}
+		switch a.Redact {
+		case "", "mask":
+		case "hash":
+			if c.HmacKey == "" {
+				return fmt.Errorf("audit.attributes: hash redaction of %s needs audit.hmac_key", a.Name)
+			}
+		default:
+			return fmt.Errorf("audit.attributes: redact of %s must be hash or mask, got %q", a.Name, a.Redact)
+		}
+	}
+	return nil
+}
+
+func (c *AuditConfig) attributes() []string {
+	var attrs []string
+	for _, a := range c.Attributes {
+		attrs = append(attrs, a.Name)
+	}
+	return attrs
+}
+
+// attributeValues returns the redacted audit attributes of entry.
+func (c *AuditConfig) attributeValues(entry *ldap.Entry) map[string][]string {
+	if len(c.Attributes) == 0 {
+		return nil
+	}
+	m := make(map[string][]string, len(c.Attributes))
+	for _, a := range c.Attributes {
+		vals := entry.GetAttributeValues(a.Name)
+		if len(vals) == 0 {
+			continue
+		}
+		redacted := make([]string, len(vals))
+		for i, v := range vals {
+			switch a.Redact {
+			case "hash":
+				redacted[i] = hmacPseudonym(c.HmacKey, v)
+			case "mask":
+				redacted[i] = maskValue(v)
+			default:
+				redacted[i] = v
+			}
+		}
+		m[a.Name] = redacted
+	}
+	return m
+}
+
+// hmacPseudonym is the hex of the first 12 bytes of the HMAC-SHA256 of v.
+func hmacPseudonym(key, v string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// maskValue replaces all but the last four characters of v by *, or all of
+// them when v is that short.
+func maskValue(v string) string {
+	r := []rune(v)
+	keep := 0
+	if len(r) > 4 {
+		keep = 4
+	}
+	return strings.Repeat("*", len(r)-keep) + string(r[len(r)-keep:])
+}
+
+// KafkaConfig exports audit events to a Kafka topic.
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+	// PartitionBy keys messages by "user" or "domain" so events of the same
+	// user or tenant stay ordered within one partition.
+	PartitionBy  string        `yaml:"partition_by"`
+	BatchSize    int           `yaml:"batch_size"`
+	BatchTimeout time.Duration `yaml:"batch_timeout"`
+}
+
+const (
+	auditSuccess  = "success"
+	auditFailure  = "failure"
+	auditTempFail = "tempfail"
+)
+
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Result   string    `json:"result"`
+	Reason   string    `json:"reason,omitempty"`
+	Code     string    `json:"code,omitempty"`
+	User     string    `json:"user"`
+	Domain   string    `json:"domain,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Protocol string    `json:"protocol,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	TraceID  string    `json:"trace_id,omitempty"`
+	SpanID   string    `json:"span_id,omitempty"`
+	// Attributes of the user entry, see AuditConfig.Attributes.
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+// auditFormat is the format of audit events, checked as it is read.
+type auditFormat string
+
+// UnmarshalYAML rejects the formats formatAuditEvent doesn't know, which
+// would otherwise fall back to JSON.
+func (f *auditFormat) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch s {
+	case "json", "cef", "leef":
+		*f = auditFormat(s)
+		return nil
+	}
+	// Only the errors of the decoder know the line, so decode the scalar
+	// as a map for one and keep its "line N" for yamlError.
+	err := unmarshal(&map[string]string{})
+	te, ok := err.(*yaml.TypeError)
+	if !ok || len(te.Errors) == 0 {
+		return fmt.Errorf("audit.format: unknown format %q", s)
+	}
+	line := strings.SplitN(te.Errors[0], ":", 2)[0]
+	return &yaml.TypeError{Errors: []string{fmt.Sprintf("%s: audit.format: unknown format %q, want json, cef or leef", line, s)}}
+}
+
+type auditLog struct {
+	mu     sync.Mutex
+	file   *rotatingFile
+	kafka  *kafka.Writer
+	by     string
+	format string
+}
+
+var auditor = &auditLog{}
+
+func newAuditLog(c *AuditConfig) (*auditLog, error) {
+	a := &auditLog{by: c.Kafka.PartitionBy, format: string(c.Format)}
+	if c.File != "" {
+		var err error
+		if a.file, err = openRotating(c.File, 0600, c.Rotate); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Kafka.Brokers) > 0 {
+		a.kafka = &kafka.Writer{
+			Addr:         kafka.TCP(c.Kafka.Brokers...),
+			Topic:        c.Kafka.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchSize:    c.Kafka.BatchSize,
+			BatchTimeout: c.Kafka.BatchTimeout,
+			Async:        true,
+			Completion: func(msgs []kafka.Message, err error) {
+				if err != nil {
+					log.Printf("Unable to export %d audit events to Kafka: %v", len(msgs), err)
+				}
+			},
+		}
+	}
+	return a, nil
+}
+
+// reopen switches the audit file to a fresh one at the same path, as after
+// logrotate moved it away.
+func (a *auditLog) reopen() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.reopen()
+}
+
+// requestEvent fills in what an audit event knows from the request alone.
+// User is the login as the handler resolves it, with the default domain of
+// the profile, so that the lockout counts failures under the key it checks.
+func requestEvent(r *http.Request, result string, code errCode) auditEvent {
+	ev := auditEvent{
+		Result:   result,
+		Reason:   code.reason(),
+		Code:     string(code),
+		User:     currentConfig().Normalize.username(r.Header.Get(AuthUser)),
+		ClientIP: r.Header.Get(ClientIP),
+		Protocol: r.Header.Get(AuthProtocol),
+		Method:   r.Header.Get(AuthMethod),
+	}
+	if login, err := requestProfile(r).login(ev.User); err == nil && ev.User != "" {
+		ev.User = login
+	}
+	if at := strings.LastIndex(ev.User, "@"); at >= 0 {
+		ev.Domain = ev.User[at+1:]
+	}
+	if tc := requestTrace(r); tc != nil {
+		ev.TraceID, ev.SpanID = tc.traceID, tc.spanID
+	}
+	return ev
+}
+
+// recordOutcome is called once for every answered authentication.
+func recordOutcome(ev auditEvent) {
+	ev.Time = time.Now().UTC()
+	stats.observe(ev)
+	observeOutcome(ev)
+	currentConfig().Lockout.observe(ev)
+	auditor.record(ev)
+}
+
+func (a *auditLog) record(ev auditEvent) {
+	b, err := formatAuditEvent(a.format, ev)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	if a.file != nil {
+		a.file.Write(append(b, '\n'))
+	}
+	a.mu.Unlock()
+	if a.kafka != nil {
+		key := ev.User
+		if a.by == "domain" {
+			key = ev.Domain
+		}
+		a.kafka.WriteMessages(context.Background(), kafka.Message{Key: []byte(key), Value: b})
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a.kafka != nil {
+		a.kafka.Close()
+	}
+	if a.file != nil {
+		return a.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: auth.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Authenticator_Authenticate_FullMethodName = "/httpauth2ldap.v1.Authenticator/Authenticate"
+	Authenticator_Authorize_FullMethodName    = "/httpauth2ldap.v1.Authenticator/Authorize"
+	Authenticator_Sasl_FullMethodName         = "/httpauth2ldap.v1.Authenticator/Sasl"
+)
+
+// AuthenticatorClient is the client API for Authenticator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Authenticator runs the same checks, backends, caches and rate limits as
+// the auth_http endpoint. Failures are returned as status errors carrying an
+// google.rpc.ErrorInfo with the failure reason and, for temporary failures,
+// a google.rpc.RetryInfo.
+type AuthenticatorClient interface {
+	// Authenticate checks the password of a user@domain login.
+	Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error)
+	// Authorize authenticates and also requires membership of one of the
+	// groups.
+	Authorize(ctx context.Context, in *AuthorizeRequest, opts ...grpc.CallOption) (*AuthorizeResponse, error)
+	// Sasl runs one step of a SASL exchange, SCRAM-SHA-256 or NTLM. The first
+	// call carries the first client message (client-first or NEGOTIATE) and
+	// returns the server's (server-first or CHALLENGE) with a session; the
+	// second names the session and carries the final client message.
+	Sasl(ctx context.Context, in *SaslRequest, opts ...grpc.CallOption) (*SaslResponse, error)
+}
+
+type authenticatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAuthenticatorClient(cc grpc.ClientConnInterface) AuthenticatorClient {
+	return &authenticatorClient{cc}
+}
+
+func (c *authenticatorClient) Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AuthenticateResponse)
+	err := c.cc.Invoke(ctx, Authenticator_Authenticate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *authenticatorClient) Authorize(ctx context.Context, in *AuthorizeRequest, opts ...grpc.CallOption) (*AuthorizeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AuthorizeResponse)
+	err := c.cc.Invoke(ctx, Authenticator_Authorize_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *authenticatorClient) Sasl(ctx context.Context, in *SaslRequest, opts ...grpc.CallOption) (*SaslResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SaslResponse)
+	err := c.cc.Invoke(ctx, Authenticator_Sasl_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AuthenticatorServer is the server API for Authenticator service.
+// All implementations must embed UnimplementedAuthenticatorServer
+// for forward compatibility
+//
+// Authenticator runs the same checks, backends, caches and rate limits as
+// the auth_http endpoint. Failures are returned as status errors carrying an
+// google.rpc.ErrorInfo with the failure reason and, for temporary failures,
+// a google.rpc.RetryInfo.
+type AuthenticatorServer interface {
+	// Authenticate checks the password of a user@domain login.
+	Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error)
+	// Authorize authenticates and also requires membership of one of the
+	// groups.
+	Authorize(context.Context, *AuthorizeRequest) (*AuthorizeResponse, error)
+	// Sasl runs one step of a SASL exchange, SCRAM-SHA-256 or NTLM. The first
+	// call carries the first client message (client-first or NEGOTIATE) and
+	// returns the server's (server-first or CHALLENGE) with a session; the
+	// second names the session and carries the final client message.
+	Sasl(context.Context, *SaslRequest) (*SaslResponse, error)
+	mustEmbedUnimplementedAuthenticatorServer()
+}
+
+// UnimplementedAuthenticatorServer must be embedded to have forward compatible implementations.
+type UnimplementedAuthenticatorServer struct {
+}
+
+func (UnimplementedAuthenticatorServer) Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Authenticate not implemented")
+}
+func (UnimplementedAuthenticatorServer) Authorize(context.Context, *AuthorizeRequest) (*AuthorizeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Authorize not implemented")
+}
+func (UnimplementedAuthenticatorServer) Sasl(context.Context, *SaslRequest) (*SaslResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Sasl not implemented")
+}
+func (UnimplementedAuthenticatorServer) mustEmbedUnimplementedAuthenticatorServer() {}
+
+// UnsafeAuthenticatorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AuthenticatorServer will
+// result in compilation errors.
+type UnsafeAuthenticatorServer interface {
+	mustEmbedUnimplementedAuthenticatorServer()
+}
+
+func RegisterAuthenticatorServer(s grpc.ServiceRegistrar, srv AuthenticatorServer) {
+	s.RegisterService(&Authenticator_ServiceDesc, srv)
+}
+
+func _Authenticator_Authenticate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthenticateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthenticatorServer).Authenticate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Authenticator_Authenticate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthenticatorServer).Authenticate(ctx, req.(*AuthenticateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Authenticator_Authorize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthorizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthenticatorServer).Authorize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Authenticator_Authorize_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthenticatorServer).Authorize(ctx, req.(*AuthorizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Authenticator_Sasl_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SaslRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthenticatorServer).Sasl(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Authenticator_Sasl_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthenticatorServer).Sasl(ctx, req.(*SaslRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Authenticator_ServiceDesc is the grpc.ServiceDesc for Authenticator service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Authenticator_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "httpauth2ldap.v1.Authenticator",
+	HandlerType: (*AuthenticatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Authenticate",
+			Handler:    _Authenticator_Authenticate_Handler,
+		},
+		{
+			MethodName: "Authorize",
+			Handler:    _Authenticator_Authorize_Handler,
+		},
+		{
+			MethodName: "Sasl",
+			Handler:    _Authenticator_Sasl_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "auth.proto",
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// authRealm is announced in the Basic challenge of auth_request routes
+// outside of a realm.
+const authRealm = "httpauth2ldap"
+
+// authRequestHandler answers the subrequests of the nginx http auth_request
+// module, which only distinguishes 2xx, 401 and 403:
+//
+//	location = /auth {
+//	    internal;
+//	    proxy_pass http://127.0.0.1:5000/nginx/auth_request;
+//	    proxy_pass_request_body off;
+//	    proxy_set_header X-Real-IP $remote_addr;
+//	}
+//
+// The credentials come from the Authorization header of the original
+// request. X-Real-IP and the X-Ldap-* headers are only taken from nginx in
+// server.trusted_proxies, as the other headers come from the client. On
+// success the response headers, e.g. X-Auth-User, can be picked up with
+// auth_request_set.
+func authRequestHandler(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			challenge(w, r)
+			return
+		}
+		clientIp := trustCaller(r, r.Header.Get("X-Real-IP"))
+		ar, out := withOutcome(authHttpRequest(r, user, pass, "http", clientIp))
+
+		rec := httptest.NewRecorder()
+		h(rec, ar)
+
+		for k, v := range rec.Header() {
+			switch k {
+			case AuthStatus, AuthWait, AuthServer, AuthPort, AuthErrorCode:
+				continue
+			}
+			w.Header()[k] = v
+		}
+		if rec.Header().Get(AuthStatus) == "OK" && out.cred != nil {
+			w.Header().Set("X-Auth-User", out.cred.usr+"@"+out.cred.domain)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		switch out.code.reason() {
+		case reasonBanned, reasonDeniedUser, reasonPolicyDenied, reasonLocked:
+			w.WriteHeader(http.StatusForbidden)
+		case reasonTemporaryFailure, reasonInternalError:
+			if wait := rec.Header().Get(AuthWait); wait != "" {
+				w.Header().Set("Retry-After", wait)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			challenge(w, r)
+		}
+	})
+}
+
+func challenge(w http.ResponseWriter, r *http.Request) {
+	realm := authRealm
+	if p := requestProfile(r); p != nil && p.realm != "" {
+		realm = p.realm
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.Replace(realm, `"`, "", -1)+`", charset="UTF-8"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthRequestTrustedHeaders(t *testing.T) {
+	useConfig(t, staticConfig+`
+server:
+  trusted_proxies: [127.0.0.1]
+`)
+	for _, tt := range []struct {
+		peer, clientIp, ldapURL string
+	}{
+		{"127.0.0.1:40000", "192.0.2.1", "ldap://ldap.example.com"},
+		{"203.0.113.5:40000", "203.0.113.5", ""},
+	} {
+		var got http.Header
+		h := authRequestHandler(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header
+			noteOutcome(r, "", &LdapCredential{usr: "alice", domain: "example.com"}, nil)
+			w.Header().Set(AuthStatus, "OK")
+		})
+		r := httptest.NewRequest(http.MethodGet, "/nginx/auth_request", nil)
+		r.RemoteAddr = tt.peer
+		r.SetBasicAuth("Alice", "secret")
+		r.Header.Set("X-Real-IP", "192.0.2.1")
+		r.Header.Set(XLdapURL, "ldap://ldap.example.com")
+		r.Header.Set(XLdapBindPass, "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if ip := got.Get(ClientIP); ip != tt.clientIp {
+			t.Errorf("peer %s: %s = %q, want %q", tt.peer, ClientIP, ip, tt.clientIp)
+		}
+		if u := got.Get(XLdapURL); u != tt.ldapURL {
+			t.Errorf("peer %s: %s = %q, want %q", tt.peer, XLdapURL, u, tt.ldapURL)
+		}
+		if tt.ldapURL == "" && got.Get(XLdapBindPass) != "" {
+			t.Errorf("peer %s: %s kept", tt.peer, XLdapBindPass)
+		}
+		if user := w.Header().Get("X-Auth-User"); user != "alice@example.com" {
+			t.Errorf("peer %s: X-Auth-User = %q, want the login", tt.peer, user)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"gopkg.in/ldap.v3"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// authBackend is one place users can live in. authenticate returns the
+// user's entry, errUserNotFound if the backend does not know the user, or
+// another error.
+type authBackend interface {
+	name() string
+	authenticate(cred *LdapCredential) (*ldap.Entry, error)
+}
+
+// BackendConfig configures one link of the authentication chain.
+type BackendConfig struct {
+	Name string `yaml:"name"`
+	// Type is ldap, htpasswd or static.
+	Type string `yaml:"type"`
+	// OnFailure is stop (default) to reject the login when this backend
+	// knows the user but the password is wrong, or continue to try the
+	// next backend anyway.
+	OnFailure string `yaml:"on_failure"`
+
+	URL              string `yaml:"url"`
+	BaseDN           string `yaml:"base_dn"`
+	BindDN           string `yaml:"bind_dn"`
+	BindPassword     string `yaml:"bind_password"`
+	BindPasswordNext string `yaml:"bind_password_next"`
+
+	// File is the htpasswd file. Its names without a domain only match
+	// logins in LocalDomains, other entries must be user@domain.
+	File         string   `yaml:"file"`
+	LocalDomains []string `yaml:"local_domains"`
+
+	// Domains maps domain to user to password hash for static backends.
+	Domains map[string]map[string]string `yaml:"domains"`
+}
+
+// requestBackend is the LDAP server nginx names in the X-Ldap-* headers. It
+// is the whole chain when no backends are configured.
+type requestBackend struct{}
+
+func (requestBackend) name() string { return "request" }
+
+func (requestBackend) authenticate(cred *LdapCredential) (*ldap.Entry, error) {
+	return authViaLdap(cred)
+}
+
+type ldapBackend struct {
+	conf *BackendConfig
+}
+
+func (b *ldapBackend) name() string { return b.conf.Name }
+
+func (b *ldapBackend) authenticate(cred *LdapCredential) (*ldap.Entry, error) {
+	return authViaLdap(b.credential(cred))
+}
+
+// credential is a copy of cred for the directory of b.
+func (b *ldapBackend) credential(cred *LdapCredential) *LdapCredential {
+	c := *cred
+	c.ldapAddr, c.baseDn = b.conf.URL, b.conf.BaseDN
+	c.bindDn, c.bindPwd, c.bindPwdNext = b.conf.BindDN, b.conf.BindPassword, b.conf.BindPasswordNext
+	c.attrs = nil
+	return &c
+}
+
+// directoryOf returns the directory of the backend b for cred, nil for
+// backends that are not a directory.
+func directoryOf(b authBackend, cred *LdapCredential) *LdapCredential {
+	switch b := b.(type) {
+	case requestBackend:
+		return cred.directory()
+	case *ldapBackend:
+		return b.credential(cred).directory()
+	}
+	return nil
+}
+
+// definitiveFailure reports whether err means the user exists but gave the
+// wrong password, as opposed to being unknown or the backend being down. A
+// rejected service bind is a serviceBindError, which is never definitive.
+func definitiveFailure(err error) bool {
+	return err == errInvalidPassword || ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials)
+}
+
+type chainLink struct {
+	backend  authBackend
+	stopOnly bool
+}
+
+func newChain(confs []BackendConfig) ([]chainLink, error) {
+	if len(confs) == 0 {
+		return []chainLink{{backend: requestBackend{}, stopOnly: true}}, nil
+	}
+	var links []chainLink
+	for i := range confs {
+		c := &confs[i]
+		var b authBackend
+		switch c.Type {
+		case "ldap":
+			b = &ldapBackend{conf: c}
+		case "htpasswd":
+			b = &htpasswdBackend{conf: c}
+		case "static":
+			b = &staticBackend{conf: c}
+		default:
+			return nil, fmt.Errorf("backends[%d]: unknown type %q", i, c.Type)
+		}
+		switch c.OnFailure {
+		case "", "stop", "continue":
+		default:
+			return nil, fmt.Errorf("backends[%d]: on_failure must be stop or continue, got %q", i, c.OnFailure)
+		}
+		links = append(links, chainLink{backend: b, stopOnly: c.OnFailure != "continue"})
+	}
+	return links, nil
+}
+
+// authChain tries the backends in order until one accepts the user. Unknown
+// users and unavailable backends always fall through to the next one.
+func authChain(cred *LdapCredential) (*ldap.Entry, error) {
+	if cred.chain != nil {
+		return runChain(cred.chain, cred)
+	}
+	return runChain(currentConfig().chain, cred)
+}
+
+func runChain(links []chainLink, cred *LdapCredential) (*ldap.Entry, error) {
+	var lastErr error = errUserNotFound
+	for _, l := range links {
+		entry, err := l.backend.authenticate(cred)
+		if err == nil {
+			cred.dir = directoryOf(l.backend, cred)
+			return entry, nil
+		}
+		if err == errDeadline {
+			return nil, err
+		}
+		if err != errUserNotFound {
+			lastErr = err
+			log.Printf("Backend %s rejected %s@%s: %v", l.backend.name(), cred.usr, cred.domain, err)
+		}
+		if definitiveFailure(err) && l.stopOnly {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
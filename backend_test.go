@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestChainDirectory(t *testing.T) {
+	fx, err := loadLdapFixtures("testdata/login.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures = fx
+	defer func() { fixtures = nil }()
+	quietLog(t)
+
+	useConfig(t, directoryConfig)
+	cred := &LdapCredential{ldapAddr: "ldap://request.example.com", usr: "alice", domain: "example.com", pwd: "secret"}
+	if _, err := authChain(cred); err != nil {
+		t.Fatal(err)
+	}
+	if cred.dir == nil || cred.dir.ldapAddr != "ldap://ldap.example.com" || cred.dir.pwd != "" {
+		t.Errorf("directory of an ldap backend = %+v", cred.dir)
+	}
+
+	useConfig(t, staticConfig)
+	cred = &LdapCredential{ldapAddr: "ldap://request.example.com", usr: "alice", domain: "example.com", pwd: "secret"}
+	if _, err := authChain(cred); err != nil {
+		t.Fatal(err)
+	}
+	if cred.dir != nil {
+		t.Errorf("directory of a static backend = %+v", cred.dir)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BlocklistConfig periodically loads IPs and CIDRs, one per line with #
+// comments, from a URL or a file. Listed clients are refused.
+type BlocklistConfig struct {
+	Source          string        `yaml:"source"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+type blocklist struct {
+	nets    atomic.Value // []*net.IPNet
+	refresh sync.Mutex
+}
+
+var blocked = &blocklist{}
+
+func (b *blocklist) contains(ip string) bool {
+	nets, _ := b.nets.Load().([]*net.IPNet)
+	if len(nets) == 0 || ip == "" {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBlocklist(r io.Reader) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if strings.Contains(line, ":") {
+				line += "/128"
+			} else {
+				line += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocklist entry %q", line)
+		}
+		nets = append(nets, n)
+	}
+	return nets, s.Err()
+}
+
+func openSource(src string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return os.Open(src)
+	}
+	resp, err := httpClient.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s answered %s", src, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// load replaces the list. On error the previous list stays in effect.
+func (b *blocklist) load(src string) error {
+	b.refresh.Lock()
+	defer b.refresh.Unlock()
+	rc, err := openSource(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	nets, err := parseBlocklist(rc)
+	if err != nil {
+		return err
+	}
+	b.nets.Store(nets)
+	blocklistEntries.Set(float64(len(nets)))
+	blocklistRefreshed.SetToCurrentTime()
+	return nil
+}
+
+func (b *blocklist) syncEvery(src string, d time.Duration) {
+	for range time.Tick(d) {
+		if err := b.load(src); err != nil {
+			log.Printf("Unable to refresh blocklist: %v", err)
+		}
+	}
+}
+
+// handleBlocklistRefresh reloads the blocklist on POST.
+func handleBlocklistRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	source := currentConfig().Blocklist.Source
+	if source == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := blocked.load(source); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/ldap.v3"
+)
+
+var (
+	cacheTTL        = flag.Duration("cache-ttl", 0, "how long to cache successful authentications, 0 disables the cache.")
+	cacheHash       = flag.String("cache-hash", "argon2id", "hash used to store cached passwords: argon2id, bcrypt or scrypt.")
+	cacheHashCost   = flag.Int("cache-hash-cost", 0, "cost of the cache password hash (argon2id passes, bcrypt cost or scrypt log2 N), 0 uses the default.")
+	cacheHashParams = flag.String("cache-hash-params", "", "comma separated parameters of the cache password hash: t (passes), m (memory in KiB) and p (threads) for argon2id, cost for bcrypt, N, r and p for scrypt.")
+	cacheSize       = flag.Int("cache-size", 10000, "maximum number of cached authentications, least recently used entries are evicted first.")
+	cacheFile       = flag.String("cache-file", "", "file the cache is saved to on shutdown and restored from at startup, so a restart doesn't send every client to LDAP at once.")
+)
+
+// passwordHasher turns a plaintext password into a value that can only be
+// checked against a candidate password, never reversed.
+type passwordHasher interface {
+	hash(pwd string) ([]byte, error)
+	verify(hashed []byte, pwd string) bool
+}
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+const argon2SaltLen = 16
+
+func (h *argon2idHasher) hash(pwd string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(pwd), salt, h.time, h.memory, h.threads, h.keyLen)
+	return append(salt, key...), nil
+}
+
+func (h *argon2idHasher) verify(hashed []byte, pwd string) bool {
+	if len(hashed) != argon2SaltLen+int(h.keyLen) {
+		return false
+	}
+	salt, key := hashed[:argon2SaltLen], hashed[argon2SaltLen:]
+	other := argon2.IDKey([]byte(pwd), salt, h.time, h.memory, h.threads, h.keyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) hash(pwd string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(pwd), h.cost)
+}
+
+func (h *bcryptHasher) verify(hashed []byte, pwd string) bool {
+	return bcrypt.CompareHashAndPassword(hashed, []byte(pwd)) == nil
+}
+
+type scryptHasher struct {
+	n, r, p int
+}
+
+const scryptKeyLen = 32
+
+func (h *scryptHasher) hash(pwd string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(pwd), salt, h.n, h.r, h.p, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, key...), nil
+}
+
+func (h *scryptHasher) verify(hashed []byte, pwd string) bool {
+	if len(hashed) != argon2SaltLen+scryptKeyLen {
+		return false
+	}
+	salt, key := hashed[:argon2SaltLen], hashed[argon2SaltLen:]
+	other, err := scrypt.Key([]byte(pwd), salt, h.n, h.r, h.p, scryptKeyLen)
+	return err == nil && subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// parseHashParams parses "name=value,..." with the names in allowed.
+func parseHashParams(hash, s string, allowed ...string) (map[string]int, error) {
+	params := make(map[string]int)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 || !contains(allowed, kv[:i]) {
+			return nil, fmt.Errorf("invalid %s parameter %q, must be one of %s set to a number", hash, kv, strings.Join(allowed, ", "))
+		}
+		v, err := strconv.Atoi(kv[i+1:])
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid %s parameter %q, must be a positive number", hash, kv)
+		}
+		params[kv[:i]] = v
+	}
+	return params, nil
+}
+
+// newPasswordHasher returns the hasher name with the defaults overridden by
+// cost and then by params.
+func newPasswordHasher(name string, cost int, params string) (passwordHasher, error) {
+	switch name {
+	case "argon2id":
+		h := &argon2idHasher{time: 1, memory: 64 * 1024, threads: 4, keyLen: 32}
+		if cost > 0 {
+			h.time = uint32(cost)
+		}
+		ps, err := parseHashParams(name, params, "t", "m", "p")
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := ps["t"]; ok {
+			h.time = uint32(v)
+		}
+		if v, ok := ps["m"]; ok {
+			h.memory = uint32(v)
+		}
+		if v, ok := ps["p"]; ok {
+			if v > 255 {
+				return nil, fmt.Errorf("argon2id threads must be at most 255")
+			}
+			h.threads = uint8(v)
+		}
+		return h, nil
+	case "bcrypt":
+		h := &bcryptHasher{cost: bcrypt.DefaultCost}
+		ps, err := parseHashParams(name, params, "cost")
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := ps["cost"]; ok {
+			cost = v
+		}
+		if cost > 0 {
+			if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+				return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+			}
+			h.cost = cost
+		}
+		return h, nil
+	case "scrypt":
+		h := &scryptHasher{n: 1 << 15, r: 8, p: 1}
+		if cost > 0 {
+			if cost > 30 {
+				return nil, fmt.Errorf("scrypt cost must be at most 30")
+			}
+			h.n = 1 << uint(cost)
+		}
+		ps, err := parseHashParams(name, params, "N", "r", "p")
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := ps["N"]; ok {
+			h.n = v
+		}
+		if v, ok := ps["r"]; ok {
+			h.r = v
+		}
+		if v, ok := ps["p"]; ok {
+			h.p = v
+		}
+		if _, err := scrypt.Key(nil, nil, h.n, h.r, h.p, scryptKeyLen); err != nil {
+			return nil, fmt.Errorf("invalid scrypt parameters: %v", err)
+		}
+		return h, nil
+	}
+	return nil, fmt.Errorf("unknown cache hash %q", name)
+}
+
+type cacheEntry struct {
+	key     string
+	hashed  []byte
+	entry   *ldap.Entry
+	dir     *LdapCredential
+	expires time.Time
+}
+
+// authCache remembers successful authentications in a size-bounded LRU. Only
+// a hash of the password is kept, so dumping the cache never yields
+// plaintext passwords.
+type authCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	hash    string
+	hasher  passwordHasher
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newAuthCache(ttl time.Duration, size int, hash string, hasher passwordHasher) *authCache {
+	return &authCache{
+		ttl:     ttl,
+		size:    size,
+		hash:    hash,
+		hasher:  hasher,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey names the user of cred, and its client when that decides which
+// entry the directory finds.
+func cacheKey(cred *LdapCredential) string {
+	key := cred.ldapAddr + "\x00" + cred.baseDn + "\x00" + cred.usr + "@" + cred.domain
+	if cred.ldapConf().usesClientIp() {
+		key += "\x00" + cred.clientIp
+	}
+	return key
+}
+
+// verify returns the cached directory entry of the user if the presented
+// password matches the cached hash, setting cred.dir to its directory.
+func (c *authCache) verify(cred *LdapCredential) *ldap.Entry {
+	if c == nil {
+		return nil
+	}
+	key := cacheKey(cred)
+	c.mu.Lock()
+	var hashed []byte
+	var entry *ldap.Entry
+	var dir *LdapCredential
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().After(e.expires) {
+			c.remove(el)
+		} else {
+			c.lru.MoveToFront(el)
+			hashed, entry, dir = e.hashed, e.entry, e.dir
+		}
+	}
+	c.mu.Unlock()
+	if hashed == nil || !c.hasher.verify(hashed, cred.pwd) {
+		cacheMisses.Inc()
+		return nil
+	}
+	cacheHits.Inc()
+	cred.dir = dir
+	return entry
+}
+
+func (c *authCache) add(cred *LdapCredential, entry *ldap.Entry) {
+	if c == nil {
+		return
+	}
+	hashed, err := c.hasher.hash(cred.pwd)
+	if err != nil {
+		return
+	}
+	key := cacheKey(cred)
+	expires := time.Now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.hashed, e.entry, e.dir, e.expires = hashed, entry, cred.dir, expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, hashed: hashed, entry: entry, dir: cred.dir, expires: expires})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		cacheEvictions.Inc()
+	}
+	cacheEntries.Set(float64(c.lru.Len()))
+}
+
+// forget drops the entry of cred, whose password changed.
+func (c *authCache) forget(cred *LdapCredential) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[cacheKey(cred)]; ok {
+		c.remove(el)
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *authCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	cacheEntries.Set(float64(c.lru.Len()))
+}
+
+// savedCache is the on-disk form of the cache. It holds only password hashes,
+// but the file should still be readable by the daemon alone.
+type savedCache struct {
+	Hash    string       `json:"hash"`
+	Entries []savedEntry `json:"entries"`
+}
+
+type savedEntry struct {
+	Key     string      `json:"key"`
+	Hashed  []byte      `json:"hashed"`
+	Entry   *ldap.Entry `json:"entry"`
+	Expires time.Time   `json:"expires"`
+}
+
+// save writes the unexpired entries, most recently used last.
+func (c *authCache) save(path string) error {
+	c.mu.Lock()
+	sc := savedCache{Hash: c.hash}
+	now := time.Now()
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*cacheEntry)
+		if now.Before(e.expires) {
+			sc.Entries = append(sc.Entries, savedEntry{e.key, e.hashed, e.entry, e.expires})
+		}
+	}
+	c.mu.Unlock()
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load restores a saved cache. Entries hashed differently than configured
+// now, or expired meanwhile, are dropped.
+func (c *authCache) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sc savedCache
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return err
+	}
+	if sc.Hash != c.hash {
+		return nil
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, se := range sc.Entries {
+		if now.After(se.Expires) {
+			continue
+		}
+		if el, ok := c.entries[se.Key]; ok {
+			c.remove(el)
+		}
+		c.entries[se.Key] = c.lru.PushFront(&cacheEntry{key: se.Key, hashed: se.Hashed, entry: se.Entry, expires: se.Expires})
+		for c.lru.Len() > c.size {
+			c.remove(c.lru.Back())
+		}
+	}
+	cacheEntries.Set(float64(c.lru.Len()))
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestCacheKeyClientIp(t *testing.T) {
+	a := &LdapCredential{usr: "alice", domain: "example.com", clientIp: "192.0.2.1"}
+	b := &LdapCredential{usr: "alice", domain: "example.com", clientIp: "192.0.2.2"}
+	a.ldap = &LdapConfig{Filter: "(uid={user})"}
+	b.ldap = a.ldap
+	if cacheKey(a) != cacheKey(b) {
+		t.Error("keys differ by client without {client_ip}")
+	}
+	a.ldap = &LdapConfig{Filter: "(&(uid={user})(allowedHost={client_ip}))"}
+	b.ldap = a.ldap
+	if cacheKey(a) == cacheKey(b) || inflightKeyFor(a) == inflightKeyFor(b) {
+		t.Error("keys don't differ by client with {client_ip}")
+	}
+}
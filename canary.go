@@ -0,0 +1,91 @@
+package main
+
+import (
+	"hash/fnv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CanaryConfig sends some users through a candidate configuration while the
+// rest stay on the stable one. A user is either always or never in the
+// canary, so their logins don't flap between configurations.
+type CanaryConfig struct {
+	// Backends and Ldap are the candidate configuration, as in shadow.
+	Backends []BackendConfig `yaml:"backends"`
+	Ldap     *LdapConfig     `yaml:"ldap"`
+	// Percent of users routed through the canary, picked by a hash of the
+	// login.
+	Percent float64 `yaml:"percent"`
+	// Domains are always routed through the canary, e.g. a test domain.
+	Domains []string `yaml:"domains"`
+
+	chain []chainLink
+}
+
+var canaryRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "httpauth2ldap_canary_requests_total",
+	Help: "Authentications checked against LDAP by configuration (stable or canary) and result (ok or fail).",
+}, []string{"config", "result"})
+
+func init() {
+	prometheus.MustRegister(canaryRequests)
+}
+
+// UnmarshalYAML starts a canary ldap section from the defaults.
+func (c *CanaryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CanaryConfig
+	p := plain(*c)
+	if err := defaultLdapSection(unmarshal, &p.Ldap); err != nil {
+		return err
+	}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	*c = CanaryConfig(p)
+	return nil
+}
+
+func (c *CanaryConfig) enabled() bool {
+	return c.Percent > 0 || len(c.Domains) > 0
+}
+
+func (c *CanaryConfig) compile() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Ldap != nil {
+		if err := c.Ldap.validate(); err != nil {
+			return err
+		}
+	}
+	var err error
+	c.chain, err = newChain(c.Backends)
+	return err
+}
+
+// route switches cred to the canary configuration if the user is in it and
+// reports which configuration it uses.
+func (c *CanaryConfig) route(cred *LdapCredential) string {
+	if !c.enabled() || c.chain == nil {
+		return "stable"
+	}
+	in := contains(c.Domains, cred.domain)
+	if !in && c.Percent > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(cred.usr + "@" + cred.domain))
+		in = float64(h.Sum32()%10000) < c.Percent*100
+	}
+	if !in {
+		return "stable"
+	}
+	cred.ldap, cred.chain = c.Ldap, c.chain
+	return "canary"
+}
+
+func observeCanary(conf string, ok bool) {
+	result := "fail"
+	if ok {
+		result = "ok"
+	}
+	canaryRequests.WithLabelValues(conf, result).Inc()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// replayHeader marks replayed requests, which are never captured again.
+const replayHeader = "X-Httpauth2ldap-Replay"
+
+var captureFile = flag.String("capture-file", "", "append every auth request, without passwords or other secrets, with its Auth-Status to this file for `replay`.")
+
+// capturedRequest is one line of a -capture-file.
+type capturedRequest struct {
+	Time    time.Time   `json:"time"`
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Header  http.Header `json:"header"`
+	Status  string      `json:"status"`
+	Latency string      `json:"latency"`
+}
+
+type requestCapture struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var capture *requestCapture
+
+func openCapture(path string) (*requestCapture, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &requestCapture{f: f}, nil
+}
+
+// sanitize copies h without the secret headers.
+func sanitize(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		if contains(secretHeaders, k) || k == currentConfig().ClientAuth.SharedSecretHeader {
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// captureHandler records the requests answered by h.
+func captureHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if capture == nil || r.Header.Get(replayHeader) != "" {
+			h(w, r)
+			return
+		}
+		start := time.Now()
+		h(w, r)
+		b, err := json.Marshal(capturedRequest{
+			Time:    start.UTC(),
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Header:  sanitize(r.Header),
+			Status:  w.Header().Get(AuthStatus),
+			Latency: time.Since(start).String(),
+		})
+		if err != nil {
+			return
+		}
+		capture.mu.Lock()
+		capture.f.Write(append(b, '\n'))
+		capture.mu.Unlock()
+	}
+}
+
+// runReplay implements `httpauth2ldap replay`, which re-issues captured
+// requests with a test password, typically to an instance configured with a
+// static backend or a test directory, and reports which answers changed.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "capture file written by -capture-file.")
+	target := fs.String("target", "http://localhost:5000", "base URL of the instance to replay against.")
+	password := fs.String("password", "", "Auth-Pass sent in place of the removed password.")
+	bindPassword := fs.String("bind-password", "", "X-Ldap-BindPass sent when the captured request had a bind DN.")
+	timing := fs.Bool("timing", false, "keep the original spacing between requests instead of sending them back to back.")
+	fs.Parse(args)
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "-file is required")
+		os.Exit(2)
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var sent, changed, failed int
+	var prev time.Time
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var cr capturedRequest
+		if err := json.Unmarshal(sc.Bytes(), &cr); err != nil {
+			log.Printf("Skipping unreadable line: %v", err)
+			continue
+		}
+		if *timing && !prev.IsZero() && cr.Time.After(prev) {
+			time.Sleep(cr.Time.Sub(prev))
+		}
+		prev = cr.Time
+		req, err := http.NewRequest(cr.Method, *target+cr.Path, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header = cr.Header
+		req.Header.Set(AuthPass, *password)
+		req.Header.Set(replayHeader, "1")
+		if req.Header.Get(XLdapBindDN) != "" {
+			req.Header.Set(XLdapBindPass, *bindPassword)
+		}
+		sent++
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			failed++
+			log.Printf("%s: %v", cr.Header.Get(AuthUser), err)
+			continue
+		}
+		resp.Body.Close()
+		if status := resp.Header.Get(AuthStatus); status != cr.Status {
+			changed++
+			fmt.Printf("%s %s: captured %q, now %q\n", cr.Time.Format(time.RFC3339), cr.Header.Get(AuthUser), cr.Status, status)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("replayed %d requests: %d answered differently, %d failed\n", sent, changed, failed)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// cgroupCpuLimit returns the CPU quota of the process' cgroup in CPUs, from
+// cpu.max under cgroup v2 or the CFS quota and period under v1, the lowest
+// of those of the cgroup and its parents.
+func cgroupCpuLimit() (float64, bool) {
+	limit := 0.0
+	for _, dir := range cgroupDirs("", "/sys/fs/cgroup") {
+		if f := strings.Fields(readCgroupFile(dir, "cpu.max")); len(f) == 2 {
+			limit = lowerLimit(limit, cpuQuota(f[0], f[1]))
+		}
+	}
+	for _, v1 := range []string{"cpu", "cpu,cpuacct", "cpuacct,cpu"} {
+		for _, dir := range cgroupDirs("cpu", "/sys/fs/cgroup/"+v1) {
+			limit = lowerLimit(limit, cpuQuota(readCgroupFile(dir, "cpu.cfs_quota_us"), readCgroupFile(dir, "cpu.cfs_period_us")))
+		}
+	}
+	return limit, limit > 0
+}
+
+// cpuQuota is quota/period, or 0 for no quota: "max" under v2, -1 under v1.
+func cpuQuota(quota, period string) float64 {
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+// cgroupMemoryLimit returns the memory limit of the process' cgroup in
+// bytes, from memory.max under cgroup v2 or memory.limit_in_bytes under v1.
+func cgroupMemoryLimit() (int64, bool) {
+	limit := 0.0
+	for _, dir := range cgroupDirs("", "/sys/fs/cgroup") {
+		if max, err := strconv.ParseInt(readCgroupFile(dir, "memory.max"), 10, 64); err == nil {
+			limit = lowerLimit(limit, float64(max))
+		}
+	}
+	for _, dir := range cgroupDirs("memory", "/sys/fs/cgroup/memory") {
+		// Without a limit, v1 reports the largest page-aligned int64.
+		if max, err := strconv.ParseInt(readCgroupFile(dir, "memory.limit_in_bytes"), 10, 64); err == nil && max < 1<<62 {
+			limit = lowerLimit(limit, float64(max))
+		}
+	}
+	return int64(limit), limit > 0
+}
+
+// lowerLimit returns the lower of two limits, where 0 is none.
+func lowerLimit(a, b float64) float64 {
+	if b > 0 && (a == 0 || b < a) {
+		return b
+	}
+	return a
+}
+
+// cgroupDirs lists the directories to look for limits in: that of the
+// process' cgroup of controller, "" for v2, under mount and then its
+// parents up to mount itself, where a container sees its own cgroup.
+func cgroupDirs(controller, mount string) []string {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return []string{mount}
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		// hierarchy-ID:controller,controller:path
+		f := strings.SplitN(line, ":", 3)
+		if len(f) != 3 || !cgroupHas(f[1], controller) {
+			continue
+		}
+		var dirs []string
+		for p := path.Clean(f[2]); p != "/" && p != "."; p = path.Dir(p) {
+			dirs = append(dirs, mount+p)
+		}
+		return append(dirs, mount)
+	}
+	return []string{mount}
+}
+
+func cgroupHas(controllers, controller string) bool {
+	if controller == "" {
+		return controllers == ""
+	}
+	for _, c := range strings.Split(controllers, ",") {
+		if c == controller {
+			return true
+		}
+	}
+	return false
+}
+
+func readCgroupFile(dir, name string) string {
+	b, err := os.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func cgroupCpuLimit() (float64, bool) {
+	return 0, false
+}
+
+func cgroupMemoryLimit() (int64, bool) {
+	return 0, false
+}
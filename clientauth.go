@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultHmacHeaders are the headers signed by default: everything that
+// decides the outcome, including Client-IP, which bans and lockouts key on.
+var defaultHmacHeaders = []string{
+	AuthMethod, AuthUser, AuthPass, AuthProtocol, ClientIP, AuthServer, AuthPort, AuthSSLCert,
+	XLdapURL, XLdapBaseDN, XLdapBindDN, XLdapBindPass, XLdapBindPassNext,
+}
+
+// ClientAuthConfig authenticates nginx itself to the daemon, either with a
+// static shared secret or with an HMAC over the critical headers.
+//
+// The HMAC is the hex encoded HMAC-SHA256 under HmacKey of the timestamp
+// (unix seconds), nonce, method, path and the HmacHeaders values, each
+// followed by a newline.
+type ClientAuthConfig struct {
+	SharedSecret       string        `yaml:"shared_secret"`
+	SharedSecretHeader string        `yaml:"shared_secret_header"`
+	HmacKey            string        `yaml:"hmac_key"`
+	HmacHeaders        []string      `yaml:"hmac_headers"`
+	SignatureHeader    string        `yaml:"signature_header"`
+	TimestampHeader    string        `yaml:"timestamp_header"`
+	NonceHeader        string        `yaml:"nonce_header"`
+	MaxSkew            time.Duration `yaml:"max_skew"`
+}
+
+func (c *ClientAuthConfig) verify(r *http.Request) bool {
+	if c.SharedSecret != "" {
+		got := r.Header.Get(c.SharedSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(c.SharedSecret)) != 1 {
+			return false
+		}
+	}
+	if c.HmacKey != "" {
+		return c.verifySignature(r)
+	}
+	return true
+}
+
+func (c *ClientAuthConfig) signature(r *http.Request) []byte {
+	mac := hmac.New(sha256.New, []byte(c.HmacKey))
+	for _, v := range []string{r.Header.Get(c.TimestampHeader), r.Header.Get(c.NonceHeader), r.Method, r.URL.Path} {
+		mac.Write([]byte(v + "\n"))
+	}
+	for _, h := range c.HmacHeaders {
+		mac.Write([]byte(r.Header.Get(h) + "\n"))
+	}
+	return mac.Sum(nil)
+}
+
+func (c *ClientAuthConfig) verifySignature(r *http.Request) bool {
+	ts, err := strconv.ParseInt(r.Header.Get(c.TimestampHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > c.MaxSkew || skew < -c.MaxSkew {
+		return false
+	}
+	nonce := r.Header.Get(c.NonceHeader)
+	if nonce == "" {
+		return false
+	}
+	got, err := hex.DecodeString(r.Header.Get(c.SignatureHeader))
+	if err != nil || !hmac.Equal(got, c.signature(r)) {
+		return false
+	}
+	// Only remember nonces of genuine requests so forgeries can't fill the cache.
+	return nonces.add(nonce, 2*c.MaxSkew)
+}
+
+// nonceCache remembers recently used nonces to reject replayed requests
+// within the allowed clock skew. There is one for the process, so that a
+// reload doesn't forget the nonces already seen.
+type nonceCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+func (n *nonceCache) add(nonce string, ttl time.Duration) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	if exp, ok := n.seen[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	if now.Sub(n.swept) > ttl {
+		for k, exp := range n.seen {
+			if now.After(exp) {
+				delete(n.seen, k)
+			}
+		}
+		n.swept = now
+	}
+	n.seen[nonce] = now.Add(ttl)
+	return true
+}
+
+var nonces = &nonceCache{}
+
+// requireClientAuth rejects requests that do not carry the credentials of
+// the running configuration before any of their headers are looked at.
+func requireClientAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentConfig().ClientAuth.verify(r) {
+			log.Printf("Rejected request from %s without a valid shared secret or signature.", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
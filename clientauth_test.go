@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNonceReplayAcrossReload(t *testing.T) {
+	const doc = `
+client_auth:
+  hmac_key: test-key
+`
+	first := useConfig(t, doc)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	c := &first.ClientAuth
+	r.Header.Set(c.TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	r.Header.Set(c.NonceHeader, "replayed-nonce")
+	r.Header.Set(c.SignatureHeader, hex.EncodeToString(c.signature(r)))
+	if !c.verify(r) {
+		t.Fatal("signed request rejected")
+	}
+	// A reload builds a new configuration.
+	reloaded := useConfig(t, doc)
+	if reloaded.ClientAuth.verify(r) {
+		t.Error("replayed request accepted after a reload")
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile  = flag.String("config", "", "path to a YAML configuration file.")
+	printConfig = flag.Bool("print-config", false, "print the effective configuration with secrets masked and exit.")
+)
+
+// secretKeys are the config keys whose values are masked when the
+// configuration is shown.
+var secretKeys = map[string]bool{
+	"bind_password":      true,
+	"bind_password_next": true,
+	"shared_secret":      true,
+	"hmac_key":           true,
+	"secret":             true,
+	"token":              true,
+	"proxy":              true,
+	"password":           true,
+}
+
+type Config struct {
+	// Include lists files, globs or directories (such as conf.d) merged over
+	// this file in order, relative to it. Directories contribute their
+	// *.yaml and *.yml files sorted by name. Later files override scalars
+	// and slices and add to maps.
+	Include []string `yaml:"include,omitempty"`
+
+	Server     ServerConfig     `yaml:"server"`
+	TLS        TLSConfig        `yaml:"tls"`
+	ClientAuth ClientAuthConfig `yaml:"client_auth"`
+	Input      InputConfig      `yaml:"input"`
+	Normalize  NormalizeConfig  `yaml:"normalize"`
+	OAuth      OAuthConfig      `yaml:"oauth"`
+	NTLM       NtlmConfig       `yaml:"ntlm"`
+	Ldap       LdapConfig       `yaml:"ldap"`
+	Backends   []BackendConfig  `yaml:"backends"`
+	Honeypot   HoneypotConfig   `yaml:"honeypot"`
+	Denylist   DenylistConfig   `yaml:"denylist"`
+	Policy     PolicyConfig     `yaml:"policy"`
+	Sessions   SessionsConfig   `yaml:"sessions"`
+	SMTP       SmtpConfig       `yaml:"smtp"`
+	Events     EventsConfig     `yaml:"events"`
+	Audit      AuditConfig      `yaml:"audit"`
+	Stats      StatsConfig      `yaml:"stats"`
+	Lockout    LockoutConfig    `yaml:"lockout"`
+	Blocklist  BlocklistConfig  `yaml:"blocklist"`
+	Messages   MessageCatalog   `yaml:"messages"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Migration  MigrationConfig  `yaml:"migration"`
+	Shadow     ShadowConfig     `yaml:"shadow"`
+	Canary     CanaryConfig     `yaml:"canary"`
+	Admin      AdminConfig      `yaml:"admin"`
+	Runtime    RuntimeConfig    `yaml:"runtime"`
+	Store      StoreConfig      `yaml:"store"`
+
+	// files are the files the configuration was loaded from, dirs the
+	// directories their includes are looked up in.
+	files, dirs []string
+	// kvVersion is the version of the -config-kv key merged over the files.
+	kvVersion uint64
+	// chain holds the backends built from Backends.
+	chain []chainLink
+}
+
+// ServerConfig hardens the HTTP listeners against slow or oversized clients.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	DisableKeepAlives bool          `yaml:"disable_keep_alives"`
+	AuthPaths         []string      `yaml:"auth_paths"`
+	AuthMethods       []string      `yaml:"auth_methods"`
+	// Routes enable, disable or add paths, see RouteConfig.
+	Routes map[string]RouteConfig `yaml:"routes"`
+	// Realms are profiles selected by RealmHeader or else the Host header.
+	Realms      map[string]ProfileConfig `yaml:"realms"`
+	RealmHeader string                   `yaml:"realm_header"`
+	// TrustedProxies are the CIDRs or addresses of the API, gRPC and
+	// auth_request callers, such as webmail frontends and nginx, trusted to
+	// name the client in client_ip or X-Real-IP and to choose the directory
+	// with X-Ldap-* headers. Other callers are taken to be the client and
+	// authenticate against the backends.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	trustedNets []*net.IPNet
+}
+
+func (c *ServerConfig) apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = c.ReadHeaderTimeout
+	srv.ReadTimeout = c.ReadTimeout
+	srv.WriteTimeout = c.WriteTimeout
+	srv.IdleTimeout = c.IdleTimeout
+	srv.MaxHeaderBytes = c.MaxHeaderBytes
+	srv.SetKeepAlivesEnabled(!c.DisableKeepAlives)
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			MaxHeaderBytes:    16 << 10,
+			AuthPaths:         []string{"/"},
+			AuthMethods:       []string{http.MethodGet},
+			RealmHeader:       "X-Auth-Realm",
+		},
+		TLS: TLSConfig{
+			ReloadInterval: time.Minute,
+			ACME: ACMEConfig{
+				CacheDir: "acme-cache",
+			},
+			Revocation: RevocationConfig{
+				OCSPCacheTTL: time.Hour,
+				OCSPTimeout:  5 * time.Second,
+			},
+		},
+		ClientAuth: ClientAuthConfig{
+			SharedSecretHeader: "X-Auth-Secret",
+			HmacHeaders:        append([]string(nil), defaultHmacHeaders...),
+			SignatureHeader:    "X-Auth-Signature",
+			TimestampHeader:    "X-Auth-Timestamp",
+			NonceHeader:        "X-Auth-Nonce",
+			MaxSkew:            30 * time.Second,
+		},
+		Events: EventsConfig{
+			Retries:    3,
+			RetryDelay: time.Second,
+		},
+		Audit: AuditConfig{
+			Format: "json",
+			Kafka: KafkaConfig{
+				Topic:        "httpauth2ldap-audit",
+				PartitionBy:  "user",
+				BatchSize:    100,
+				BatchTimeout: time.Second,
+			},
+		},
+		Stats: StatsConfig{
+			SaveInterval: 5 * time.Minute,
+		},
+		Runtime: RuntimeConfig{
+			MemoryLimitRatio: 0.9,
+		},
+		Store: StoreConfig{
+			Prefix:  "httpauth2ldap:",
+			Timeout: 250 * time.Millisecond,
+		},
+		Lockout: LockoutConfig{
+			Window:   15 * time.Minute,
+			Duration: 15 * time.Minute,
+		},
+		Blocklist: BlocklistConfig{
+			RefreshInterval: 15 * time.Minute,
+		},
+		Migration: MigrationConfig{
+			Mode: "enforce",
+		},
+		Policy: PolicyConfig{
+			GroupAttribute: "memberOf",
+		},
+		SMTP: SmtpConfig{
+			SenderAttributes: []string{"mail", "mailAlternateAddress"},
+			RejectCode:       "550 5.7.1",
+			Dnsbl: DnsblConfig{
+				Threshold:   1,
+				Action:      "reject",
+				TarpitDelay: 10 * time.Second,
+				CacheTTL:    10 * time.Minute,
+				Timeout:     2 * time.Second,
+			},
+		},
+		Sessions: SessionsConfig{
+			Window: time.Hour,
+		},
+		Honeypot: HoneypotConfig{
+			BanDuration: 24 * time.Hour,
+		},
+		Input: InputConfig{
+			MaxUsernameLength: 256,
+			MaxPasswordLength: 1024,
+		},
+		OAuth: OAuthConfig{
+			Leeway:          time.Minute,
+			RefreshInterval: time.Hour,
+		},
+		NTLM: NtlmConfig{
+			MaxSessions: 100,
+		},
+		Ldap: LdapConfig{
+			UserAttributes: []string{"uid"},
+			ObjectClass:    "organizationalPerson",
+			Scope:          "sub",
+			DerefAliases:   "never",
+			PasswordCheck:  "bind",
+			ScramAttribute: "userPassword",
+			ServicePool: PoolConfig{
+				MaxIdle:        8,
+				MaxLifetime:    10 * time.Minute,
+				AcquireTimeout: 5 * time.Second,
+			},
+			UserPool: PoolConfig{
+				MaxIdle:        4,
+				MaxLifetime:    time.Minute,
+				AcquireTimeout: 5 * time.Second,
+			},
+			LastLogin: LastLoginConfig{
+				// LDAP GeneralizedTime.
+				Format:   "20060102150405Z",
+				Interval: 24 * time.Hour,
+			},
+			DirectoryLockout: 15 * time.Minute,
+			Dial: DialConfig{
+				Family:        "any",
+				Prefer:        "ipv6",
+				FallbackDelay: 300 * time.Millisecond,
+			},
+			DNS: DNSConfig{
+				MinTTL:  5 * time.Second,
+				MaxTTL:  time.Hour,
+				Stale:   time.Hour,
+				Timeout: 2 * time.Second,
+			},
+			FailedLogins: FailedLoginsConfig{
+				Format:   "20060102150405Z",
+				Window:   15 * time.Minute,
+				Duration: 15 * time.Minute,
+			},
+		},
+	}
+}
+
+// liveConfig holds the running *Config. A reload publishes a new one, so a
+// request loads it once through currentConfig and keeps that snapshot.
+var liveConfig atomic.Value
+
+func init() {
+	liveConfig.Store(defaultConfig())
+}
+
+func currentConfig() *Config {
+	return liveConfig.Load().(*Config)
+}
+
+// loadConfig loads path and -config-kv over the defaults, along with the
+// backend chain they define.
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		if err := c.loadFile(path, make(map[string]bool)); err != nil {
+			return nil, err
+		}
+	}
+	if configSource != nil {
+		if err := c.loadKV(configSource); err != nil {
+			return nil, err
+		}
+	}
+	if path != "" || configSource != nil {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
+	links, err := newChain(c.Backends)
+	if err != nil {
+		return nil, err
+	}
+	c.chain = links
+	return c, nil
+}
+
+// loadFile merges path and, depth first, the files it includes into c. A
+// file reached again through another include is merged again, loading
+// holds the files being loaded to reject a file that includes itself.
+func (c *Config) loadFile(path string, loading map[string]bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if loading[abs] {
+		return fmt.Errorf("%s: include cycle", path)
+	}
+	loading[abs] = true
+	defer delete(loading, abs)
+	c.files = append(c.files, path)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if b, err = decryptConfig(path, b); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return yamlError(path, err)
+	}
+	var inc struct {
+		Include []string `yaml:"include,omitempty"`
+	}
+	yaml.Unmarshal(b, &inc)
+	c.Include = nil
+	for _, pattern := range inc.Include {
+		joined := pattern
+		if !filepath.IsAbs(joined) {
+			joined = filepath.Join(filepath.Dir(path), pattern)
+		}
+		c.dirs = append(c.dirs, filepath.Dir(joined), joined)
+		files, err := includedFiles(filepath.Dir(path), pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %s: %v", path, pattern, err)
+		}
+		for _, f := range files {
+			if err := c.loadFile(f, loading); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlError rewrites the "line N: ..." errors of yaml.v2 as "path:N: ..."
+// so that unknown keys and type errors point at the offending line.
+func yamlError(path string, err error) error {
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		return fmt.Errorf("%s: %v", path, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	msgs := make([]string, len(te.Errors))
+	for i, e := range te.Errors {
+		msg := strings.Replace(strings.TrimPrefix(e, "line "), "not found in type main.", "not found in ", 1)
+		msgs[i] = path + ":" + msg
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+}
+
+func includedFiles(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	var files []string
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, m)
+			continue
+		}
+		entries, err := ioutil.ReadDir(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && (strings.HasSuffix(e.Name(), ".yaml") || strings.HasSuffix(e.Name(), ".yml")) {
+				files = append(files, filepath.Join(m, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+func (c *Config) validate() error {
+	if c.Ldap.BindDnTemplate != "" && c.Ldap.Filter != "" {
+		return fmt.Errorf("ldap.bind_dn_template and ldap.filter are mutually exclusive")
+	}
+	if c.TLS.CertFile != "" && len(c.TLS.ACME.Hosts) > 0 {
+		return fmt.Errorf("tls.cert_file and tls.acme.hosts are mutually exclusive")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if err := c.Server.compileRoutes(); err != nil {
+		return err
+	}
+	nets, err := parseNetworks("server.trusted_proxies", c.Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	c.Server.trustedNets = nets
+	if err := c.Ldap.validate(); err != nil {
+		return err
+	}
+	if err := c.OAuth.compile(); err != nil {
+		return err
+	}
+	if err := c.Denylist.compile(); err != nil {
+		return err
+	}
+	if err := c.Migration.validate(); err != nil {
+		return err
+	}
+	if err := c.Shadow.compile(); err != nil {
+		return fmt.Errorf("shadow: %v", err)
+	}
+	if err := c.Canary.compile(); err != nil {
+		return fmt.Errorf("canary: %v", err)
+	}
+	if err := c.SMTP.Dnsbl.validate(); err != nil {
+		return err
+	}
+	if err := c.Policy.compile(); err != nil {
+		return err
+	}
+	if err := c.Audit.validate(); err != nil {
+		return err
+	}
+	if err := c.Runtime.validate(); err != nil {
+		return err
+	}
+	if err := c.Store.validate(); err != nil {
+		return err
+	}
+	return c.SMTP.Relay.compile()
+}
+
+// redacted renders c as YAML with the values of secretKeys masked.
+func (c *Config) redacted() ([]byte, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redactValue(doc))
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			if k, ok := item.Key.(string); ok && secretKeys[k] && item.Value != nil && item.Value != "" {
+				v[i].Value = "********"
+				continue
+			}
+			v[i].Value = redactValue(item.Value)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+// handleConfig serves the effective configuration with secrets masked.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	b, err := currentConfig().redacted()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
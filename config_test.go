@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, doc := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(doc), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadFileDiamondInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yaml":   "include: [a.yaml, b.yaml]\n",
+		"a.yaml":      "include: [common.yaml]\n",
+		"b.yaml":      "include: [common.yaml]\n",
+		"common.yaml": "sessions:\n  max_logins: 3\n",
+	})
+	c := defaultConfig()
+	if err := c.loadFile(filepath.Join(dir, "main.yaml"), make(map[string]bool)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Sessions.MaxLogins != 3 {
+		t.Errorf("sessions.max_logins = %d, want 3", c.Sessions.MaxLogins)
+	}
+}
+
+func TestLoadFileIncludeCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yaml": "include: [a.yaml]\n",
+		"a.yaml":    "include: [main.yaml]\n",
+	})
+	err := defaultConfig().loadFile(filepath.Join(dir, "main.yaml"), make(map[string]bool))
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("got %v, want an include cycle", err)
+	}
+}
+
+func TestLoadFileUnknownAuditFormat(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yaml": "audit:\n  file: /dev/null\n  format: syslog\n",
+	})
+	path := filepath.Join(dir, "main.yaml")
+	err := defaultConfig().loadFile(path, make(map[string]bool))
+	if err == nil || !strings.HasPrefix(err.Error(), path+":3: ") {
+		t.Errorf("got %v, want an error at %s:3", err, path)
+	}
+}
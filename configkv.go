@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configKV      = flag.String("config-kv", "", "Consul or etcd key holding YAML configuration merged over -config and watched for changes, as consul://host:8500/path/to/key or etcd://[user:password@]host:2379/path/to/key, with consul+https or etcd+https for TLS.")
+	configKVToken = flag.String("config-kv-token", os.Getenv("CONSUL_HTTP_TOKEN"), "Consul ACL token reading -config-kv.")
+	configKVCA    = flag.String("config-kv-ca", "", "PEM file of the CA certificates verifying the -config-kv server, the system roots by default.")
+)
+
+const (
+	// kvWaitTime bounds a blocking query or watch, after which it is sent
+	// again, so that a silently dropped connection is noticed.
+	kvWaitTime = 5 * time.Minute
+	// kvRetry is the pause after a failed query.
+	kvRetry = 5 * time.Second
+)
+
+// kvSource is a key of a KV store holding a configuration document. The
+// version increases with every change of the key.
+type kvSource interface {
+	// get returns the document, nil when the key doesn't exist, and its
+	// version.
+	get() ([]byte, uint64, error)
+	// wait returns once the key may have changed since version, at the
+	// latest after kvWaitTime.
+	wait(version uint64) error
+	// String names the key without credentials, for logs.
+	String() string
+}
+
+// configSource is nil without -config-kv.
+var configSource kvSource
+
+func newKVSource(raw string) (kvSource, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("%s: need a host and a key", u.Redacted())
+	}
+	client := &http.Client{}
+	if *configKVCA != "" {
+		pool, err := loadCertPool(*configKVCA)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}
+	}
+	base := url.URL{Scheme: "http", Host: u.Host}
+	kind := u.Scheme
+	if strings.HasSuffix(kind, "+https") {
+		base.Scheme = "https"
+		kind = strings.TrimSuffix(kind, "+https")
+	}
+	switch kind {
+	case "consul":
+		base.Path = "/v1/kv/" + key
+		base.RawQuery = u.RawQuery
+		return &consulSource{client: client, url: base, token: *configKVToken, name: u.Redacted()}, nil
+	case "etcd":
+		s := &etcdSource{client: client, base: base.String(), key: key, name: u.Redacted()}
+		if u.User != nil {
+			s.user = u.User.Username()
+			s.password, _ = u.User.Password()
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("%s: unknown scheme %q, need consul or etcd", u.Redacted(), u.Scheme)
+}
+
+// loadKV merges the document of src into c.
+func (c *Config) loadKV(src kvSource) error {
+	b, version, err := src.get()
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	if b == nil {
+		return fmt.Errorf("%s: key not found", src)
+	}
+	var meta struct {
+		Sops    interface{} `yaml:"sops"`
+		Include []string    `yaml:"include"`
+	}
+	yaml.Unmarshal(b, &meta)
+	if meta.Sops != nil {
+		return fmt.Errorf("%s: sops documents are not supported, use age: values", src)
+	}
+	if len(meta.Include) > 0 {
+		return fmt.Errorf("%s: include is not supported", src)
+	}
+	if b, err = decryptConfig(src.String(), b); err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return yamlError(src.String(), err)
+	}
+	c.kvVersion = version
+	return nil
+}
+
+// watchConfigKV reloads the configuration when the key of src changes,
+// starting from the version the running configuration was loaded at.
+func watchConfigKV(src kvSource, version uint64) {
+	for {
+		if err := src.wait(version); err != nil {
+			log.Printf("Unable to watch %s: %v", src, err)
+			time.Sleep(kvRetry)
+			continue
+		}
+		_, v, err := src.get()
+		if err != nil {
+			log.Printf("Unable to watch %s: %v", src, err)
+			time.Sleep(kvRetry)
+			continue
+		}
+		if v == version {
+			continue
+		}
+		version = v
+		reloadConfig()
+	}
+}
+
+// consulSource reads a key with the KV HTTP API of Consul, waiting with
+// blocking queries.
+type consulSource struct {
+	client *http.Client
+	url    url.URL
+	token  string
+	name   string
+}
+
+func (s *consulSource) String() string {
+	return s.name
+}
+
+func (s *consulSource) get() ([]byte, uint64, error) {
+	return s.query(nil)
+}
+
+func (s *consulSource) wait(version uint64) error {
+	_, _, err := s.query(url.Values{
+		"index": {strconv.FormatUint(version, 10)},
+		"wait":  {kvWaitTime.String()},
+	})
+	return err
+}
+
+func (s *consulSource) query(params url.Values) ([]byte, uint64, error) {
+	u := s.url
+	q := u.Query()
+	q.Set("raw", "")
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), kvWaitTime+time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return b, index, nil
+	case http.StatusNotFound:
+		return nil, index, nil
+	}
+	return nil, 0, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+}
+
+// etcdSource reads a key with the JSON gateway of etcd v3, waiting with
+// watches.
+type etcdSource struct {
+	client   *http.Client
+	base     string
+	key      string
+	name     string
+	user     string
+	password string
+
+	mu    sync.Mutex
+	token string
+}
+
+func (s *etcdSource) String() string {
+	return s.name
+}
+
+func (s *etcdSource) get() ([]byte, uint64, error) {
+	var out struct {
+		Header struct {
+			Revision uint64 `json:"revision,string"`
+		} `json:"header"`
+		Kvs []struct {
+			Value       []byte `json:"value"`
+			ModRevision uint64 `json:"mod_revision,string"`
+		} `json:"kvs"`
+	}
+	resp, err := s.post(context.Background(), "/v3/kv/range", map[string]interface{}{
+		"key": []byte(s.key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, err
+	}
+	if len(out.Kvs) == 0 {
+		return nil, out.Header.Revision, nil
+	}
+	// An empty value decodes as nil, but the key exists.
+	if out.Kvs[0].Value == nil {
+		out.Kvs[0].Value = []byte{}
+	}
+	return out.Kvs[0].Value, out.Kvs[0].ModRevision, nil
+}
+
+func (s *etcdSource) wait(version uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kvWaitTime)
+	defer cancel()
+	resp, err := s.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(s.key),
+			"start_revision": strconv.FormatUint(version+1, 10),
+		},
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		// A watch canceled because the revision was compacted means the
+		// key may have changed.
+		if len(msg.Result.Events) > 0 || msg.Result.Canceled {
+			return nil
+		}
+	}
+}
+
+// post sends a gateway request, authenticating first when a user is set and
+// again once its token expired.
+func (s *etcdSource) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	for retried := false; ; retried = true {
+		token, err := s.authToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+path, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && token != "" && !retried {
+			s.mu.Lock()
+			s.token = ""
+			s.mu.Unlock()
+			continue
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+}
+
+func (s *etcdSource) authToken(ctx context.Context) (string, error) {
+	if s.user == "" {
+		return "", nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" {
+		return s.token, nil
+	}
+	b, _ := json.Marshal(map[string]string{"name": s.user, "password": s.password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/v3/auth/authenticate", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("authenticate: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	s.token = out.Token
+	return s.token, nil
+}
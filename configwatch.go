@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var configWatch = flag.Duration("config-watch", defaultConfigWatch(), "how often to check the configuration files for changes and reload them, 0 disables. Defaults to 10s in Kubernetes.")
+
+func defaultConfigWatch() time.Duration {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return 10 * time.Second
+	}
+	return 0
+}
+
+// configFingerprint hashes the contents of the loaded files and the age
+// identity, and the names in the include directories. Kubernetes updates mounted
+// ConfigMaps and Secrets by swapping a ..data symlink, which changes neither
+// the path nor reliably the mtime of the files, so contents are compared.
+func configFingerprint(c *Config) [sha256.Size]byte {
+	h := sha256.New()
+	files := c.files
+	if *ageIdentity != "" {
+		files = append(files[:len(files):len(files)], *ageIdentity)
+	}
+	for _, f := range files {
+		b, _ := ioutil.ReadFile(f)
+		h.Write([]byte(f))
+		h.Write(b)
+	}
+	for _, d := range c.dirs {
+		entries, _ := ioutil.ReadDir(d)
+		for _, e := range entries {
+			h.Write([]byte(filepath.Join(d, e.Name())))
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// watchConfig reloads the configuration when its files change. An invalid
+// new configuration is logged and the running one kept. Listener, TLS, audit
+// and cache settings still need a restart.
+func watchConfig(interval time.Duration) {
+	last := configFingerprint(currentConfig())
+	for range time.Tick(interval) {
+		sum := configFingerprint(currentConfig())
+		if sum == last {
+			continue
+		}
+		last = sum
+		if reloadConfig() {
+			last = configFingerprint(currentConfig())
+		}
+	}
+}
+
+// reloadMu serializes the reloads of the file watcher, the KV watcher and
+// SIGHUP.
+var reloadMu sync.Mutex
+
+// reloadConfig loads -config and -config-kv again and switches to them if
+// they are valid. Requests already running finish on the old configuration.
+func reloadConfig() bool {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		log.Printf("Unable to reload configuration, keeping the current one: %v", err)
+		return false
+	}
+	liveConfig.Store(c)
+	log.Printf("Reloaded configuration from %s.", configOrigin())
+	return true
+}
+
+// configOrigin names where the configuration is loaded from, for logs.
+func configOrigin() string {
+	switch {
+	case configSource == nil:
+		return *configFile
+	case *configFile == "":
+		return configSource.String()
+	}
+	return *configFile + " and " + configSource.String()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// XAuthTimeout tells the daemon how long nginx waits for the answer, e.g.
+//
+//	auth_http_timeout 5s;
+//	auth_http_header X-Auth-Timeout 5s;
+//
+// The LDAP operations of the request are then cut off early enough to
+// answer with a temporary failure before nginx gives up on the subrequest.
+// gRPC calls are bounded by their own deadline alike.
+const XAuthTimeout = "X-Auth-Timeout"
+
+var authTimeoutMargin = flag.Duration("auth-timeout-margin", 500*time.Millisecond, "time kept back from the X-Auth-Timeout or gRPC deadline to answer in, at most half of it.")
+
+// errDeadline is returned by pooled operations cut off at the deadline of
+// the request, and is answered as a temporary failure.
+var errDeadline = errors.New("request deadline reached before the directory answered")
+
+// requestDeadline returns when the LDAP operations of r must be done, or
+// the zero time when r doesn't say.
+func requestDeadline(r *http.Request) time.Time {
+	now := time.Now()
+	var deadline time.Time
+	if v := r.Header.Get(XAuthTimeout); v != "" {
+		d, err := parseNginxTime(v)
+		if err != nil {
+			log.Printf("Ignoring %s %q: %v", XAuthTimeout, v, err)
+		} else {
+			deadline = now.Add(d)
+		}
+	}
+	if d, ok := r.Context().Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if deadline.IsZero() {
+		return deadline
+	}
+	margin := *authTimeoutMargin
+	if half := deadline.Sub(now) / 2; margin > half {
+		margin = half
+	}
+	return deadline.Add(-margin)
+}
+
+// parseNginxTime parses a time as nginx writes it in its configuration:
+// plain seconds or a Go duration such as 500ms or 1m30s.
+func parseNginxTime(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if n, nerr := strconv.Atoi(v); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return d, nil
+}
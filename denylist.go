@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DenylistConfig names logins that are always rejected without contacting
+// any backend. Entries are matched against both the local part and the full
+// user@domain login, ignoring case as the directories do.
+type DenylistConfig struct {
+	Users []string `yaml:"users"`
+	// Patterns are shell globs such as "postmaster*".
+	Patterns []string `yaml:"patterns"`
+	Regexes  []string `yaml:"regexes"`
+
+	patterns []string
+	regexes  []*regexp.Regexp
+}
+
+func (c *DenylistConfig) compile() error {
+	c.patterns = nil
+	for _, p := range c.Patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("denylist.patterns: %q: %v", p, err)
+		}
+		c.patterns = append(c.patterns, strings.ToLower(p))
+	}
+	c.regexes = nil
+	for _, r := range c.Regexes {
+		re, err := regexp.Compile("(?i)" + r)
+		if err != nil {
+			return fmt.Errorf("denylist.regexes: %v", err)
+		}
+		c.regexes = append(c.regexes, re)
+	}
+	return nil
+}
+
+func (c *DenylistConfig) denied(usr, domain string) bool {
+	for _, name := range []string{usr, usr + "@" + domain} {
+		if containsFold(c.Users, name) {
+			return true
+		}
+		lower := strings.ToLower(name)
+		for _, p := range c.patterns {
+			if ok, _ := path.Match(p, lower); ok {
+				return true
+			}
+		}
+		for _, re := range c.regexes {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestDenylistIgnoresCase(t *testing.T) {
+	c := &DenylistConfig{
+		Users:    []string{"root"},
+		Patterns: []string{"Postmaster*"},
+		Regexes:  []string{`^admin[0-9]+$`},
+	}
+	if err := c.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, usr := range []string{"Root", "POSTMASTER2", "Admin7"} {
+		if !c.denied(usr, "example.com") {
+			t.Errorf("%s@example.com is not denied", usr)
+		}
+	}
+	if c.denied("alice", "example.com") {
+		t.Error("alice@example.com is denied")
+	}
+}
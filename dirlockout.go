@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// directoryLocks remembers users the directory reported as locked out, so
+// no further binds are sent for them until ldap.directory_lockout passed.
+// Each of those binds would count as a failure and extend the lockout.
+var directoryLocks = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+func directoryLocked(addr, dn string) bool {
+	directoryLocks.Lock()
+	defer directoryLocks.Unlock()
+	k := addr + "\x00" + strings.ToLower(dn)
+	until, ok := directoryLocks.until[k]
+	if ok && time.Now().After(until) {
+		delete(directoryLocks.until, k)
+		return false
+	}
+	return ok
+}
+
+func lockDirectoryUser(addr, dn string, d time.Duration) {
+	directoryLocks.Lock()
+	defer directoryLocks.Unlock()
+	now := time.Now()
+	for k, until := range directoryLocks.until {
+		if now.After(until) {
+			delete(directoryLocks.until, k)
+		}
+	}
+	directoryLocks.until[addr+"\x00"+strings.ToLower(dn)] = now.Add(d)
+}
+
+// unlockDirectoryUser forgets a lockout, reporting whether there was one.
+func unlockDirectoryUser(addr, dn string) bool {
+	directoryLocks.Lock()
+	defer directoryLocks.Unlock()
+	k := addr + "\x00" + strings.ToLower(dn)
+	_, ok := directoryLocks.until[k]
+	delete(directoryLocks.until, k)
+	return ok
+}
+
+// isDirectoryLockout recognizes the lockout answers to a user bind: the
+// ppolicy accountLocked error sent with the password policy control, Active
+// Directory's "data 775" and 389 Directory Server's retry limit.
+func isDirectoryLockout(err error, res *ldap.SimpleBindResult) bool {
+	if res != nil {
+		for _, c := range res.Controls {
+			if pp, ok := c.(*ldap.ControlBeheraPasswordPolicy); ok && pp.Error == 1 {
+				return true
+			}
+		}
+	}
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		return strings.Contains(err.Error(), "data 775")
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation):
+		return strings.Contains(err.Error(), "retry limit")
+	}
+	return false
+}
+
+// bindUser binds as dn asking for the password policy control, and turns
+// lockouts into errLockedInDirectory.
+func bindUser(cred *LdapCredential, dn string) error {
+	if directoryLocked(cred.ldapAddr, dn) {
+		return errLockedInDirectory
+	}
+	var res *ldap.SimpleBindResult
+	err := userPool(cred.ldapAddr).doUntil(cred.deadline, func(u *pooledConn) (err error) {
+		res, err = u.SimpleBind(&ldap.SimpleBindRequest{
+			Username: dn,
+			Password: cred.pwd,
+			Controls: []ldap.Control{ldap.NewControlBeheraPasswordPolicy()},
+		})
+		return err
+	})
+	if err != nil && isDirectoryLockout(err, res) {
+		log.Printf("Directory reports %s as locked out, not binding as it for %s: %v", dn, cred.ldapConf().DirectoryLockout, err)
+		if !cred.shadow {
+			lockDirectoryUser(cred.ldapAddr, dn, cred.ldapConf().DirectoryLockout)
+		}
+		return errLockedInDirectory
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DnsblConfig scores SMTP clients against DNS blocklists. A client whose
+// summed score reaches Threshold is rejected, or with Action tarpit only has
+// its response delayed by TarpitDelay.
+type DnsblConfig struct {
+	Lists       []DnsblList   `yaml:"lists"`
+	Threshold   int           `yaml:"threshold"`
+	Action      string        `yaml:"action"`
+	TarpitDelay time.Duration `yaml:"tarpit_delay"`
+	CacheTTL    time.Duration `yaml:"cache_ttl"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// DnsblList is one zone, e.g. zen.spamhaus.org, and the score of a listing.
+type DnsblList struct {
+	Zone  string `yaml:"zone"`
+	Score int    `yaml:"score"`
+}
+
+type dnsblResult struct {
+	score   int
+	zones   []string
+	expires time.Time
+}
+
+var dnsblCache = struct {
+	sync.Mutex
+	m map[string]dnsblResult
+	// swept is when the expired results were last dropped.
+	swept time.Time
+}{m: make(map[string]dnsblResult)}
+
+func (c *DnsblConfig) validate() error {
+	if c.Action != "reject" && c.Action != "tarpit" {
+		return fmt.Errorf("smtp.dnsbl.action must be reject or tarpit, got %q", c.Action)
+	}
+	return nil
+}
+
+// reverseIP returns the DNSBL query label of ip: reversed octets for IPv4
+// and reversed nibbles for IPv6.
+func reverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		if i > 0 {
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
+
+// lookup queries all lists concurrently. Lists that don't answer in time
+// count as not listing the client.
+func (c *DnsblConfig) lookup(ip net.IP) dnsblResult {
+	key := ip.String()
+	dnsblCache.Lock()
+	res, ok := dnsblCache.m[key]
+	dnsblCache.Unlock()
+	if ok && time.Now().Before(res.expires) {
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	rev := reverseIP(ip)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	res = dnsblResult{}
+	for _, l := range c.Lists {
+		wg.Add(1)
+		go func(l DnsblList) {
+			defer wg.Done()
+			addrs, err := net.DefaultResolver.LookupHost(ctx, rev+"."+l.Zone)
+			if err != nil || len(addrs) == 0 {
+				return
+			}
+			mu.Lock()
+			res.score += l.Score
+			res.zones = append(res.zones, l.Zone)
+			mu.Unlock()
+		}(l)
+	}
+	wg.Wait()
+	res.expires = time.Now().Add(c.CacheTTL)
+
+	dnsblCache.Lock()
+	// Sweep once per TTL, so that a new client costs no scan of the cache.
+	if now := time.Now(); now.Sub(dnsblCache.swept) > c.CacheTTL {
+		for k, v := range dnsblCache.m {
+			if now.After(v.expires) {
+				delete(dnsblCache.m, k)
+			}
+		}
+		dnsblCache.swept = now
+	}
+	dnsblCache.m[key] = res
+	dnsblCache.Unlock()
+	return res
+}
+
+// check reports whether an smtp request may go on, tarpitting or rejecting
+// listed clients itself.
+func (c *DnsblConfig) check(w http.ResponseWriter, r *http.Request) bool {
+	if len(c.Lists) == 0 || r.Header.Get(AuthProtocol) != "smtp" {
+		return true
+	}
+	ip := net.ParseIP(r.Header.Get(ClientIP))
+	if ip == nil {
+		return true
+	}
+	res := c.lookup(ip)
+	if res.score < c.Threshold || res.score == 0 {
+		return true
+	}
+	if c.Action == "tarpit" {
+		log.Printf("Tarpitting %s listed on %s (score %d).", ip, strings.Join(res.zones, ", "), res.score)
+		time.Sleep(c.TarpitDelay)
+		return true
+	}
+	w.Header().Set(AuthErrorCode, currentConfig().SMTP.RejectCode)
+	authFailed(w, r, codeBlocklisted, fmt.Sprintf("Client %s is listed on %s (score %d).", ip, strings.Join(res.zones, ", "), res.score))
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSConfig caches the addresses of LDAP server names, so a DNS blip doesn't
+// fail logins. Entries live for the record TTL bounded by MinTTL and MaxTTL
+// and, when resolving fails, are used for up to Stale longer. Resolvers are
+// host:port servers queried instead of those of /etc/resolv.conf.
+type DNSConfig struct {
+	Cache     bool          `yaml:"cache"`
+	Resolvers []string      `yaml:"resolvers"`
+	MinTTL    time.Duration `yaml:"min_ttl"`
+	MaxTTL    time.Duration `yaml:"max_ttl"`
+	Stale     time.Duration `yaml:"stale"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+func (c *DNSConfig) enabled() bool {
+	return c.Cache || len(c.Resolvers) > 0
+}
+
+type dnsEntry struct {
+	addrs      []string
+	expires    time.Time
+	staleUntil time.Time
+}
+
+// staleRetry is how often resolving is retried while stale addresses are used.
+const staleRetry = 10 * time.Second
+
+var dnsCache = struct {
+	sync.Mutex
+	entries map[string]*dnsEntry
+}{entries: make(map[string]*dnsEntry)}
+
+// resolveHost returns the addresses of host, from the cache when fresh.
+func (c *DNSConfig) resolveHost(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	now := time.Now()
+	dnsCache.Lock()
+	var cached dnsEntry
+	e, ok := dnsCache.entries[host]
+	if ok {
+		cached = *e
+	}
+	dnsCache.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	addrs, ttl, err := c.query(host)
+	if err != nil {
+		if ok && now.Before(cached.staleUntil) {
+			log.Printf("Unable to resolve %s, using the addresses resolved before: %v", host, err)
+			dnsCache.Lock()
+			e.expires = now.Add(staleRetry)
+			dnsCache.Unlock()
+			return cached.addrs, nil
+		}
+		return nil, err
+	}
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	dnsCache.Lock()
+	dnsCache.entries[host] = &dnsEntry{addrs: addrs, expires: now.Add(ttl), staleUntil: now.Add(ttl + c.Stale)}
+	dnsCache.Unlock()
+	return addrs, nil
+}
+
+// forgetHost makes host be resolved again after none of its addresses
+// answered.
+func forgetHost(host string) {
+	dnsCache.Lock()
+	if e, ok := dnsCache.entries[host]; ok {
+		e.expires = time.Time{}
+	}
+	dnsCache.Unlock()
+}
+
+// query asks the resolvers for the A and AAAA records of host. The TTL is
+// the lowest of the answers.
+func (c *DNSConfig) query(host string) ([]string, time.Duration, error) {
+	servers := c.Resolvers
+	if len(servers) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, s := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(s, conf.Port))
+		}
+	}
+	client := &dns.Client{Timeout: c.Timeout}
+	var addrs []string
+	var ttl uint32
+	var lastErr error = errors.New("no resolvers")
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+		for _, server := range servers {
+			resp, _, err := client.Exchange(m, server)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if resp.Rcode != dns.RcodeSuccess {
+				lastErr = fmt.Errorf("%s answered %s for %s", server, dns.RcodeToString[resp.Rcode], host)
+				if resp.Rcode == dns.RcodeNameError {
+					break
+				}
+				continue
+			}
+			for _, rr := range resp.Answer {
+				var ip net.IP
+				switch a := rr.(type) {
+				case *dns.A:
+					ip = a.A
+				case *dns.AAAA:
+					ip = a.AAAA
+				default:
+					continue
+				}
+				addrs = append(addrs, ip.String())
+				if h := rr.Header(); ttl == 0 || h.Ttl < ttl {
+					ttl = h.Ttl
+				}
+			}
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, lastErr
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// dialHost connects to one of the addresses of host. With the cache, when
+// none answers, host is resolved once more, so a directory that moved is
+// picked up.
+func dialHost(dialer *net.Dialer, host, port string) (net.Conn, error) {
+	conf := currentConfig()
+	c, dc := &conf.Ldap.DNS, &conf.Ldap.Dial
+	if !c.enabled() {
+		addrs, err := lookupHost(host, dialer.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return dc.dial(dialer, addrs, port)
+	}
+	addrs, err := c.resolveHost(host)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := dc.dial(dialer, addrs, port)
+	if err == nil || net.ParseIP(host) != nil {
+		return nc, err
+	}
+	forgetHost(host)
+	fresh, rerr := c.resolveHost(host)
+	if rerr != nil || sameAddrs(addrs, fresh) {
+		return nil, err
+	}
+	log.Printf("Addresses of %s changed to %v, retrying.", host, fresh)
+	return dc.dial(dialer, fresh, port)
+}
+
+// lookupHost resolves host with the system resolver.
+func lookupHost(host string, timeout time.Duration) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+
+	"gopkg.in/ldap.v3"
+)
+
+var statusErrorCodes = flag.Bool("status-error-codes", false, "append the error code of failures to Auth-Status, e.g. \"Invalid login or password [ERR_INVALID_CREDENTIALS]\".")
+
+// errCode is the stable, machine-readable identifier of a failure, shown
+// in the log, the audit events, the metrics and the JSON and gRPC answers.
+// Each belongs to a reason, the coarser grouping that picks the catalog
+// message and the SMTP and gRPC status codes.
+type errCode string
+
+const (
+	codeUnsupportedMethod  errCode = "ERR_UNSUPPORTED_METHOD"
+	codeBadRequest         errCode = "ERR_BAD_REQUEST"
+	codeBadUsername        errCode = "ERR_BAD_USERNAME"
+	codeInvalidInput       errCode = "ERR_INVALID_INPUT"
+	codeNoUser             errCode = "ERR_NO_USER"
+	codeBadPassword        errCode = "ERR_BAD_PASSWORD"
+	codeBadToken           errCode = "ERR_BAD_TOKEN"
+	codeHoneypot           errCode = "ERR_HONEYPOT"
+	codeLdapError          errCode = "ERR_LDAP_ERROR"
+	codeInvalidCredentials errCode = "ERR_INVALID_CREDENTIALS"
+	codeBanned             errCode = "ERR_BANNED"
+	codeBlocklisted        errCode = "ERR_BLOCKLISTED"
+	codeDeniedUser         errCode = "ERR_DENIED_USER"
+	codePolicyDenied       errCode = "ERR_POLICY_DENIED"
+	codeEnvelopeRejected   errCode = "ERR_ENVELOPE_REJECTED"
+	codeLocked             errCode = "ERR_LOCKED"
+	codeBadCertificate     errCode = "ERR_BAD_CERTIFICATE"
+	codeInternal           errCode = "ERR_INTERNAL"
+	codeLdapUnavailable    errCode = "ERR_LDAP_UNAVAILABLE"
+	codeServiceBind        errCode = "ERR_SERVICE_BIND"
+	codeOverloaded         errCode = "ERR_OVERLOADED"
+	codeTimeout            errCode = "ERR_TIMEOUT"
+	codeTemporary          errCode = "ERR_TEMPORARY"
+)
+
+var codeReasons = map[errCode]string{
+	codeUnsupportedMethod:  reasonUnsupportedMethod,
+	codeBadRequest:         reasonBadRequest,
+	codeBadUsername:        reasonBadUsername,
+	codeInvalidInput:       reasonInvalidInput,
+	codeNoUser:             reasonInvalidCredentials,
+	codeBadPassword:        reasonInvalidCredentials,
+	codeBadToken:           reasonInvalidCredentials,
+	codeHoneypot:           reasonInvalidCredentials,
+	codeLdapError:          reasonInvalidCredentials,
+	codeInvalidCredentials: reasonInvalidCredentials,
+	codeBanned:             reasonBanned,
+	codeBlocklisted:        reasonBanned,
+	codeDeniedUser:         reasonDeniedUser,
+	codePolicyDenied:       reasonPolicyDenied,
+	codeEnvelopeRejected:   reasonEnvelopeRejected,
+	codeLocked:             reasonLocked,
+	codeBadCertificate:     reasonBadCertificate,
+	codeInternal:           reasonInternalError,
+	codeLdapUnavailable:    reasonTemporaryFailure,
+	codeServiceBind:        reasonTemporaryFailure,
+	codeOverloaded:         reasonTemporaryFailure,
+	codeTimeout:            reasonTemporaryFailure,
+	codeTemporary:          reasonTemporaryFailure,
+}
+
+func (c errCode) reason() string {
+	if c == "" {
+		return ""
+	}
+	if reason, ok := codeReasons[c]; ok {
+		return reason
+	}
+	return reasonInternalError
+}
+
+func (c errCode) temporary() bool {
+	return c.reason() == reasonTemporaryFailure
+}
+
+// public is the code told to clients. Unless -error-detail=detailed, the
+// codes that would reveal whether a user exists, or is a honeypot, are all
+// told as ERR_INVALID_CREDENTIALS.
+func (c errCode) public() errCode {
+	if *errorDetail != "detailed" && c.reason() == reasonInvalidCredentials {
+		return codeInvalidCredentials
+	}
+	return c
+}
+
+// statusWithCode appends the public code to the Auth-Status message with
+// -status-error-codes.
+func statusWithCode(status string, c errCode) string {
+	if !*statusErrorCodes {
+		return status
+	}
+	return status + " [" + string(c.public()) + "]"
+}
+
+// failureCode classifies an error of the authentication backends.
+func failureCode(err error) errCode {
+	if sb, ok := err.(serviceBindError); ok {
+		if ldap.IsErrorWithCode(sb.err, ldap.LDAPResultInvalidCredentials) {
+			return codeServiceBind
+		}
+		return failureCode(sb.err)
+	}
+	switch {
+	case err == errUserNotFound:
+		return codeNoUser
+	case err == errLockedInDirectory:
+		return codeLocked
+	case err == errPoolExhausted:
+		return codeOverloaded
+	case err == errDeadline:
+		return codeTimeout
+	case definitiveFailure(err):
+		return codeBadPassword
+	case ldap.IsErrorWithCode(err, ldap.ErrorNetwork),
+		ldap.IsErrorWithCode(err, ldap.LDAPResultBusy),
+		ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailable),
+		ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded),
+		ldap.IsErrorWithCode(err, ldap.LDAPResultAdminLimitExceeded):
+		// The directory is down or shedding load, which says nothing about
+		// the password and must not count toward lockouts.
+		return codeLdapUnavailable
+	}
+	return codeLdapError
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventsConfig configures where security events are sent.
+type EventsConfig struct {
+	Webhooks   []WebhookConfig `yaml:"webhooks"`
+	Retries    int             `yaml:"retries"`
+	RetryDelay time.Duration   `yaml:"retry_delay"`
+}
+
+// WebhookConfig is one receiver of security events. When Secret is set the
+// body is signed with HMAC-SHA256 in the X-Httpauth2ldap-Signature header.
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// Events limits the event types sent, empty sends all of them.
+	Events []string `yaml:"events"`
+}
+
+const (
+	eventHoneypot    = "honeypot"
+	eventLdapOutage  = "ldap_outage"
+	eventLockout     = "lockout"
+	eventBruteForce  = "brute_force"
+	eventSessions    = "session_limit"
+	webhookSignature = "X-Httpauth2ldap-Signature"
+)
+
+type securityEvent struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// emitEvent posts ev to the webhooks in the background so alerting never
+// delays the auth response.
+func emitEvent(ev securityEvent) {
+	ev.Time = time.Now().UTC()
+	log.Printf("Security event %s: user=%q client=%s %s", ev.Type, ev.User, ev.ClientIP, ev.Detail)
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	c := &currentConfig().Events
+	for _, wh := range c.Webhooks {
+		if len(wh.Events) > 0 && !contains(wh.Events, ev.Type) {
+			continue
+		}
+		go c.deliver(wh, ev.Type, b)
+	}
+}
+
+func (c *EventsConfig) deliver(wh WebhookConfig, typ string, body []byte) {
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(wh, body)
+		if err == nil {
+			return
+		}
+		if attempt >= c.Retries {
+			log.Printf("Unable to deliver %s event to %s: %v", typ, wh.URL, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhook(wh WebhookConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// eventThrottle keeps recurring conditions, such as an unreachable LDAP
+// server, from emitting an event per request.
+type eventThrottle struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+var throttle = &eventThrottle{last: make(map[string]time.Time)}
+
+func (t *eventThrottle) emit(key string, every time.Duration, ev securityEvent) {
+	t.mu.Lock()
+	now := time.Now()
+	if now.Sub(t.last[key]) < every {
+		t.mu.Unlock()
+		return
+	}
+	t.last[key] = now
+	t.mu.Unlock()
+	emitEvent(ev)
+}
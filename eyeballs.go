@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DialConfig chooses among the addresses of a directory name. Family
+// restricts them to ipv4 or ipv6, any allows both. Both families are tried
+// Happy Eyeballs style (RFC 8305): addresses alternate starting with Prefer,
+// and when one hasn't connected after FallbackDelay the next is tried
+// alongside it, so a broken IPv6 path doesn't stall until the dial timeout.
+type DialConfig struct {
+	Family        string        `yaml:"family"`
+	Prefer        string        `yaml:"prefer"`
+	FallbackDelay time.Duration `yaml:"fallback_delay"`
+	// Proxy is a socks5://[user:password@]host:port or http:// CONNECT
+	// proxy the directories are reached through.
+	Proxy string `yaml:"proxy"`
+}
+
+func (c *DialConfig) validate() error {
+	switch c.Family {
+	case "any", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("ldap.dial.family must be any, ipv4 or ipv6, got %q", c.Family)
+	}
+	switch c.Prefer {
+	case "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("ldap.dial.prefer must be ipv4 or ipv6, got %q", c.Prefer)
+	}
+	return checkProxy("ldap.dial.proxy", c.Proxy)
+}
+
+// order filters addrs by family and interleaves them, preferred family first.
+func (c *DialConfig) order(addrs []string) []string {
+	var v4, v6 []string
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			if c.Family != "ipv6" {
+				v4 = append(v4, a)
+			}
+		case c.Family != "ipv4":
+			v6 = append(v6, a)
+		}
+	}
+	first, second := v6, v4
+	if c.Prefer == "ipv4" {
+		first, second = v4, v6
+	}
+	ordered := make([]string, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+type dialResult struct {
+	nc  net.Conn
+	err error
+}
+
+// dial races connections to addrs, starting the next one whenever the
+// previous failed or FallbackDelay passed, and returns the first to connect.
+func (c *DialConfig) dial(dialer *net.Dialer, addrs []string, port string) (net.Conn, error) {
+	addrs = c.order(addrs)
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses of the allowed family")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	next, running := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next], port)
+		next++
+		running++
+		go func() {
+			nc, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- dialResult{nc, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(c.FallbackDelay)
+	defer timer.Stop()
+	var firstErr error
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// The losers are cancelled; close any that connected anyway.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.nc != nil {
+							r.nc.Close()
+						}
+					}
+				}(running)
+				return r.nc, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				timer.Reset(c.FallbackDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(c.FallbackDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// errLockedInDirectory is returned for users the directory marks as locked
+// out, so the failure is reported as a lockout rather than a bad password.
+var errLockedInDirectory = errors.New("account is locked in the directory")
+
+// FailedLoginsConfig counts failed logins on the user's entry, so every
+// daemon and other LDAP consumers see the same lockout state. CountAttribute
+// holds the failures since TimeAttribute, the time of the first one, within
+// Window. Users reaching Max are refused until Window plus Duration after
+// the first failure, without their password being tried. Only searched
+// users are counted, not those bound through ldap.bind_dn_template.
+// Directories with ppolicy count and lock by themselves and don't need this.
+type FailedLoginsConfig struct {
+	CountAttribute string        `yaml:"count_attribute"`
+	TimeAttribute  string        `yaml:"time_attribute"`
+	Format         string        `yaml:"format"`
+	Max            int           `yaml:"max"`
+	Window         time.Duration `yaml:"window"`
+	Duration       time.Duration `yaml:"duration"`
+}
+
+func (c *FailedLoginsConfig) enabled() bool {
+	return c.CountAttribute != ""
+}
+
+func (c *FailedLoginsConfig) validate() error {
+	if c.enabled() && c.TimeAttribute == "" {
+		return fmt.Errorf("ldap.failed_logins.time_attribute is required with count_attribute")
+	}
+	return nil
+}
+
+func (c *FailedLoginsConfig) attributes() []string {
+	if !c.enabled() {
+		return nil
+	}
+	return []string{c.CountAttribute, c.TimeAttribute}
+}
+
+// state reads the count and the time of the first failure from entry,
+// treating counts older than the window as zero.
+func (c *FailedLoginsConfig) state(entry *ldap.Entry) (count int, first time.Time) {
+	count, _ = strconv.Atoi(entry.GetAttributeValue(c.CountAttribute))
+	first, err := time.Parse(c.Format, entry.GetAttributeValue(c.TimeAttribute))
+	if err != nil || time.Since(first) > c.Window+c.Duration {
+		return 0, time.Time{}
+	}
+	return count, first
+}
+
+// check refuses users whose count reached the maximum.
+func (c *FailedLoginsConfig) check(entry *ldap.Entry) error {
+	if !c.enabled() || c.Max <= 0 {
+		return nil
+	}
+	if count, _ := c.state(entry); count >= c.Max {
+		return errLockedInDirectory
+	}
+	return nil
+}
+
+// failed increments the count of entry. The old value is deleted and the
+// new one added in one modify, which fails instead of losing an increment
+// when another daemon updated the count in the meantime.
+func (c *FailedLoginsConfig) failed(cred *LdapCredential, entry *ldap.Entry) {
+	if !c.enabled() {
+		return
+	}
+	count, first := c.state(entry)
+	now := time.Now()
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	if count == 0 || now.Sub(first) > c.Window && count < c.Max {
+		req.Replace(c.CountAttribute, []string{"1"})
+		req.Replace(c.TimeAttribute, []string{now.UTC().Format(c.Format)})
+	} else {
+		if old := entry.GetAttributeValue(c.CountAttribute); old != "" {
+			req.Delete(c.CountAttribute, []string{old})
+		}
+		req.Add(c.CountAttribute, []string{strconv.Itoa(count + 1)})
+	}
+	c.modify(cred, req)
+}
+
+// succeeded clears a count left by earlier failures.
+func (c *FailedLoginsConfig) succeeded(cred *LdapCredential, entry *ldap.Entry) {
+	if !c.enabled() || entry.GetAttributeValue(c.CountAttribute) == "" {
+		return
+	}
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	req.Delete(c.CountAttribute, nil)
+	req.Delete(c.TimeAttribute, nil)
+	c.modify(cred, req)
+}
+
+// modify runs as the service account, off the request path. Shadow
+// authentications write nothing.
+func (c *FailedLoginsConfig) modify(cred *LdapCredential, req *ldap.ModifyRequest) {
+	if cred.shadow {
+		return
+	}
+	sp := servicePool(cred)
+	go func() {
+		err := sp.do(func(conn *pooledConn) error {
+			return conn.Modify(req)
+		})
+		if err != nil {
+			log.Printf("Unable to update the failed login count of %s: %v", req.DN, err)
+		}
+	}()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative auth.proto
+
+var grpcAddr = flag.String("grpc-addr", "", "address serving the Authenticator gRPC service of auth.proto. Empty disables it.")
+
+// reasonCodes maps failure reasons to gRPC status codes.
+var reasonCodes = map[string]codes.Code{
+	reasonUnsupportedMethod:  codes.InvalidArgument,
+	reasonBadRequest:         codes.InvalidArgument,
+	reasonBadUsername:        codes.InvalidArgument,
+	reasonInvalidInput:       codes.InvalidArgument,
+	reasonInvalidCredentials: codes.Unauthenticated,
+	reasonBadCertificate:     codes.Unauthenticated,
+	reasonBanned:             codes.PermissionDenied,
+	reasonDeniedUser:         codes.PermissionDenied,
+	reasonPolicyDenied:       codes.PermissionDenied,
+	reasonEnvelopeRejected:   codes.PermissionDenied,
+	reasonLocked:             codes.ResourceExhausted,
+	reasonInternalError:      codes.Internal,
+	reasonTemporaryFailure:   codes.Unavailable,
+}
+
+// grpcServer serves auth.proto by running each call through h, the same
+// handler as auth_http requests.
+type grpcServer struct {
+	UnimplementedAuthenticatorServer
+	h http.HandlerFunc
+}
+
+func newGrpcServer(h http.HandlerFunc, tlsConf *tls.Config) *grpc.Server {
+	var opts []grpc.ServerOption
+	if tlsConf != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
+	s := grpc.NewServer(opts...)
+	RegisterAuthenticatorServer(s, &grpcServer{h: h})
+	return s
+}
+
+func (s *grpcServer) Authenticate(ctx context.Context, in *AuthenticateRequest) (*AuthenticateResponse, error) {
+	out, h, err := s.run(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	resp := &AuthenticateResponse{Headers: h}
+	if out.entry != nil {
+		resp.Dn = out.entry.DN
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Authorize(ctx context.Context, in *AuthorizeRequest) (*AuthorizeResponse, error) {
+	if len(in.GetGroups()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no groups to authorize against")
+	}
+	out, h, err := s.run(ctx, in.GetCredentials())
+	if err != nil {
+		return nil, err
+	}
+	resp := &AuthorizeResponse{Headers: h}
+	if out.entry != nil {
+		resp.Dn = out.entry.DN
+		for _, g := range in.Groups {
+			if inGroup(out.entry, currentConfig().Policy.GroupAttribute, []string{g}) {
+				resp.Groups = append(resp.Groups, g)
+			}
+		}
+	}
+	if len(resp.Groups) == 0 {
+		user := in.GetCredentials().GetUsername()
+		log.Printf("Authorization of %s denied, not a member of %s.", user, strings.Join(in.Groups, ", "))
+		return nil, failureStatus(codePolicyDenied, fmt.Sprintf("User %s is not a member of the groups.", user), 0)
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Sasl(ctx context.Context, in *SaslRequest) (*SaslResponse, error) {
+	r, err := s.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	protocol, clientIp := callDefaults(r, in.Protocol, in.ClientIp)
+	r, sasl, err := saslRequest(r, in.Mechanism, in.Session, in.Response, protocol, clientIp)
+	if _, ok := err.(saslUnavailable); ok {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer sasl.release()
+	if r == nil {
+		return &SaslResponse{Challenge: []byte(sasl.challenge), Session: sasl.id}, nil
+	}
+	out, h, err := s.serve(ctx, r)
+	if out == nil {
+		return nil, err
+	}
+	if sasl.id != "" {
+		return &SaslResponse{Challenge: []byte(sasl.challenge), Session: sasl.id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := &SaslResponse{Challenge: []byte(sasl.challenge), Done: true, Headers: h}
+	if out.entry != nil {
+		resp.Dn = out.entry.DN
+	}
+	return resp, nil
+}
+
+// run turns the call into an auth_http request for a plain login.
+func (s *grpcServer) run(ctx context.Context, in *AuthenticateRequest) (*authOutcome, map[string]string, error) {
+	if in == nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "missing credentials")
+	}
+	r, err := s.request(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	protocol, clientIp := callDefaults(r, in.Protocol, in.ClientIp)
+	return s.serve(ctx, authHttpRequest(r, in.Username, in.Password, protocol, clientIp))
+}
+
+// request builds the base request of a call, taking the X-Ldap-* and
+// client authentication headers from the metadata and the host from the
+// authority.
+func (s *grpcServer) request(ctx context.Context) (*http.Request, error) {
+	method, _ := grpc.Method(ctx)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, method, nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, v := range md {
+		if !strings.HasPrefix(k, ":") {
+			r.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	if !currentConfig().ClientAuth.verify(r) {
+		log.Printf("Rejected gRPC call from %s without a valid shared secret or signature.", r.RemoteAddr)
+		return nil, status.Error(codes.PermissionDenied, "missing or invalid client authentication")
+	}
+	trustCaller(r, "")
+	r.Host = *grpcAddr
+	if a := md.Get(":authority"); len(a) > 0 {
+		if _, _, err := net.SplitHostPort(a[0]); err == nil {
+			r.Host = a[0]
+		}
+	}
+	return r, nil
+}
+
+func callDefaults(r *http.Request, protocol, clientIp string) (string, string) {
+	if protocol == "" {
+		protocol = "grpc"
+	}
+	return protocol, trustCaller(r, clientIp)
+}
+
+// serve runs r through h. The deadline of the call also bounds its LDAP
+// operations, see requestDeadline.
+func (s *grpcServer) serve(ctx context.Context, r *http.Request) (*authOutcome, map[string]string, error) {
+	r, out := withOutcome(r)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.h(rec, r)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	if tp := rec.Header().Get(Traceparent); tp != "" {
+		grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(Traceparent), tp))
+	}
+	authStatus := rec.Header().Get(AuthStatus)
+	if authStatus != "OK" {
+		wait, _ := strconv.Atoi(rec.Header().Get(AuthWait))
+		return nil, nil, failureStatus(out.code, authStatus, wait)
+	}
+	h := make(map[string]string)
+	for k, v := range rec.Header() {
+		switch k {
+		case AuthStatus, Traceparent, Tracestate:
+			continue
+		}
+		h[k] = v[0]
+	}
+	return out, h, nil
+}
+
+// stopGrpc waits for running calls until ctx is done.
+func stopGrpc(ctx context.Context, s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+
+// failureStatus carries the public error code as the reason of an
+// ErrorInfo, with the reason grouping it in the metadata, and, when the
+// client should retry later, a RetryInfo.
+func failureStatus(ec errCode, msg string, wait int) error {
+	code, ok := reasonCodes[ec.reason()]
+	if !ok {
+		code = codes.Unknown
+	}
+	st := status.New(code, msg)
+	info := &errdetails.ErrorInfo{Reason: string(ec.public()), Domain: "httpauth2ldap", Metadata: map[string]string{"reason": ec.reason()}}
+	details := []protoadapt.MessageV1{info}
+	if wait > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(wait) * time.Second)})
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strings"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/apr1_crypt"
+	_ "github.com/GehirnInc/crypt/md5_crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// checkSaltedHash verifies RFC 2307 style {SHA}/{SSHA} values, which are the
+// base64 of the digest followed by the salt.
+func checkSaltedHash(newHash func() hash.Hash, encoded, pwd string) bool {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	h := newHash()
+	if err != nil || len(raw) < h.Size() {
+		return false
+	}
+	digest, salt := raw[:h.Size()], raw[h.Size():]
+	h.Write([]byte(pwd))
+	h.Write(salt)
+	return subtle.ConstantTimeCompare(digest, h.Sum(nil)) == 1
+}
+
+// checkCrypt verifies crypt(3) strings: $1$, $5$, $6$, $apr1$ and bcrypt.
+func checkCrypt(stored, pwd string) bool {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pwd)) == nil
+	}
+	if !crypt.IsHashSupported(stored) {
+		return false
+	}
+	return crypt.NewFromHash(stored).Verify(stored, []byte(pwd)) == nil
+}
+
+// checkHashedPassword verifies pwd against a userPassword value. Values
+// without a recognized {SCHEME} never match, so cleartext passwords are not
+// accepted.
+func checkHashedPassword(stored, pwd string) bool {
+	end := strings.IndexByte(stored, '}')
+	if !strings.HasPrefix(stored, "{") || end < 0 {
+		return strings.HasPrefix(stored, "$") && checkCrypt(stored, pwd)
+	}
+	scheme, value := strings.ToUpper(stored[1:end]), stored[end+1:]
+	switch scheme {
+	case "SHA", "SSHA":
+		return checkSaltedHash(sha1.New, value, pwd)
+	case "SHA256", "SSHA256":
+		return checkSaltedHash(sha256.New, value, pwd)
+	case "SHA512", "SSHA512":
+		return checkSaltedHash(sha512.New, value, pwd)
+	case "CRYPT", "BCRYPT":
+		return checkCrypt(value, pwd)
+	}
+	return false
+}
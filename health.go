@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	failFast    = flag.Bool("fail-fast", false, "at startup, dial and service-bind every configured LDAP backend and exit if one fails.")
+	readyWindow = flag.Duration("ready-window", 30*time.Second, "age after which /readyz refreshes the LDAP health by binding to the configured backends.")
+)
+
+type serverHealth struct {
+	at  time.Time
+	err error
+}
+
+// ldapHealth remembers the latest service bind outcome per LDAP server, so
+// that /readyz can take the instance out of rotation while no directory is
+// reachable.
+var ldapHealth = struct {
+	sync.Mutex
+	servers map[string]serverHealth
+}{servers: make(map[string]serverHealth)}
+
+func recordLdapHealth(addr string, err error) {
+	ldapHealth.Lock()
+	ldapHealth.servers[addr] = serverHealth{at: time.Now(), err: err}
+	ldapHealth.Unlock()
+}
+
+// ldapReady succeeds while at least one LDAP server answered the latest
+// service bind, or none has been contacted yet.
+func ldapReady() error {
+	ldapHealth.Lock()
+	defer ldapHealth.Unlock()
+	var down []string
+	for addr, h := range ldapHealth.servers {
+		if h.err == nil {
+			return nil
+		}
+		down = append(down, fmt.Sprintf("%s: %v", addr, h.err))
+	}
+	if len(down) == 0 {
+		return nil
+	}
+	return fmt.Errorf("no LDAP server reachable: %s", strings.Join(down, "; "))
+}
+
+// ldapHealthStale reports whether no LDAP server was contacted within -ready-window.
+func ldapHealthStale() bool {
+	ldapHealth.Lock()
+	defer ldapHealth.Unlock()
+	for _, h := range ldapHealth.servers {
+		if time.Since(h.at) < *readyWindow {
+			return false
+		}
+	}
+	return true
+}
+
+// checkBackends service-binds every configured LDAP backend once.
+func checkBackends(confs []BackendConfig) error {
+	var errs []string
+	for _, c := range confs {
+		if c.Type != "ldap" {
+			continue
+		}
+		l, err := bindService(&LdapCredential{ldapAddr: c.URL, bindDn: c.BindDN, bindPwd: c.BindPassword, bindPwdNext: c.BindPasswordNext})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("backend %s (%s): %v", c.Name, c.URL, err))
+			continue
+		}
+		l.Close()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// handleReadyz reports whether logins can be served. Without recent traffic
+// it binds to the configured backends to find out.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if ldapHealthStale() {
+		checkBackends(currentConfig().Backends)
+	}
+	if err := ldapReady(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// HoneypotConfig lists decoy accounts. Any attempt to use one bans the
+// client and raises an alert without querying LDAP.
+type HoneypotConfig struct {
+	// Users are matched against the normalized login or its local part,
+	// ignoring case.
+	Users       []string      `yaml:"users"`
+	BanDuration time.Duration `yaml:"ban_duration"`
+}
+
+func (c *HoneypotConfig) isHoneypot(usr, domain string) bool {
+	return containsFold(c.Users, usr) || containsFold(c.Users, usr+"@"+domain)
+}
+
+// banList holds client IPs that are refused until their ban expires, on all
+// instances when they share a store.
+type banList struct {
+	mu   sync.Mutex
+	bans map[string]time.Time
+}
+
+var bans = &banList{bans: make(map[string]time.Time)}
+
+func (b *banList) ban(ip string, d time.Duration) {
+	if ip == "" || d <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.bans[ip] = time.Now().Add(d)
+	b.mu.Unlock()
+	if shared != nil {
+		storeOk(shared.set("banned:"+ip, d))
+	}
+}
+
+func (b *banList) banned(ip string) bool {
+	if ip == "" {
+		return false
+	}
+	if shared != nil && len(currentConfig().Honeypot.Users) > 0 {
+		banned, err := shared.exists("banned:" + ip)
+		if storeOk(err) {
+			return banned
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	exp, ok := b.bans[ip]
+	if ok && time.Now().After(exp) {
+		delete(b.bans, ip)
+		return false
+	}
+	return ok
+}
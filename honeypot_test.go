@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestHoneypotIgnoresCase(t *testing.T) {
+	c := &HoneypotConfig{Users: []string{"admin", "backup@example.com"}}
+	for _, login := range [][2]string{{"ADMIN", "example.com"}, {"Backup", "Example.COM"}} {
+		if !c.isHoneypot(login[0], login[1]) {
+			t.Errorf("%s@%s is not a honeypot", login[0], login[1])
+		}
+	}
+	if c.isHoneypot("alice", "example.com") {
+		t.Error("alice@example.com is a honeypot")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// htpasswdBackend authenticates against an htpasswd file (bcrypt, apr1,
+// SHA, MD5 or SHA crypt hashes), for service and break-glass accounts that
+// must work while the directory is down. The file is re-read when it
+// changes.
+type htpasswdBackend struct {
+	conf *BackendConfig
+
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+func (b *htpasswdBackend) name() string { return b.conf.Name }
+
+func (b *htpasswdBackend) load() (map[string]string, error) {
+	fi, err := os.Stat(b.conf.File)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.users != nil && fi.ModTime().Equal(b.modTime) {
+		return b.users, nil
+	}
+	f, err := os.Open(b.conf.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			users[line[:i]] = line[i+1:]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	b.users, b.modTime = users, fi.ModTime()
+	return users, nil
+}
+
+// authenticate matches the full login first, then its local part if the
+// domain is one of LocalDomains, so that an entry "admin" isn't admin of
+// every domain.
+func (b *htpasswdBackend) authenticate(cred *LdapCredential) (*ldap.Entry, error) {
+	users, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{cred.usr + "@" + cred.domain}
+	for _, d := range b.conf.LocalDomains {
+		if strings.EqualFold(d, cred.domain) {
+			names = append(names, cred.usr)
+			break
+		}
+	}
+	for _, name := range names {
+		hashed, ok := users[name]
+		if !ok {
+			continue
+		}
+		if !checkHtpasswd(hashed, cred.pwd) {
+			return nil, errInvalidPassword
+		}
+		return &ldap.Entry{DN: name}, nil
+	}
+	return nil, errUserNotFound
+}
+
+// checkHtpasswd understands the hashes htpasswd writes except legacy DES
+// crypt, and never accepts plaintext entries.
+func checkHtpasswd(hashed, pwd string) bool {
+	if strings.HasPrefix(hashed, "{SHA}") || strings.HasPrefix(hashed, "$") {
+		return checkHashedPassword(hashed, pwd)
+	}
+	return false
+}
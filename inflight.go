@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/ldap.v3"
+)
+
+// Identical concurrent authentications (same directory, user and password,
+// and client for lookups using {client_ip}) share a single LDAP round trip.
+// Passwords only appear in the key as an HMAC under a per-process random
+// key.
+var (
+	inflight    singleflight.Group
+	inflightKey = make([]byte, 32)
+)
+
+func init() {
+	if _, err := rand.Read(inflightKey); err != nil {
+		panic(err)
+	}
+}
+
+func inflightKeyFor(cred *LdapCredential) string {
+	mac := hmac.New(sha256.New, inflightKey)
+	mac.Write([]byte(cred.pwd))
+	return cacheKey(cred) + "\x00" + cred.bindDn + "\x00" + string(mac.Sum(nil))
+}
+
+// sharedAuth is the result of an authentication handed to all its callers.
+type sharedAuth struct {
+	entry *ldap.Entry
+	dir   *LdapCredential
+}
+
+func authShared(cred *LdapCredential) (*ldap.Entry, error) {
+	v, err, shared := inflight.Do(inflightKeyFor(cred), func() (interface{}, error) {
+		entry, err := authChain(cred)
+		if entry != nil {
+			cache.add(cred, entry)
+		}
+		return sharedAuth{entry, cred.dir}, err
+	})
+	if shared {
+		inflightShared.Inc()
+	}
+	res := v.(sharedAuth)
+	cred.dir = res.dir
+	return res.entry, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// InputConfig bounds what is accepted from the Auth-User and Auth-Pass
+// headers before the directory is contacted.
+type InputConfig struct {
+	MaxUsernameLength int `yaml:"max_username_length"`
+	MaxPasswordLength int `yaml:"max_password_length"`
+}
+
+func checkValue(name, v string, max int) error {
+	if v == "" {
+		return fmt.Errorf("%s is empty", name)
+	}
+	if max > 0 && len(v) > max {
+		return fmt.Errorf("%s is longer than %d bytes", name, max)
+	}
+	if !utf8.ValidString(v) {
+		return fmt.Errorf("%s is not valid UTF-8", name)
+	}
+	if strings.IndexByte(v, 0) >= 0 {
+		return fmt.Errorf("%s contains a NUL byte", name)
+	}
+	return nil
+}
+
+// check rejects junk logins. An empty password must never reach LDAP, where
+// it would be accepted as an unauthenticated bind.
+func (c *InputConfig) check(usr, pwd string) error {
+	if err := checkValue("username", usr, c.MaxUsernameLength); err != nil {
+		return err
+	}
+	return checkValue("password", pwd, c.MaxPasswordLength)
+}
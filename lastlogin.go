@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// LastLoginConfig writes the time of successful logins back to the user's
+// entry, at most once per Interval per user.
+type LastLoginConfig struct {
+	Attribute string        `yaml:"attribute"`
+	Format    string        `yaml:"format"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+type lastLoginWriter struct {
+	mu      sync.Mutex
+	written map[string]time.Time
+}
+
+var lastLogins = &lastLoginWriter{written: make(map[string]time.Time)}
+
+// due reports whether key was not written within the interval and, if so,
+// marks it written.
+func (l *lastLoginWriter) due(key string, interval time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.written[key]) < interval {
+		return false
+	}
+	l.written[key] = now
+	return true
+}
+
+// touch writes the login time to the entry dn of the user authenticated as
+// cred, on the directory that authenticated the user. Users of other
+// backends have no entry to write to.
+func (l *lastLoginWriter) touch(cred *LdapCredential, dn string) {
+	c := &currentConfig().Ldap.LastLogin
+	if c.Attribute == "" || cred.dir == nil || !l.due(cacheKey(cred), c.Interval) {
+		return
+	}
+	// The modify runs as the service account, off the request path.
+	sp := servicePool(cred.dir)
+	go func() {
+		req := ldap.NewModifyRequest(dn, nil)
+		req.Replace(c.Attribute, []string{time.Now().UTC().Format(c.Format)})
+		err := sp.do(func(conn *pooledConn) error {
+			return conn.Modify(req)
+		})
+		if err != nil {
+			log.Printf("Unable to update %s of %s: %v", c.Attribute, dn, err)
+		}
+	}()
+}
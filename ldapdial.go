@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// LdapTLSConfig secures connections to the directory.
+type LdapTLSConfig struct {
+	TLSParams `yaml:",inline"`
+	// CAFile verifies the directory certificate instead of the system roots.
+	CAFile string `yaml:"ca_file"`
+	// StartTLS upgrades ldap:// connections before binding.
+	StartTLS bool `yaml:"start_tls"`
+	// SPKIPins are base64 SHA-256 hashes of a SubjectPublicKeyInfo, CertPins
+	// hex SHA-256 hashes of a DER certificate. When any are set, some
+	// certificate presented by the server must match one of them.
+	SPKIPins []string `yaml:"spki_pins"`
+	CertPins []string `yaml:"cert_pins"`
+	// CertFile and KeyFile are presented to directories requiring mutual TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// LdapServerConfig holds settings for one directory server, keyed by its URL
+// in LdapConfig.Servers.
+type LdapServerConfig struct {
+	// TLS replaces the default LDAP TLS settings for this server.
+	TLS *LdapTLSConfig `yaml:"tls"`
+	// Proxy replaces ldap.dial.proxy for this server.
+	Proxy string `yaml:"proxy"`
+}
+
+func (c *LdapConfig) tlsFor(addr string) *LdapTLSConfig {
+	if s, ok := c.Servers[addr]; ok && s.TLS != nil {
+		return s.TLS
+	}
+	return &c.TLS
+}
+
+func (c *LdapTLSConfig) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	for _, raw := range rawCerts {
+		sum := sha256.Sum256(raw)
+		if contains(c.CertPins, hex.EncodeToString(sum[:])) {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if contains(c.SPKIPins, base64.StdEncoding.EncodeToString(spki[:])) {
+			return nil
+		}
+	}
+	return errors.New("LDAP server certificate does not match any pin")
+}
+
+func (c *LdapTLSConfig) clientConfig(serverName string) (*tls.Config, error) {
+	tc := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if err := c.TLSParams.apply(tc); err != nil {
+		return nil, err
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.SPKIPins) > 0 || len(c.CertPins) > 0 {
+		tc.VerifyPeerCertificate = c.verifyPins
+	}
+	return tc, nil
+}
+
+var ldapDialTimeout = 10 * time.Second
+
+const defaultLdapiSocket = "/var/run/slapd/ldapi"
+
+// ldapiSocket returns the socket path of an ldapi:// URL, whose host part is
+// the percent-encoded path, e.g. ldapi://%2Fvar%2Frun%2Fslapd%2Fldapi.
+func ldapiSocket(addr string) (string, error) {
+	rest := strings.TrimPrefix(addr, "ldapi://")
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest = rest[:i]
+	}
+	path, err := url.PathUnescape(rest)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		path = defaultLdapiSocket
+	}
+	return path, nil
+}
+
+func isLdapi(addr string) bool {
+	return strings.HasPrefix(addr, "ldapi://")
+}
+
+// dialLdap connects to an ldap://, ldaps:// or ldapi:// URL using the
+// configured TLS settings, upgrading with StartTLS when asked to.
+func dialLdap(addr string) (*ldap.Conn, error) {
+	if fixtures != nil {
+		return fixtures.dial(addr), nil
+	}
+	nc, startTLS, isTLS, err := dialLdapNet(addr)
+	if err != nil {
+		return nil, err
+	}
+	l := ldap.NewConn(nc, isTLS)
+	l.Start()
+	if startTLS != nil {
+		if err := l.StartTLS(startTLS); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// dialLdapNet opens the connection of dialLdap. startTLS is the TLS
+// configuration for StartTLS when it is still due, isTLS tells ldaps.
+func dialLdapNet(addr string) (nc net.Conn, startTLS *tls.Config, isTLS bool, err error) {
+	if isLdapi(addr) {
+		path, err := ldapiSocket(addr)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		nc, err := net.DialTimeout("unix", path, ldapDialTimeout)
+		if err != nil {
+			return nil, nil, false, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		return recordConn(nc, addr), nil, false, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, ""
+	}
+	conf := &currentConfig().Ldap
+	c := conf.tlsFor(addr)
+	proxyURL := conf.proxyFor(addr)
+	dialer := &net.Dialer{Timeout: ldapDialTimeout}
+
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = ldap.DefaultLdapPort
+		}
+		if c.StartTLS {
+			if startTLS, err = c.clientConfig(host); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		nc, err := dialTCP(dialer, proxyURL, host, port)
+		if err != nil {
+			return nil, nil, false, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		if !c.StartTLS {
+			nc = recordConn(nc, addr)
+		}
+		return nc, startTLS, false, nil
+	case "ldaps":
+		if port == "" {
+			port = ldap.DefaultLdapsPort
+		}
+		tc, err := c.clientConfig(host)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		raw, err := dialTCP(dialer, proxyURL, host, port)
+		if err != nil {
+			return nil, nil, false, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		nc := tls.Client(raw, tc)
+		nc.SetDeadline(time.Now().Add(ldapDialTimeout))
+		if err := nc.Handshake(); err != nil {
+			raw.Close()
+			return nil, nil, false, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		nc.SetDeadline(time.Time{})
+		return recordConn(nc, addr), nil, true, nil
+	}
+	return nil, nil, false, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+}
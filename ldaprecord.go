@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"gopkg.in/ldap.v3"
+)
+
+var (
+	ldapRecord = flag.String("ldap-record", "", "append the LDAP exchanges of ldap://, ldaps:// and ldapi:// connections (not StartTLS) to this fixture file.")
+	ldapReplay = flag.String("ldap-replay", "", "answer LDAP operations from this fixture file instead of contacting any directory.")
+)
+
+// ldapExchange is one recorded operation: the encoded protocol op and
+// controls of the request and those of every response to it, without
+// message IDs so that they can be replayed on any connection.
+type ldapExchange struct {
+	Addr      string     `json:"addr"`
+	Request   [][]byte   `json:"request"`
+	Responses [][][]byte `json:"responses"`
+}
+
+func (e *ldapExchange) key() string {
+	var b bytes.Buffer
+	b.WriteString(e.Addr)
+	for _, p := range e.Request {
+		b.WriteByte(0)
+		b.WriteString(hex.EncodeToString(p))
+	}
+	return b.String()
+}
+
+// nextPacket takes one complete LDAP message off buf, nil while incomplete.
+func nextPacket(buf *bytes.Buffer) *ber.Packet {
+	r := bytes.NewReader(buf.Bytes())
+	p, err := ber.ReadPacket(r)
+	if err != nil {
+		return nil
+	}
+	buf.Next(buf.Len() - r.Len())
+	if len(p.Children) < 2 {
+		return nil
+	}
+	return p
+}
+
+func messageID(p *ber.Packet) int64 {
+	id, _ := p.Children[0].Value.(int64)
+	return id
+}
+
+func opBytes(p *ber.Packet) [][]byte {
+	var parts [][]byte
+	for _, c := range p.Children[1:] {
+		parts = append(parts, c.Bytes())
+	}
+	return parts
+}
+
+// finalResponse reports whether p ends the responses to its request: every
+// response but search result entries and references does.
+func finalResponse(p *ber.Packet) bool {
+	tag := p.Children[1].Tag
+	return tag != ldap.ApplicationSearchResultEntry && tag != ldap.ApplicationSearchResultReference
+}
+
+type ldapRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var recorder *ldapRecorder
+
+func openLdapRecorder(path string) (*ldapRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &ldapRecorder{f: f}, nil
+}
+
+func (r *ldapRecorder) write(e *ldapExchange) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.f.Write(append(b, '\n'))
+	r.mu.Unlock()
+}
+
+// recordingConn tees the plaintext LDAP messages on a connection into the
+// recorder.
+type recordingConn struct {
+	net.Conn
+	addr string
+
+	mu      sync.Mutex
+	out, in bytes.Buffer
+	pending map[int64]*ldapExchange
+}
+
+func recordConn(nc net.Conn, addr string) net.Conn {
+	if recorder == nil {
+		return nc
+	}
+	return &recordingConn{Conn: nc, addr: addr, pending: make(map[int64]*ldapExchange)}
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.out.Write(b[:n])
+	for p := nextPacket(&c.out); p != nil; p = nextPacket(&c.out) {
+		c.pending[messageID(p)] = &ldapExchange{Addr: c.addr, Request: opBytes(p)}
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.in.Write(b[:n])
+	for p := nextPacket(&c.in); p != nil; p = nextPacket(&c.in) {
+		e, ok := c.pending[messageID(p)]
+		if !ok {
+			continue
+		}
+		e.Responses = append(e.Responses, opBytes(p))
+		if finalResponse(p) {
+			delete(c.pending, messageID(p))
+			recorder.write(e)
+		}
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// ldapFixtures replays recorded exchanges. Identical requests are answered
+// in recorded order, repeating the last answer once they run out.
+type ldapFixtures struct {
+	mu        sync.Mutex
+	exchanges map[string][]*ldapExchange
+}
+
+var fixtures *ldapFixtures
+
+func loadLdapFixtures(path string) (*ldapFixtures, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fx := &ldapFixtures{exchanges: make(map[string][]*ldapExchange)}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var e ldapExchange
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		fx.exchanges[e.key()] = append(fx.exchanges[e.key()], &e)
+	}
+	return fx, sc.Err()
+}
+
+func (fx *ldapFixtures) answer(e *ldapExchange) *ldapExchange {
+	fx.mu.Lock()
+	defer fx.mu.Unlock()
+	k := e.key()
+	recorded := fx.exchanges[k]
+	if len(recorded) == 0 {
+		return nil
+	}
+	if len(recorded) > 1 {
+		fx.exchanges[k] = recorded[1:]
+	}
+	return recorded[0]
+}
+
+// dial returns a connection to an in-process server answering from
+// the fixtures.
+func (fx *ldapFixtures) dial(addr string) *ldap.Conn {
+	client, server := net.Pipe()
+	go fx.serve(server, addr)
+	l := ldap.NewConn(client, false)
+	l.Start()
+	return l
+}
+
+func (fx *ldapFixtures) serve(nc net.Conn, addr string) {
+	defer nc.Close()
+	for {
+		p, err := ber.ReadPacket(nc)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		if p.Children[1].Tag == ldap.ApplicationUnbindRequest {
+			return
+		}
+		req := &ldapExchange{Addr: addr, Request: opBytes(p)}
+		var responses [][][]byte
+		if e := fx.answer(req); e != nil {
+			responses = e.Responses
+		} else {
+			log.Printf("No recorded LDAP exchange for %s on %s, answering with an error.", ldap.ApplicationMap[uint8(p.Children[1].Tag)], addr)
+			responses = [][][]byte{{unrecordedResponse(p.Children[1].Tag).Bytes()}}
+		}
+		for _, parts := range responses {
+			msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID(p), "MessageID"))
+			for _, b := range parts {
+				msg.AppendChild(ber.DecodePacket(b))
+			}
+			if _, err := nc.Write(msg.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// unrecordedResponse is the "other" error result for a request of the given
+// application tag, whose response tag is the next one (search: its done).
+func unrecordedResponse(reqTag ber.Tag) *ber.Packet {
+	tag := reqTag + 1
+	if reqTag == ldap.ApplicationSearchRequest {
+		tag = ldap.ApplicationSearchResultDone
+	}
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(ldap.LDAPResultOther), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "not in the LDAP fixtures", "diagnosticMessage"))
+	return op
+}
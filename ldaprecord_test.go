@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// directoryConfig authenticates against the directory recorded in
+// testdata/login.jsonl, which knows alice with the password secret.
+const directoryConfig = `
+backends:
+  - name: directory
+    type: ldap
+    url: ldap://ldap.example.com
+    base_dn: ou=people,dc=example,dc=com
+    bind_dn: cn=auth,dc=example,dc=com
+    bind_password: service
+`
+
+func TestReplayLogin(t *testing.T) {
+	fx, err := loadLdapFixtures("testdata/login.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures = fx
+	defer func() { fixtures = nil }()
+	useConfig(t, directoryConfig)
+	quietLog(t)
+	for _, tt := range []struct {
+		pass string
+		ok   bool
+	}{
+		{"secret", true},
+		{"wrong", false},
+	} {
+		w := httptest.NewRecorder()
+		handleHttpAuthReq(w, authRequest("alice@example.com", tt.pass))
+		if got := w.Header().Get(AuthStatus); (got == "OK") != tt.ok {
+			t.Errorf("password %q: %s = %q", tt.pass, AuthStatus, got)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Signals handled by the daemon:
+//
+//	SIGTERM, SIGINT  stop accepting requests, drain in-flight ones for up
+//	                 to -drain-timeout, then exit
+//	SIGHUP           reload -config, and the TLS certificate if serving TLS
+//	SIGUSR1          reopen -log-file and the audit log after logrotate
+//	                 moved them (not on Windows)
+var (
+	pidFile = flag.String("pidfile", "", "file to write the process ID to, removed on exit.")
+	logFile = flag.String("log-file", "", "file to log to instead of stderr, reopened on SIGUSR1.")
+
+	logMaxBytes   = flag.Int64("log-max-bytes", 0, "rotate -log-file once it would grow past this size, 0 leaves rotation to logrotate.")
+	logMaxBackups = flag.Int("log-max-backups", 0, "rotated -log-file backups to keep, 0 keeps all.")
+	logMaxAge     = flag.Duration("log-max-age", 0, "delete rotated -log-file backups older than this, 0 keeps them.")
+	logCompress   = flag.Bool("log-compress", false, "gzip rotated -log-file backups.")
+)
+
+func writePidfile(path string) error {
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// appLog is the -log-file output.
+var appLog *rotatingFile
+
+func openLog(path string) (*rotatingFile, error) {
+	conf := RotateConfig{MaxBytes: *logMaxBytes, MaxBackups: *logMaxBackups, MaxAge: *logMaxAge, Compress: *logCompress}
+	if err := conf.validate("-log-max-*"); err != nil {
+		return nil, err
+	}
+	l, err := openRotating(path, 0640, conf)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(l)
+	return l, nil
+}
+
+// handleLifecycleSignals serves SIGHUP and SIGUSR1 for the life of the
+// process. SIGTERM and SIGINT are handled by main.
+func handleLifecycleSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reopen := make(chan os.Signal, 1)
+	notifyReopen(reopen)
+	for {
+		select {
+		case <-hup:
+			if *configFile != "" || configSource != nil {
+				reloadConfig()
+			}
+		case <-reopen:
+			if appLog != nil {
+				if err := appLog.reopen(); err != nil {
+					log.Printf("Unable to reopen %s: %v", appLog.path, err)
+				}
+			}
+			if err := auditor.reopen(); err != nil {
+				log.Printf("Unable to reopen the audit log: %v", err)
+			}
+			log.Print("Reopened log files.")
+		}
+	}
+}
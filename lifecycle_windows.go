@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// notifyReopen does nothing, Windows has no SIGUSR1.
+func notifyReopen(c chan<- os.Signal) {}
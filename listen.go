@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+)
+
+var reusePort = flag.Bool("reuseport", false, "listen with SO_REUSEPORT so a new instance can bind the same port before the old one drains.")
+
+// listen returns the auth listener. A socket inherited through systemd-style
+// socket activation (LISTEN_FDS) takes precedence, which lets a supervisor
+// hand the same socket to the next instance during a restart.
+func listen(addr string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		if n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS")); n >= 1 {
+			f := os.NewFile(3, "listener")
+			defer f.Close()
+			return net.FileListener(f)
+		}
+	}
+	lc := net.ListenConfig{}
+	if *reusePort {
+		lc.Control = setReusePort
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
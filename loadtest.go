@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runLoadtest implements `httpauth2ldap loadtest`, which sends synthetic
+// auth_http requests to a running instance and reports latency percentiles.
+func runLoadtest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:5000/", "auth URL of the instance under test.")
+	rate := fs.Int("rate", 100, "requests per second.")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests.")
+	concurrency := fs.Int("concurrency", 50, "maximum requests in flight.")
+	users := fs.Int("users", 1000, "number of distinct users, named user<N>@<domain>.")
+	domain := fs.String("domain", "example.com", "domain of the synthetic users.")
+	dist := fs.String("distribution", "uniform", "how users are picked: uniform, or zipf for a few very active users.")
+	password := fs.String("password", "secret", "password of the synthetic users.")
+	failRatio := fs.Float64("fail-ratio", 0, "fraction of requests sent with a wrong password.")
+	protocol := fs.String("protocol", "imap", "Auth-Protocol of the requests.")
+	ldapURL := fs.String("ldap-url", "", "X-Ldap-URL header, when the instance takes the directory from the request.")
+	baseDn := fs.String("base-dn", "", "X-Ldap-BaseDN header.")
+	fs.Parse(args)
+	if *rate <= 0 || *users <= 0 || *concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "rate, users and concurrency must be positive")
+		os.Exit(2)
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	pick := func() int { return rnd.Intn(*users) }
+	if *dist == "zipf" {
+		z := rand.NewZipf(rnd, 1.1, 1, uint64(*users-1))
+		pick = func() int { return int(z.Uint64()) }
+	} else if *dist != "uniform" {
+		fmt.Fprintf(os.Stderr, "unknown distribution %q\n", *dist)
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		results   = make(map[string]int)
+		wg        sync.WaitGroup
+	)
+	sem := make(chan struct{}, *concurrency)
+	send := func(user, pwd string) {
+		defer wg.Done()
+		defer func() { <-sem }()
+		req, _ := http.NewRequest(http.MethodGet, *target, nil)
+		req.Header.Set(AuthMethod, "plain")
+		req.Header.Set(AuthUser, user)
+		req.Header.Set(AuthPass, pwd)
+		req.Header.Set(AuthProtocol, *protocol)
+		req.Header.Set(AuthServer, "127.0.0.1")
+		req.Header.Set(AuthPort, "143")
+		req.Header.Set(ClientIP, fmt.Sprintf("10.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(256)))
+		if *ldapURL != "" {
+			req.Header.Set(XLdapURL, *ldapURL)
+			req.Header.Set(XLdapBaseDN, *baseDn)
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		took := time.Since(start)
+		result := "error"
+		if err == nil {
+			resp.Body.Close()
+			result = resp.Header.Get(AuthStatus)
+			if resp.Header.Get(AuthWait) != "" {
+				result = "tempfail: " + result
+			}
+		}
+		mu.Lock()
+		latencies = append(latencies, took)
+		results[result]++
+		mu.Unlock()
+	}
+
+	tick := time.NewTicker(time.Second / time.Duration(*rate))
+	defer tick.Stop()
+	stop := time.After(*duration)
+	start := time.Now()
+	dropped := 0
+loop:
+	for {
+		select {
+		case <-stop:
+			break loop
+		case <-tick.C:
+			pwd := *password
+			if rnd.Float64() < *failRatio {
+				pwd += "-wrong"
+			}
+			select {
+			case sem <- struct{}{}:
+				wg.Add(1)
+				go send(fmt.Sprintf("user%d@%s", pick(), *domain), pwd)
+			default:
+				dropped++
+			}
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Printf("requests: %d in %v (%.1f/s), %d skipped at the concurrency limit\n",
+		len(latencies), elapsed.Round(time.Millisecond), float64(len(latencies))/elapsed.Seconds(), dropped)
+	fmt.Printf("latency: p50=%v p90=%v p99=%v max=%v\n", pct(0.5), pct(0.9), pct(0.99), pct(1))
+	var statuses []string
+	for s := range results {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Printf("  %6d  %s\n", results[s], s)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LockoutConfig locks out users and client IPs after too many failed logins
+// within Window. A zero maximum disables that kind of lockout.
+type LockoutConfig struct {
+	MaxUserFailures int           `yaml:"max_user_failures"`
+	MaxIPFailures   int           `yaml:"max_ip_failures"`
+	Window          time.Duration `yaml:"window"`
+	Duration        time.Duration `yaml:"duration"`
+}
+
+type failureCount struct {
+	Failures    int       `json:"failures"`
+	FirstFailed time.Time `json:"first_failed"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+type failureCounters struct {
+	// kind is user or ip, namespacing the keys in the shared store.
+	kind   string
+	mu     sync.Mutex
+	counts map[string]*failureCount
+	// swept is when failLocal last dropped the expired counts.
+	swept time.Time
+}
+
+func newFailureCounters(kind string) *failureCounters {
+	return &failureCounters{kind: kind, counts: make(map[string]*failureCount)}
+}
+
+var (
+	userFailures = newFailureCounters("user")
+	ipFailures   = newFailureCounters("ip")
+)
+
+// fail counts a failure of key and reports whether it just became locked,
+// across all instances when they share a store.
+func (f *failureCounters) fail(key string, max int, c *LockoutConfig) bool {
+	if key == "" || max <= 0 {
+		return false
+	}
+	locked := f.failLocal(key, max, c)
+	if shared == nil {
+		return locked
+	}
+	n, err := shared.incr(f.kind+"-failures:"+key, c.Window)
+	if !storeOk(err) {
+		return locked
+	}
+	if n < int64(max) {
+		return false
+	}
+	// Only the instance that sets the lock reports the lockout.
+	added, err := shared.add(f.kind+"-locked:"+key, c.Duration)
+	if !storeOk(err) {
+		return locked
+	}
+	return added
+}
+
+func (f *failureCounters) failLocal(key string, max int, c *LockoutConfig) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if now.Sub(f.swept) > c.Window {
+		for k, fc := range f.counts {
+			if fc.expired(now, c.Window) {
+				delete(f.counts, k)
+			}
+		}
+		f.swept = now
+	}
+	fc, ok := f.counts[key]
+	if !ok || fc.expired(now, c.Window) {
+		fc = &failureCount{FirstFailed: now}
+		f.counts[key] = fc
+	}
+	fc.Failures++
+	if fc.Failures >= max && now.After(fc.LockedUntil) {
+		fc.LockedUntil = now.Add(c.Duration)
+		return true
+	}
+	return false
+}
+
+// expired reports whether fc is past its window and not locked.
+func (fc *failureCount) expired(now time.Time, window time.Duration) bool {
+	return now.Sub(fc.FirstFailed) > window && now.After(fc.LockedUntil)
+}
+
+func (f *failureCounters) locked(key string) bool {
+	if shared != nil {
+		locked, err := shared.exists(f.kind + "-locked:" + key)
+		if storeOk(err) {
+			return locked
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, ok := f.counts[key]
+	return ok && time.Now().Before(fc.LockedUntil)
+}
+
+func (f *failureCounters) reset(key string) bool {
+	f.mu.Lock()
+	_, ok := f.counts[key]
+	delete(f.counts, key)
+	f.mu.Unlock()
+	if shared != nil {
+		found, err := shared.del(f.kind+"-failures:"+key, f.kind+"-locked:"+key)
+		ok = storeOk(err) && found || ok
+	}
+	return ok
+}
+
+func (f *failureCounters) snapshot() map[string]failureCount {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	m := make(map[string]failureCount, len(f.counts))
+	for k, fc := range f.counts {
+		if fc.expired(now, currentConfig().Lockout.Window) {
+			delete(f.counts, k)
+			continue
+		}
+		m[k] = *fc
+	}
+	return m
+}
+
+func (c *LockoutConfig) isLocked(user, ip string) bool {
+	return c.MaxUserFailures > 0 && userFailures.locked(user) || c.MaxIPFailures > 0 && ip != "" && ipFailures.locked(ip)
+}
+
+// observe updates the counters from an authentication outcome.
+func (c *LockoutConfig) observe(ev auditEvent) {
+	switch {
+	case ev.Result == auditSuccess:
+		userFailures.reset(ev.User)
+	case ev.Result == auditFailure && ev.Reason == reasonInvalidCredentials:
+		failedLogins.WithLabelValues("user").Inc()
+		if userFailures.fail(ev.User, c.MaxUserFailures, c) {
+			lockouts.WithLabelValues("user").Inc()
+			emitEvent(securityEvent{Type: eventLockout, User: ev.User, ClientIP: ev.ClientIP, Detail: "user locked out"})
+		}
+		if ev.ClientIP != "" {
+			failedLogins.WithLabelValues("ip").Inc()
+			if ipFailures.fail(ev.ClientIP, c.MaxIPFailures, c) {
+				lockouts.WithLabelValues("ip").Inc()
+				emitEvent(securityEvent{Type: eventBruteForce, User: ev.User, ClientIP: ev.ClientIP, Detail: "client locked out"})
+			}
+		}
+	}
+}
+
+// handleFailures serves the failure counters. GET lists those of this
+// instance, DELETE with a user or ip query parameter resets one, which also
+// lifts its lockout, in the shared store too.
+func handleFailures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]map[string]failureCount{
+			"users": userFailures.snapshot(),
+			"ips":   ipFailures.snapshot(),
+		})
+	case http.MethodDelete:
+		found := false
+		if u := r.URL.Query().Get("user"); u != "" {
+			found = userFailures.reset(currentConfig().Normalize.username(u)) || found
+		}
+		if ip := r.URL.Query().Get("ip"); ip != "" {
+			found = ipFailures.reset(ip) || found
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFailureCountersBounded(t *testing.T) {
+	f := newFailureCounters("user")
+	c := &LockoutConfig{Window: time.Minute, Duration: time.Minute}
+	for i := 0; i < 100; i++ {
+		f.fail("user"+strconv.Itoa(i), 0, c)
+	}
+	if n := len(f.counts); n != 0 {
+		t.Errorf("%d counts kept with the lockout off", n)
+	}
+
+	c.Window = time.Millisecond
+	for i := 0; i < 100; i++ {
+		f.fail("user"+strconv.Itoa(i), 5, c)
+	}
+	time.Sleep(2 * time.Millisecond)
+	f.fail("last", 5, c)
+	if n := len(f.counts); n != 1 {
+		t.Errorf("%d counts kept after their window, want 1", n)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var debugSample = flag.Float64("debug-sample", 0, "fraction of requests, between 0 and 1, logged with debug detail. Adjustable at runtime via /admin/debug?sample=.")
+
+// debugRate holds the current sampling fraction as float64 bits.
+var debugRate uint64
+
+func setDebugSample(f float64) {
+	atomic.StoreUint64(&debugRate, math.Float64bits(f))
+}
+
+// sampleDebug decides whether a new request is logged with debug detail.
+func sampleDebug() bool {
+	f := math.Float64frombits(atomic.LoadUint64(&debugRate))
+	return f > 0 && rand.Float64() < f
+}
+
+// logWarn logs conditions operators should look at, marked so they can be
+// filtered from the regular request log.
+func logWarn(format string, v ...interface{}) {
+	log.Printf("WARN "+format, v...)
+}
+
+// logDebug logs detail about the request of cred if it was sampled. Callers
+// check cred.debug first so requests not sampled don't build the arguments.
+func logDebug(cred *LdapCredential, format string, v ...interface{}) {
+	if cred.debug {
+		log.Printf("DEBUG "+format, v...)
+	}
+}
+
+// handleDebug shows or, with a sample query parameter, sets the fraction of
+// requests logged with debug detail.
+func handleDebug(w http.ResponseWriter, r *http.Request) {
+	if v := r.URL.Query().Get("sample"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			http.Error(w, "sample must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		setDebugSample(f)
+	}
+	w.Write([]byte(strconv.FormatFloat(math.Float64frombits(atomic.LoadUint64(&debugRate)), 'g', -1, 64) + "\n"))
+}
@@ -1,34 +1,127 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
+	"google.golang.org/grpc"
 	"gopkg.in/ldap.v3"
 )
 
-var port = flag.String("port", "5000", "port to listen for HTTP auth requests.")
+var (
+	port         = flag.String("port", "5000", "port to listen for HTTP auth requests.")
+	drainTimeout = flag.Duration("drain-timeout", 10*time.Second, "how long to wait for in-flight requests on SIGTERM/SIGINT before exiting.")
+	errorDetail  = flag.String("error-detail", "generic", "failure detail returned in Auth-Status: generic for end users or detailed for debugging.")
+)
 
 const (
-	AuthStatus    = "Auth-Status"
-	AuthUser      = "Auth-User"
-	AuthPass      = "Auth-Pass"
-	AuthMethod    = "Auth-Method"
-	XLdapURL      = "X-Ldap-URL"
-	XLdapBaseDN   = "X-Ldap-BaseDN"
-	XLdapBindDN   = "X-Ldap-BindDN"
-	XLdapBindPass = "X-Ldap-BindPass"
-	AuthServer    = "Auth-Server"
-	AuthPort      = "Auth-Port"
+	AuthStatus        = "Auth-Status"
+	AuthUser          = "Auth-User"
+	AuthPass          = "Auth-Pass"
+	AuthMethod        = "Auth-Method"
+	XLdapURL          = "X-Ldap-URL"
+	XLdapBaseDN       = "X-Ldap-BaseDN"
+	XLdapBindDN       = "X-Ldap-BindDN"
+	XLdapBindPass     = "X-Ldap-BindPass"
+	XLdapBindPassNext = "X-Ldap-BindPass-Next"
+	AuthServer        = "Auth-Server"
+	AuthPort          = "Auth-Port"
+	AuthProtocol      = "Auth-Protocol"
+	AuthWait          = "Auth-Wait"
+	AuthErrorCode     = "Auth-Error-Code"
+	ClientIP          = "Client-IP"
+	AuthSSLCert       = "Auth-SSL-Cert"
+	AuthSMTPHelo      = "Auth-SMTP-Helo"
+	AuthSMTPFrom      = "Auth-SMTP-From"
+	AuthSMTPTo        = "Auth-SMTP-To"
 )
 
-func authFailed(w http.ResponseWriter, err string) {
-	log.Printf("Failed authentication due to: %s", err)
-	w.Header().Add(AuthStatus, err)
+// authFailed logs the detailed reason but, unless -error-detail=detailed,
+// only tells the client the catalog message for the reason of code.
+func authFailed(w http.ResponseWriter, r *http.Request, code errCode, err string) {
+	reason := code.reason()
+	log.Printf("Failed authentication (%s)%s due to: %s", code, traceFields(r), err)
+	recordOutcome(requestEvent(r, auditFailure, code))
+	noteOutcome(r, code, nil, nil)
+	status := currentConfig().Messages.failureMessage(r, reason)
+	if *errorDetail == "detailed" {
+		status = err
+	}
+	w.Header().Add(AuthStatus, statusWithCode(status, code))
+	if code, ok := smtpErrorCodes[reason]; ok && r.Header.Get(AuthProtocol) == "smtp" && w.Header().Get(AuthErrorCode) == "" {
+		w.Header().Set(AuthErrorCode, code)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+var secretHeaders = []string{AuthPass, XLdapBindPass, XLdapBindPassNext}
+
+// redactedHeader formats a request header for the log with the secret
+// values replaced. It formats lazily, without copying the header.
+type redactedHeader http.Header
+
+func redactHeader(h http.Header) redactedHeader {
+	return redactedHeader(h)
+}
+
+func (h redactedHeader) String() string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	secret := currentConfig().ClientAuth.SharedSecretHeader
+	var b strings.Builder
+	b.WriteString("map[")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(k)
+		b.WriteString(":[")
+		if contains(secretHeaders, k) || k == secret && k != "" {
+			b.WriteString("<redacted>")
+		} else {
+			b.WriteString(strings.Join(h[k], " "))
+		}
+		b.WriteByte(']')
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func authSucceeded(w http.ResponseWriter, r *http.Request, cred *LdapCredential, entry *ldap.Entry) {
+	h, err := successHeaders(r, cred, entry)
+	if err != nil {
+		authFailed(w, r, codeInternal, fmt.Sprintf("Unable to build response headers: %v", err))
+		return
+	}
+	if cred.debug {
+		logDebug(cred, "Responding with %v", h)
+	}
+	for k, v := range h {
+		w.Header()[k] = v
+	}
+	w.Header().Set(AuthStatus, "OK")
 	w.WriteHeader(http.StatusOK)
+
+	ev := requestEvent(r, auditSuccess, "")
+	ev.User, ev.Domain = cred.usr+"@"+cred.domain, cred.domain
+	ev.Attributes = currentConfig().Audit.attributeValues(entry)
+	recordOutcome(ev)
+	noteOutcome(r, "", cred, entry)
+	lastLogins.touch(cred, entry.DN)
 }
 
 type LdapCredential struct {
@@ -36,101 +129,594 @@ type LdapCredential struct {
 	baseDn   string
 	bindDn   string
 	bindPwd  string
-	usr      string
-	pwd      string
-	domain   string
+	// bindPwdNext is tried when bindPwd is rejected, so the service
+	// password can be rotated without downtime.
+	bindPwdNext string
+	usr         string
+	pwd         string
+	domain      string
+	clientIp    string
+	// timings collects the stage durations of the request, may be nil.
+	timings *stageTimings
+	// deadline, when set, cuts off the LDAP operations of the request.
+	deadline time.Time
+	// debug is set on requests sampled by -debug-sample.
+	debug bool
+	// ldap and chain override the ldap section and the backends of the
+	// configuration, for shadow comparisons and canaries.
+	ldap  *LdapConfig
+	chain []chainLink
+	// shadow marks a shadow authentication, which leaves no state behind:
+	// no failed login counts and no directory lock marks.
+	shadow bool
+	// attrs, when set, reads the attributes of the authenticated user in
+	// place of the service account, see LdapDomainConfig.
+	attrs *LdapAccount
+	// dir is set once the user is authenticated to the settings, without
+	// the user's password, of the directory holding the entry. It is nil
+	// when a backend other than a directory authenticated the user.
+	dir *LdapCredential
+}
+
+// directory returns a copy of cred for the directory it names, without the
+// password of the user.
+func (cred *LdapCredential) directory() *LdapCredential {
+	d := *cred
+	d.pwd, d.dir = "", nil
+	return &d
+}
+
+// ldapConf returns the directory settings that apply to cred.
+func (cred *LdapCredential) ldapConf() *LdapConfig {
+	if cred.ldap != nil {
+		return cred.ldap
+	}
+	return &currentConfig().Ldap
+}
+
+// serviceBindError is a failed bind of the service account, a problem of
+// the daemon's configuration rather than of the user's password.
+type serviceBindError struct {
+	err error
+}
+
+func (e serviceBindError) Error() string {
+	return fmt.Sprintf("service bind failed: %v", e.err)
 }
 
-func authViaLdap(cred *LdapCredential) (bool, error) {
-	l, err := ldap.DialURL(cred.ldapAddr)
+// bindService connects to the directory and binds as the service account.
+func bindService(cred *LdapCredential) (*ldap.Conn, error) {
+	l, err := dialLdap(cred.ldapAddr)
 	if err != nil {
 		log.Printf("Failed to connect to LDAP server: %s", cred.ldapAddr)
-		return false, err
+		throttle.emit(eventLdapOutage+cred.ldapAddr, time.Minute, securityEvent{Type: eventLdapOutage, Detail: fmt.Sprintf("%s: %v", cred.ldapAddr, err)})
+		recordLdapHealth(cred.ldapAddr, err)
+		return nil, err
+	}
+	// Over a local ldapi:// socket without a bind DN, slapd identifies the
+	// daemon by its Unix credentials.
+	if isLdapi(cred.ldapAddr) && cred.bindDn == "" {
+		err = l.ExternalBind()
+	} else {
+		err = l.Bind(cred.bindDn, cred.bindPwd)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) && cred.bindPwdNext != "" {
+			if err = l.Bind(cred.bindDn, cred.bindPwdNext); err == nil {
+				log.Printf("Bound as %s with the next bind password.", cred.bindDn)
+			}
+		}
 	}
-	defer l.Close()
-	err = l.Bind(cred.bindDn, cred.bindPwd)
 	if err != nil {
-		log.Printf("Unable to bind to LDAP server with DN: %s, Pass: %s.", cred.bindDn, cred.bindPwd)
-		return false, err
-	}
-
-	sreq := ldap.NewSearchRequest(
-		cred.baseDn,
-		ldap.ScopeWholeSubtree,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		fmt.Sprintf("(&(objectClass=organizationalPerson)(uid=%s))", cred.usr),
-		[]string{"dn"},
-		nil,
-	)
-	sresp, err := l.Search(sreq)
+		log.Printf("Unable to bind to LDAP server with DN: %s.", cred.bindDn)
+		l.Close()
+		recordLdapHealth(cred.ldapAddr, err)
+		return nil, serviceBindError{err}
+	}
+	recordLdapHealth(cred.ldapAddr, nil)
+	return l, nil
+}
+
+// authViaLdap looks the user up on a pooled service connection and checks
+// the password on a separate pooled connection, so searches never run with
+// the user's privileges.
+func authViaLdap(cred *LdapCredential) (*ldap.Entry, error) {
+	if cred.ldapConf().BindDnTemplate != "" {
+		return authViaBindDn(cred)
+	}
+
+	sreq := cred.ldapConf().userSearch(cred.baseDn, cred, searchAttrs(cred))
+	if cred.debug {
+		logDebug(cred, "Searching %s under %q with filter %s for %v", cred.ldapAddr, sreq.BaseDN, sreq.Filter, sreq.Attributes)
+	}
+	var sresp *ldap.SearchResult
+	start := time.Now()
+	err := servicePool(cred).doUntil(cred.deadline, func(l *pooledConn) (err error) {
+		sresp, err = l.Search(sreq)
+		return err
+	})
+	cred.timings.add("search", start)
 	if err != nil {
 		log.Printf("Search error: %v", err)
-		return false, err
+		return nil, err
 	}
 
+	if cred.debug {
+		logDebug(cred, "Search found %d entries", len(sresp.Entries))
+	}
 	if len(sresp.Entries) != 1 {
-		log.Printf("Unable to locate user: %s", cred.usr)
-		return false, err
+		log.Printf("Unable to locate user: %s@%s", cred.usr, cred.domain)
+		return nil, errUserNotFound
 	}
 
-	err = l.Bind(sresp.Entries[0].DN, cred.pwd)
+	entry := sresp.Entries[0]
+	failed := &cred.ldapConf().FailedLogins
+	if err := failed.check(entry); err != nil {
+		log.Printf("User %s@%s has too many failed logins in the directory", cred.usr, cred.domain)
+		return nil, err
+	}
+
+	start = time.Now()
+	err = verifyPassword(cred, entry.DN)
+	cred.timings.add(cred.ldapConf().PasswordCheck, start)
+	if cred.debug {
+		logDebug(cred, "Password check (%s) of %s: %v", cred.ldapConf().PasswordCheck, entry.DN, err)
+	}
+	if err != nil {
+		log.Printf("Unable to authenticate user: %s@%s", cred.usr, cred.domain)
+		if definitiveFailure(err) {
+			failed.failed(cred, entry)
+		}
+		return nil, err
+	}
+	failed.succeeded(cred, entry)
+
+	return authorizedEntry(cred, entry), nil
+}
+
+// authViaBindDn binds directly with the DN built from the bind DN template,
+// reading the user's attributes only when response templates or the policy
+// need them.
+func authViaBindDn(cred *LdapCredential) (*ldap.Entry, error) {
+	dn := expandPlaceholders(cred.ldapConf().BindDnTemplate, cred, escapeDN)
+	start := time.Now()
+	err := verifyPassword(cred, dn)
+	cred.timings.add(cred.ldapConf().PasswordCheck, start)
+	if cred.debug {
+		logDebug(cred, "Password check (%s) of %s: %v", cred.ldapConf().PasswordCheck, dn, err)
+	}
 	if err != nil {
-		log.Printf("Unable to authenticate user: %s with password: %s", cred.usr, cred.pwd)
-		return false, err
+		log.Printf("Unable to authenticate user: %s@%s", cred.usr, cred.domain)
+		return nil, err
 	}
 
-	return true, nil
+	return readEntry(cred, dn, entryAttrs()[1:]), nil
 }
 
 func handleHttpAuthReq(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received authentication request: %s", r.Header)
+	config := currentConfig()
+	r = withTrace(r)
+	// Hand the trace back so nginx (through njs) can parent later spans on
+	// this one.
+	tc := requestTrace(r)
+	w.Header().Set(Traceparent, tc.traceparent())
+	if tc.state != "" {
+		w.Header().Set(Tracestate, tc.state)
+	}
+	log.Printf("Received authentication request:%s %s", traceFields(r), redactHeader(r.Header))
+	clientip := r.Header.Get(ClientIP)
+	if bans.banned(clientip) {
+		authFailed(w, r, codeBanned, fmt.Sprintf("Client %s is banned.", clientip))
+		return
+	}
+
+	if blocked.contains(clientip) {
+		blocklistHits.Inc()
+		authFailed(w, r, codeBlocklisted, fmt.Sprintf("Client %s is on the blocklist.", clientip))
+		return
+	}
+
+	if !config.SMTP.Dnsbl.check(w, r) {
+		return
+	}
+
 	authm := r.Header.Get(AuthMethod)
-	if authm != "plain" {
-		authFailed(w, fmt.Sprintf("Unsupported authentication method %s", authm))
+	if authm == "none" && r.Header.Get(AuthProtocol) == "smtp" {
+		handleRelay(w, r)
+		return
+	}
+	sasl := requestSasl(r)
+	bearer := isOauthMethod(authm) && config.OAuth.enabled()
+	if authm != "plain" && !bearer && (sasl == nil || authm != sasl.mechanism) {
+		authFailed(w, r, codeUnsupportedMethod, fmt.Sprintf("Unsupported authentication method %s", authm))
 		return
 	}
 
 	authserver := r.Header.Get(AuthServer)
 	authport := r.Header.Get(AuthPort)
 	if authserver == "" || authport == "" {
-		authFailed(w, "Must supply Auth-Server and Auth-Port via HTTP Header.")
+		authFailed(w, r, codeBadRequest, "Must supply Auth-Server and Auth-Port via HTTP Header.")
 		return
 	}
 
-	authud := strings.Split(r.Header.Get(AuthUser), "@")
-	if len(authud) != 2 {
-		authFailed(w, "Username must contain both user id and domain.")
+	if bearer {
+		login, err := config.OAuth.login(r.Header.Get(AuthUser), r.Header.Get(AuthPass))
+		if err != nil {
+			authFailed(w, r, codeBadToken, fmt.Sprintf("Bearer token rejected: %v", err))
+			return
+		}
+		r.Header.Set(AuthUser, login)
+	}
+	if bearer || sasl != nil {
+		// Auth-Pass holds a token or SASL message rather than a password.
+		if err := checkValue("username", r.Header.Get(AuthUser), config.Input.MaxUsernameLength); err != nil {
+			authFailed(w, r, codeInvalidInput, err.Error())
+			return
+		}
+	} else if err := config.Input.check(r.Header.Get(AuthUser), r.Header.Get(AuthPass)); err != nil {
+		authFailed(w, r, codeInvalidInput, err.Error())
+		return
+	}
+
+	profile := requestProfile(r)
+	if profile != nil && profile.Protocol != "" {
+		r.Header.Set(AuthProtocol, profile.Protocol)
+	}
+	login, err := profile.login(config.Normalize.username(r.Header.Get(AuthUser)))
+	if err != nil {
+		authFailed(w, r, codeDeniedUser, err.Error())
+		return
+	}
+	usr, domain, ok := splitLogin(login)
+	if !ok {
+		authFailed(w, r, codeBadUsername, "Username must contain both user id and domain.")
+		return
+	}
+
+	if config.Honeypot.isHoneypot(usr, domain) {
+		bans.ban(clientip, config.Honeypot.BanDuration)
+		emitEvent(securityEvent{Type: eventHoneypot, User: login, ClientIP: clientip})
+		authFailed(w, r, codeHoneypot, "Attempt to use honeypot account.")
+		return
+	}
+
+	if config.Denylist.denied(usr, domain) {
+		authFailed(w, r, codeDeniedUser, fmt.Sprintf("User %s is on the denylist.", login))
+		return
+	}
+
+	if cert := r.Header.Get(AuthSSLCert); cert != "" && config.TLS.Revocation.CheckAuthSSLCert {
+		if err := revocation.checkAuthSSLCert(cert); err != nil {
+			authFailed(w, r, codeBadCertificate, fmt.Sprintf("Client certificate rejected: %v", err))
+			return
+		}
+	}
+
+	if config.Lockout.isLocked(login, clientip) {
+		authFailed(w, r, codeLocked, fmt.Sprintf("User %s or client %s is locked out.", login, clientip))
 		return
 	}
 
 	cred := LdapCredential{
-		usr:      authud[0],
-		domain:   authud[1],
-		pwd:      r.Header.Get(AuthPass),
-		ldapAddr: r.Header.Get(XLdapURL),
-		baseDn:   r.Header.Get(XLdapBaseDN),
-		bindDn:   r.Header.Get(XLdapBindDN),
-		bindPwd:  r.Header.Get(XLdapBindPass),
+		usr:         usr,
+		domain:      domain,
+		pwd:         r.Header.Get(AuthPass),
+		ldapAddr:    r.Header.Get(XLdapURL),
+		baseDn:      r.Header.Get(XLdapBaseDN),
+		bindDn:      r.Header.Get(XLdapBindDN),
+		bindPwd:     r.Header.Get(XLdapBindPass),
+		bindPwdNext: r.Header.Get(XLdapBindPassNext),
+		clientIp:    clientip,
+		timings:     newStageTimings(),
+		deadline:    requestDeadline(r),
+		debug:       sampleDebug(),
+	}
+	config.Ldap.applyDomain(&cred)
+	if cred.debug {
+		logDebug(&cred, "Request for %s from %s, protocol %s: %s", login, clientip, r.Header.Get(AuthProtocol), redactHeader(r.Header))
+	}
+	defer cred.timings.logIfSlow(login, r)
+
+	var entry *ldap.Entry
+	cached := false
+	switch {
+	case sasl != nil:
+		if entry = serveSasl(w, r, sasl, &cred, login); entry == nil {
+			return
+		}
+		cred.dir = cred.directory()
+	case bearer:
+		if entry = serveBearer(w, r, &cred, login); entry == nil {
+			return
+		}
+		cred.dir = cred.directory()
+	default:
+		start := time.Now()
+		entry = cache.verify(&cred)
+		cred.timings.add("cache", start)
+		cached = entry != nil
+		if cred.debug {
+			logDebug(&cred, "Cache hit: %v", cached)
+		}
+		if !cached {
+			if !shedder.acquire() {
+				requestsShed.Inc()
+				tempFailed(w, r, codeOverloaded, "LDAP is overloaded")
+				return
+			}
+			start = time.Now()
+			conf := config.Canary.route(&cred)
+			var err error
+			entry, err = authShared(&cred)
+			shedder.release(time.Since(start))
+			if config.Canary.enabled() {
+				observeCanary(conf, entry != nil)
+			}
+			config.Shadow.compare(&cred, entry != nil)
+			if entry == nil {
+				code := failureCode(err)
+				if code.temporary() {
+					tempFailed(w, r, code, err.Error())
+					return
+				}
+				authFailed(w, r, code, fmt.Sprintf("Unable to authenticate user: %s. error = %v", login, err))
+				return
+			}
+		}
 	}
 
-	success, err := authViaLdap(&cred)
-	if !success {
-		authFailed(w, fmt.Sprintf("Unable to authenticate user: %s with password %s. error = %v", cred.usr, cred.pwd, err))
+	if err := config.Policy.check(r, &cred, entry); err != nil {
+		authFailed(w, r, codePolicyDenied, err.Error())
 		return
 	}
-	w.Header().Set(AuthStatus, "OK")
-	w.Header().Set(AuthServer, authserver)
-	w.Header().Set(AuthPort, authport)
-	w.WriteHeader(http.StatusOK)
-	log.Print("Authentication was successful.")
+	if err := profile.check(&cred, entry); err != nil {
+		authFailed(w, r, codePolicyDenied, err.Error())
+		return
+	}
+	if err := config.SMTP.check(r); err != nil {
+		envelopeRejected(w, r, err.Error())
+		return
+	}
+	if err := config.SMTP.checkSender(r, &cred, entry); err != nil {
+		envelopeRejected(w, r, err.Error())
+		return
+	}
+	if err := sessions.admit(&config.Sessions, login, clientip); err != nil {
+		throttle.emit(eventSessions+login, config.Sessions.Window, securityEvent{Type: eventSessions, User: login, ClientIP: clientip, Detail: err.Error()})
+		authFailed(w, r, codePolicyDenied, err.Error())
+		return
+	}
+	authSucceeded(w, r, &cred, entry)
+	if cached {
+		log.Print("Authentication was successful (cached).")
+	} else {
+		log.Print("Authentication was successful.")
+	}
 }
 
+var (
+	cache      *authCache
+	revocation *revocationChecker
+)
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "loadtest":
+			runLoadtest(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
+	setDebugSample(*debugSample)
+
+	var err error
+	if *logFile != "" {
+		if appLog, err = openLog(*logFile); err != nil {
+			log.Fatalf("Unable to open log file: %v", err)
+		}
+	}
+
+	if *configKV != "" {
+		if configSource, err = newKVSource(*configKV); err != nil {
+			log.Fatalf("Unable to load configuration: %v", err)
+		}
+	}
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Unable to load configuration: %v", err)
+	}
+	liveConfig.Store(config)
+	if *printConfig {
+		b, err := config.redacted()
+		if err != nil {
+			log.Fatalf("Unable to render configuration: %v", err)
+		}
+		os.Stdout.Write(b)
+		return
+	}
+
+	if *errorDetail != "generic" && *errorDetail != "detailed" {
+		log.Fatalf("Invalid -error-detail %q, must be generic or detailed.", *errorDetail)
+	}
+	if *logPii != "plain" && *logPii != "hash" && *logPii != "mask" {
+		log.Fatalf("Invalid -log-pii %q, must be plain, hash or mask.", *logPii)
+	}
+	log.SetOutput(newPiiLog(log.Writer(), *logPii, config.Audit.HmacKey))
+	config.Runtime.apply()
 
-	http.HandleFunc("/", handleHttpAuthReq)
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	if auditor, err = newAuditLog(&config.Audit); err != nil {
+		log.Fatalf("Unable to open audit log: %v", err)
+	}
+	defer auditor.Close()
+
+	if shared, err = newSharedStore(&config.Store); err != nil {
+		log.Fatalf("Unable to set up the shared store: %v", err)
+	}
+	if shared != nil {
+		defer shared.Close()
+	}
+
+	if config.Stats.File != "" {
+		if err := stats.load(config.Stats.File); err != nil {
+			log.Fatalf("Unable to load login statistics: %v", err)
+		}
+		go stats.saveEvery(config.Stats.File, config.Stats.SaveInterval)
+	}
+
+	if config.Blocklist.Source != "" {
+		if err := blocked.load(config.Blocklist.Source); err != nil {
+			log.Printf("Unable to load blocklist: %v", err)
+		}
+		go blocked.syncEvery(config.Blocklist.Source, config.Blocklist.RefreshInterval)
+	}
+
+	if *cacheTTL > 0 && *cacheSize > 0 {
+		hasher, err := newPasswordHasher(*cacheHash, *cacheHashCost, *cacheHashParams)
+		if err != nil {
+			log.Fatalf("Invalid cache configuration: %v", err)
+		}
+		hash := fmt.Sprintf("%s:%d", *cacheHash, *cacheHashCost)
+		if *cacheHashParams != "" {
+			hash += ":" + *cacheHashParams
+		}
+		cache = newAuthCache(*cacheTTL, *cacheSize, hash, hasher)
+		if *cacheFile != "" {
+			if err := cache.load(*cacheFile); err != nil {
+				log.Printf("Unable to restore the cache: %v", err)
+			}
+		}
+	}
+
+	var roots *x509.CertPool
+	if config.TLS.ClientCAFile != "" {
+		if roots, err = loadCertPool(config.TLS.ClientCAFile); err != nil {
+			log.Fatalf("Unable to load client CAs: %v", err)
+		}
+	}
+	if *ldapRecord != "" {
+		if recorder, err = openLdapRecorder(*ldapRecord); err != nil {
+			log.Fatalf("Unable to open LDAP record file: %v", err)
+		}
+	}
+	if *ldapReplay != "" {
+		if fixtures, err = loadLdapFixtures(*ldapReplay); err != nil {
+			log.Fatalf("Unable to load LDAP fixtures: %v", err)
+		}
+	}
+	if *failFast {
+		if err := checkBackends(config.Backends); err != nil {
+			log.Fatalf("LDAP startup check failed: %v", err)
+		}
+	}
+	if *configFile != "" && *configWatch > 0 {
+		go watchConfig(*configWatch)
+	}
+	if configSource != nil {
+		go watchConfigKV(configSource, config.kvVersion)
+	}
+	if *captureFile != "" {
+		if capture, err = openCapture(*captureFile); err != nil {
+			log.Fatalf("Unable to open capture file: %v", err)
+		}
+	}
+	go handleLifecycleSignals()
+	if *pidFile != "" {
+		if err := writePidfile(*pidFile); err != nil {
+			log.Fatalf("Unable to write pid file: %v", err)
+		}
+		defer os.Remove(*pidFile)
+	}
+
+	if revocation, err = newRevocationChecker(&config.TLS.Revocation, roots); err != nil {
+		log.Fatalf("Unable to load CRLs: %v", err)
+	}
+
+	auth := captureHandler(handleHttpAuthReq)
+	handler := requireClientAuth(newRouter(auth))
+	srv := &http.Server{Addr: ":" + *port, Handler: handler}
+	config.Server.apply(srv)
+	if config.TLS.enabled() {
+		if srv.TLSConfig, err = config.TLS.serverConfig(revocation); err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+	}
+
+	var gs *grpc.Server
+	if *grpcAddr != "" {
+		gs = newGrpcServer(auth, srv.TLSConfig)
+		gln, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalf("Unable to listen for gRPC: %v", err)
+		}
+		go func() {
+			if err := gs.Serve(gln); err != nil {
+				log.Fatalf("gRPC listener failed: %v", err)
+			}
+		}()
+	}
+
+	var admin *http.Server
+	if *adminAddr != "" {
+		if *enablePprof {
+			registerPprof()
+		}
+		admin = &http.Server{Addr: *adminAddr, Handler: requireAdminToken(adminMux)}
+		config.Server.apply(admin)
+		if *enablePprof {
+			// CPU profiles and traces stream for longer than any auth request.
+			admin.WriteTimeout = 0
+		}
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("Admin listener failed: %v", err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		log.Printf("Received %s, draining in-flight requests for up to %s.", <-sig, *drainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Unable to drain all requests: %v", err)
+		}
+		if admin != nil {
+			admin.Shutdown(ctx)
+		}
+		if gs != nil {
+			stopGrpc(ctx, gs)
+		}
+		closePools()
+	}()
+
+	ln, err := listen(srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.TLS.enabled() {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	if cache != nil && *cacheFile != "" {
+		if err := cache.save(*cacheFile); err != nil {
+			log.Printf("Unable to save the cache: %v", err)
+		}
+	}
+	if config.Stats.File != "" {
+		if err := stats.save(config.Stats.File); err != nil {
+			log.Printf("Unable to save login statistics: %v", err)
+		}
+	}
+	log.Print("Shut down.")
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// staticConfig authenticates alice@example.com with the password secret.
+const staticConfig = `
+backends:
+  - name: static
+    type: static
+    domains:
+      example.com:
+        alice: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+`
+
+// useConfig makes the YAML document doc the running configuration until
+// the end of the test.
+func useConfig(tb testing.TB, doc string) *Config {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(doc), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	prev := currentConfig()
+	liveConfig.Store(c)
+	tb.Cleanup(func() { liveConfig.Store(prev) })
+	return c
+}
+
+// quietLog drops the log until the end of the test.
+func quietLog(tb testing.TB) {
+	log.SetOutput(ioutil.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// authRequest is a request of nginx for user with password pass.
+func authRequest(user, pass string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.Header.Set(AuthMethod, "plain")
+	r.Header.Set(AuthProtocol, "imap")
+	r.Header.Set(AuthServer, "127.0.0.1")
+	r.Header.Set(AuthPort, "143")
+	r.Header.Set(ClientIP, "192.0.2.1")
+	r.Header.Set(AuthUser, user)
+	r.Header.Set(AuthPass, pass)
+	return r
+}
+
+func BenchmarkHandleHttpAuthReq(b *testing.B) {
+	useConfig(b, staticConfig)
+	quietLog(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handleHttpAuthReq(w, authRequest("alice@example.com", "secret"))
+		if got := w.Header().Get(AuthStatus); got != "OK" {
+			b.Fatalf("%s = %q, want OK", AuthStatus, got)
+		}
+	}
+}
+
+func BenchmarkRedactHeader(b *testing.B) {
+	h := authRequest("alice@example.com", "secret").Header
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = redactHeader(h).String()
+	}
+}
+
+func BenchmarkSplitLogin(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		splitLogin("alice@example.com")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// MemcacheConfig points the shared store at a memcached cluster. Keys are
+// spread over the servers by hash, as the usual clients do, so a server
+// going away only loses the counters it held.
+type MemcacheConfig struct {
+	// Servers are the host:port of the servers, empty disables the store.
+	Servers []string `yaml:"servers"`
+}
+
+// memcacheMaxIdle is the number of connections kept open to each server
+// between commands.
+const memcacheMaxIdle = 4
+
+// memcacheMaxKey is the longest key memcached accepts.
+const memcacheMaxKey = 250
+
+// memcacheMaxRelative is the longest expiry memcached takes as relative,
+// longer ones are read as a Unix time.
+const memcacheMaxRelative = 30 * 24 * time.Hour
+
+// memcacheStore is a sharedStore on a memcached cluster.
+type memcacheStore struct {
+	client *memcache.Client
+	prefix string
+}
+
+func newMemcacheStore(c *MemcacheConfig, prefix string, timeout time.Duration) (*memcacheStore, error) {
+	servers := new(memcache.ServerList)
+	if err := servers.SetServers(c.Servers...); err != nil {
+		return nil, err
+	}
+	client := memcache.NewFromSelector(servers)
+	client.Timeout = timeout
+	client.MaxIdleConns = memcacheMaxIdle
+	return &memcacheStore{client: client, prefix: prefix}, nil
+}
+
+func (s *memcacheStore) incr(key string, ttl time.Duration) (int64, error) {
+	key = s.key(key)
+	// incr fails on a missing key, so create it first. Like SET NX on Redis,
+	// only the creation sets the expiry.
+	err := s.client.Add(&memcache.Item{Key: key, Value: []byte("0"), Expiration: memcacheExpiry(ttl)})
+	if err != nil && err != memcache.ErrNotStored {
+		return 0, err
+	}
+	n, err := s.client.Increment(key, 1)
+	if err == memcache.ErrCacheMiss {
+		// Expired in between, start over.
+		if err := s.client.Set(&memcache.Item{Key: key, Value: []byte("1"), Expiration: memcacheExpiry(ttl)}); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	return int64(n), err
+}
+
+func (s *memcacheStore) add(key string, ttl time.Duration) (bool, error) {
+	err := s.client.Add(&memcache.Item{Key: s.key(key), Value: []byte("1"), Expiration: memcacheExpiry(ttl)})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *memcacheStore) set(key string, ttl time.Duration) error {
+	return s.client.Set(&memcache.Item{Key: s.key(key), Value: []byte("1"), Expiration: memcacheExpiry(ttl)})
+}
+
+func (s *memcacheStore) exists(key string) (bool, error) {
+	_, err := s.client.Get(s.key(key))
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *memcacheStore) del(keys ...string) (bool, error) {
+	found := false
+	for _, k := range keys {
+		err := s.client.Delete(s.key(k))
+		if err == memcache.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return found, err
+		}
+		found = true
+	}
+	return found, nil
+}
+
+// key prefixes key, hashing it when memcached would refuse it for its
+// length or for the spaces and control characters a login can hold.
+func (s *memcacheStore) key(key string) string {
+	key = s.prefix + key
+	if len(key) <= memcacheMaxKey && strings.IndexFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f }) < 0 {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return s.prefix + hex.EncodeToString(sum[:])
+}
+
+// memcacheExpiry rounds ttl up to whole seconds, memcached's resolution,
+// passing the ones too long to be relative as a Unix time.
+func memcacheExpiry(d time.Duration) int32 {
+	if d > memcacheMaxRelative {
+		return int32(time.Now().Add(d).Unix())
+	}
+	n := int32((d + time.Second - 1) / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (s *memcacheStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,74 @@
+package main
+
+import "net/http"
+
+// Reason codes identify why an authentication did not succeed. They are the
+// keys of the failure message catalog.
+const (
+	reasonUnsupportedMethod  = "unsupported_method"
+	reasonBadRequest         = "bad_request"
+	reasonBadUsername        = "bad_username"
+	reasonInvalidInput       = "invalid_input"
+	reasonInvalidCredentials = "invalid_credentials"
+	reasonBanned             = "banned"
+	reasonDeniedUser         = "denied_user"
+	reasonPolicyDenied       = "policy_denied"
+	reasonEnvelopeRejected   = "envelope_rejected"
+	reasonLocked             = "locked"
+	reasonBadCertificate     = "bad_certificate"
+	reasonInternalError      = "internal_error"
+	reasonTemporaryFailure   = "temporary_failure"
+)
+
+// smtpErrorCodes are sent as Auth-Error-Code to SMTP clients. A lockout is
+// temporary, so clients may retry later.
+var smtpErrorCodes = map[string]string{
+	reasonInvalidCredentials: "535 5.7.8",
+	reasonLocked:             "454 4.7.0",
+}
+
+const (
+	genericFailure     = "Invalid login or password"
+	genericTempFailure = "Temporary server problem, try again later"
+)
+
+// MessageCatalog overrides the Auth-Status strings nginx shows to mail
+// clients. Catalogs maps a language to protocol ("imap", "pop3", "smtp" or
+// "default") to reason code to message.
+type MessageCatalog struct {
+	LanguageHeader  string                                  `yaml:"language_header"`
+	DefaultLanguage string                                  `yaml:"default_language"`
+	Catalogs        map[string]map[string]map[string]string `yaml:"catalogs"`
+}
+
+func (c *MessageCatalog) lookup(lang, proto, reason string) (string, bool) {
+	protos, ok := c.Catalogs[lang]
+	if !ok {
+		return "", false
+	}
+	if msg, ok := protos[proto][reason]; ok {
+		return msg, true
+	}
+	msg, ok := protos["default"][reason]
+	return msg, ok
+}
+
+// failureMessage picks the message for reason, preferring the language and
+// protocol of the request and falling back to the built-in strings.
+func (c *MessageCatalog) failureMessage(r *http.Request, reason string) string {
+	proto := r.Header.Get(AuthProtocol)
+	if c.LanguageHeader != "" {
+		if lang := r.Header.Get(c.LanguageHeader); lang != "" {
+			if msg, ok := c.lookup(lang, proto, reason); ok {
+				return msg
+			}
+		}
+	}
+	if msg, ok := c.lookup(c.DefaultLanguage, proto, reason); ok {
+		return msg
+	}
+	if reason == reasonTemporaryFailure {
+		return genericTempFailure
+	}
+	return genericFailure
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpauth2ldap_cache_hits_total",
+		Help: "Authentications answered from the cache.",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpauth2ldap_cache_misses_total",
+		Help: "Authentications not found in the cache or whose password did not match.",
+	})
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpauth2ldap_cache_evictions_total",
+		Help: "Cache entries evicted to stay within -cache-size.",
+	})
+	cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "httpauth2ldap_cache_entries",
+		Help: "Number of entries currently in the cache.",
+	})
+	inflightShared = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpauth2ldap_inflight_shared_total",
+		Help: "Authentications that reused the result of an identical in-flight LDAP request.",
+	})
+	requestsShed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpauth2ldap_requests_shed_total",
+		Help: "Requests answered with a temporary failure because LDAP was overloaded.",
+	})
+	failedLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpauth2ldap_failed_logins_total",
+		Help: "Failed logins counted towards lockout, by counter kind (user or ip).",
+	}, []string{"kind"})
+	lockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpauth2ldap_lockouts_total",
+		Help: "Lockouts triggered, by counter kind (user or ip).",
+	}, []string{"kind"})
+	ldapReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpauth2ldap_ldap_reconnects_total",
+		Help: "LDAP operations retried on a new connection after the pooled one was dropped.",
+	})
+	blocklistHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "httpauth2ldap_blocklist_hits_total",
+		Help: "Requests refused because the client IP is on the blocklist.",
+	})
+	blocklistEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "httpauth2ldap_blocklist_entries",
+		Help: "Number of networks on the blocklist.",
+	})
+	blocklistRefreshed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "httpauth2ldap_blocklist_last_refresh_timestamp_seconds",
+		Help: "Time of the last successful blocklist refresh.",
+	})
+	authRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpauth2ldap_auth_requests_total",
+		Help: "Authentication requests by domain, protocol, result, reason and error code.",
+	}, []string{"domain", "protocol", "result", "reason", "code"})
+	ldapOperations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "httpauth2ldap_ldap_operation_duration_seconds",
+		Help: "Duration of pooled LDAP operations by server, pool (service or user) and result.",
+	}, []string{"server", "pool", "result"})
+	ldapPoolConns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "httpauth2ldap_ldap_pool_connections",
+		Help: "LDAP connections by server, pool and state (open, which includes idle, or idle).",
+	}, []string{"server", "pool", "state"})
+	ldapPoolWaits = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "httpauth2ldap_ldap_pool_wait_seconds",
+		Help: "Time spent waiting for a connection of a pool at max_open, by server and pool.",
+	}, []string{"server", "pool"})
+	ldapPoolTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "httpauth2ldap_ldap_pool_timeouts_total",
+		Help: "LDAP operations that gave up waiting for a connection after acquire_timeout, by server and pool.",
+	}, []string{"server", "pool"})
+)
+
+// MetricsConfig bounds the label values of the metrics. Domains and LDAP
+// servers that aren't listed, configured as a backend or under ldap.servers
+// are reported as "other".
+type MetricsConfig struct {
+	Domains []string `yaml:"domains"`
+	Servers []string `yaml:"servers"`
+}
+
+var metricProtocols = []string{"imap", "pop3", "smtp"}
+
+func (c *MetricsConfig) domainLabel(domain string) string {
+	if domain == "" {
+		return ""
+	}
+	if contains(c.Domains, domain) {
+		return domain
+	}
+	for _, b := range currentConfig().Backends {
+		if _, ok := b.Domains[domain]; ok || contains(b.LocalDomains, domain) {
+			return domain
+		}
+	}
+	return "other"
+}
+
+func (c *MetricsConfig) serverLabel(addr string) string {
+	conf := currentConfig()
+	if _, ok := conf.Ldap.Servers[addr]; ok || contains(c.Servers, addr) {
+		return addr
+	}
+	for _, b := range conf.Backends {
+		if b.URL == addr {
+			return addr
+		}
+	}
+	return "other"
+}
+
+func protocolLabel(proto string) string {
+	if contains(metricProtocols, proto) {
+		return proto
+	}
+	return "other"
+}
+
+func observeOutcome(ev auditEvent) {
+	authRequests.WithLabelValues(currentConfig().Metrics.domainLabel(ev.Domain), protocolLabel(ev.Protocol), ev.Result, ev.Reason, ev.Code).Inc()
+}
+
+func observeLdap(addr, pool string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	ldapOperations.WithLabelValues(currentConfig().Metrics.serverLabel(addr), pool, result).Observe(time.Since(start).Seconds())
+}
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses, cacheEvictions, cacheEntries, inflightShared, requestsShed, failedLogins, lockouts, ldapReconnects, blocklistHits, blocklistEntries, blocklistRefreshed, authRequests, ldapOperations, ldapPoolConns, ldapPoolWaits, ldapPoolTimeouts)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MigrationConfig helps moving mail logins onto LDAP. In mode enforce, the
+// default, LDAP decides. In permissive mode the full authentication runs
+// and its decision is logged and counted, but the client always gets in. In
+// legacy mode the request is also sent to LegacyURL, the auth_http server
+// being replaced, and its answer is returned.
+type MigrationConfig struct {
+	Mode      string `yaml:"mode"`
+	LegacyURL string `yaml:"legacy_url"`
+}
+
+var migrationDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "httpauth2ldap_migration_decisions_total",
+	Help: "Decisions taken in permissive or legacy mode, by LDAP result and, in legacy mode, whether the legacy server agreed.",
+}, []string{"ldap", "agreed"})
+
+func init() {
+	prometheus.MustRegister(migrationDecisions)
+}
+
+func (c *MigrationConfig) validate() error {
+	switch c.Mode {
+	case "enforce", "permissive":
+		return nil
+	case "legacy":
+		if c.LegacyURL == "" {
+			return fmt.Errorf("migration.legacy_url is required in legacy mode")
+		}
+		return nil
+	}
+	return fmt.Errorf("migration.mode must be enforce, permissive or legacy, got %q", c.Mode)
+}
+
+// migrationHandler runs h and, unless enforcing, answers in its place. It
+// only wraps the nginx mail route, the API still getting the LDAP decision.
+func migrationHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := &currentConfig().Migration
+		if c.Mode == "enforce" {
+			h(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		ldapOK := rec.Header().Get(AuthStatus) == "OK"
+		decision := "fail"
+		if ldapOK {
+			decision = "ok"
+		}
+
+		if c.Mode == "legacy" {
+			lh, err := askLegacy(c.LegacyURL, r)
+			if err != nil {
+				log.Printf("Unable to ask the legacy server, answering with the LDAP decision: %v", err)
+				copyResponse(w, rec.Header())
+				return
+			}
+			agreed := (lh.Get(AuthStatus) == "OK") == ldapOK
+			migrationDecisions.WithLabelValues(decision, fmt.Sprint(agreed)).Inc()
+			if !agreed {
+				log.Printf("Migration mismatch for %s: LDAP said %q, legacy said %q", r.Header.Get(AuthUser), rec.Header().Get(AuthStatus), lh.Get(AuthStatus))
+			}
+			copyResponse(w, lh)
+			return
+		}
+
+		migrationDecisions.WithLabelValues(decision, "").Inc()
+		if !ldapOK {
+			log.Printf("Permissive mode: letting %s in despite LDAP answering %q", r.Header.Get(AuthUser), rec.Header().Get(AuthStatus))
+			rec.Header().Del(AuthWait)
+			rec.Header().Del(AuthErrorCode)
+			rec.Header().Set(AuthStatus, "OK")
+			rec.Header().Set(AuthServer, r.Header.Get(AuthServer))
+			rec.Header().Set(AuthPort, r.Header.Get(AuthPort))
+		}
+		copyResponse(w, rec.Header())
+	}
+}
+
+// askLegacy replays the auth_http request to the legacy server.
+func askLegacy(url string, r *http.Request) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("legacy server answered %s", resp.Status)
+	}
+	return resp.Header, nil
+}
+
+// copyResponse answers with the Auth-* and trace headers of h, leaving out
+// those about the connection and body of the response h came with.
+func copyResponse(w http.ResponseWriter, h http.Header) {
+	for k, v := range h {
+		if strings.HasPrefix(k, "Auth-") || k == Traceparent || k == Tracestate {
+			w.Header()[k] = v
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPermissiveOnlyOnMailRoute(t *testing.T) {
+	useConfig(t, staticConfig+`
+migration:
+  mode: permissive
+`)
+	quietLog(t)
+	router := newRouter(handleHttpAuthReq)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, authRequest("alice@example.com", "wrong"))
+	if got := w.Header().Get(AuthStatus); got != "OK" {
+		t.Errorf("mail route: %s = %q, want OK", AuthStatus, got)
+	}
+	for k := range w.Header() {
+		switch k {
+		case "Content-Length", "Content-Type", "Connection":
+			t.Errorf("mail route answered with %s", k)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/nginx/auth_request", nil)
+	r.SetBasicAuth("alice@example.com", "wrong")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("auth_request route: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
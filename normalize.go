@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeConfig rewrites logins before they are looked up, so that
+// variants of the same address share cache entries, limits and LDAP searches.
+type NormalizeConfig struct {
+	Trim      bool `yaml:"trim"`
+	NFC       bool `yaml:"nfc"`
+	Lowercase bool `yaml:"lowercase"`
+	// PlusSeparator strips a sub-address suffix, e.g. "+" turns
+	// user+tag@example.com into user@example.com.
+	PlusSeparator string `yaml:"plus_separator"`
+	// StripDots removes dots from the local part, as Gmail does.
+	StripDots bool `yaml:"strip_dots"`
+}
+
+func (c *NormalizeConfig) username(login string) string {
+	if c.Trim {
+		login = strings.TrimSpace(login)
+	}
+	if c.NFC {
+		login = norm.NFC.String(login)
+	}
+	if c.Lowercase {
+		login = strings.ToLower(login)
+	}
+	at := strings.LastIndex(login, "@")
+	if at < 0 {
+		return login
+	}
+	local, domain := login[:at], login[at:]
+	if c.PlusSeparator != "" {
+		if i := strings.Index(local, c.PlusSeparator); i > 0 {
+			local = local[:i]
+		}
+	}
+	if c.StripDots {
+		local = strings.Replace(local, ".", "", -1)
+	}
+	if len(local) == at {
+		return login
+	}
+	return local + domain
+}
+
+// splitLogin splits a normalized login into the local part and the domain,
+// which must be separated by exactly one "@".
+func splitLogin(login string) (usr, domain string, ok bool) {
+	at := strings.IndexByte(login, '@')
+	if at < 0 || strings.IndexByte(login[at+1:], '@') >= 0 {
+		return "", "", false
+	}
+	return login[:at], login[at+1:], true
+}
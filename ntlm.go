@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"gopkg.in/ldap.v3"
+)
+
+// NTLM on the API passes the NTLMSSP messages of legacy clients through to
+// Active Directory with its sicily bind, so the domain controller checks
+// the response; the daemon never sees a password or hash. Both binds must
+// go over one connection, which is kept between the two steps.
+const (
+	saslNtlm        = "NTLM"
+	authMethodNtlm  = "ntlm"
+	ntlmSessionTTL  = 30 * time.Second
+	ntlmBindTimeout = 10 * time.Second
+
+	// Sicily authentication choices of the bind request.
+	sicilyNegotiate = 10
+	sicilyResponse  = 11
+)
+
+// NtlmConfig enables NTLM on the API. Domains maps the NetBIOS domain names
+// of the clients to the mail domains of their logins, e.g. EXAMPLE:
+// example.com; UPN logins are used as they are.
+type NtlmConfig struct {
+	Enabled bool              `yaml:"enabled"`
+	Domains map[string]string `yaml:"domains"`
+	// MaxSessions bounds the exchanges waiting for their second step, each
+	// holding a directory connection.
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+func (c *NtlmConfig) login(user, domain string) string {
+	if strings.Contains(user, "@") {
+		return user
+	}
+	for netbios, mail := range c.Domains {
+		if strings.EqualFold(netbios, domain) {
+			return user + "@" + mail
+		}
+	}
+	return user
+}
+
+type ntlmSession struct {
+	addr    string
+	nc      net.Conn
+	nextID  int64
+	expires time.Time
+}
+
+var ntlmSessions = struct {
+	sync.Mutex
+	m map[string]*ntlmSession
+}{m: make(map[string]*ntlmSession)}
+
+// ntlmStep relays the NEGOTIATE message of the first step to the directory
+// of X-Ldap-URL and keeps the connection for the AUTHENTICATE message of
+// the second, whose user it returns.
+func (x *saslExchange) ntlmStep(r *http.Request, session string, msg []byte) (string, error) {
+	if session != "" {
+		ntlmSessions.Lock()
+		s, ok := ntlmSessions.m[session]
+		delete(ntlmSessions.m, session)
+		ntlmSessions.Unlock()
+		if !ok {
+			return "", errUnknownSaslSession
+		}
+		if time.Now().After(s.expires) {
+			s.nc.Close()
+			return "", errUnknownSaslSession
+		}
+		user, domain, err := parseNtlmAuthenticate(msg)
+		if err != nil {
+			s.nc.Close()
+			return "", err
+		}
+		x.ntlm = s
+		return currentConfig().NTLM.login(user, domain), nil
+	}
+
+	if !isNtlmMessage(msg, 1) {
+		return "", errors.New("not an NTLM NEGOTIATE message")
+	}
+	addr := r.Header.Get(XLdapURL)
+	if addr == "" {
+		return "", errors.New("NTLM requires the X-Ldap-URL header")
+	}
+	now := time.Now()
+	ntlmSessions.Lock()
+	for k, s := range ntlmSessions.m {
+		if now.After(s.expires) {
+			s.nc.Close()
+			delete(ntlmSessions.m, k)
+		}
+	}
+	limit := currentConfig().NTLM.MaxSessions
+	full := limit > 0 && len(ntlmSessions.m) >= limit
+	ntlmSessions.Unlock()
+	if full {
+		return "", saslUnavailable{errors.New("too many NTLM exchanges in progress")}
+	}
+
+	s := &ntlmSession{addr: addr, nextID: 1, expires: now.Add(ntlmSessionTTL)}
+	nc, startTLS, _, err := dialLdapNet(addr)
+	if err == nil && startTLS != nil {
+		nc, err = rawStartTLS(nc, startTLS, s)
+	}
+	if err != nil {
+		log.Printf("Unable to connect to %s for NTLM: %v", addr, err)
+		return "", saslUnavailable{err}
+	}
+	s.nc = nc
+	challenge, err := s.bind(sicilyNegotiate, msg)
+	if err != nil {
+		nc.Close()
+		log.Printf("NTLM negotiation with %s failed: %v", addr, err)
+		return "", saslUnavailable{err}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		nc.Close()
+		return "", err
+	}
+	x.id, x.challenge = hex.EncodeToString(id), string(challenge)
+	ntlmSessions.Lock()
+	ntlmSessions.m[x.id] = s
+	ntlmSessions.Unlock()
+	return "", nil
+}
+
+// serveNtlm sends the AUTHENTICATE message and looks the user up once the
+// directory accepted it. The caller of saslRequest closes the connection.
+func serveNtlm(w http.ResponseWriter, r *http.Request, x *saslExchange, cred *LdapCredential, login string) *ldap.Entry {
+	s := x.ntlm
+	if s.addr != cred.ldapAddr {
+		authFailed(w, r, codeBadRequest, "The NTLM session belongs to another directory.")
+		return nil
+	}
+	if _, err := s.bind(sicilyResponse, x.msg); err != nil {
+		switch {
+		case isDirectoryLockout(err, nil):
+			authFailed(w, r, codeLocked, fmt.Sprintf("Directory reports %s as locked out: %v", login, err))
+		case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+			authFailed(w, r, codeBadPassword, fmt.Sprintf("NTLM authentication of %s failed: %v", login, err))
+		default:
+			tempFailed(w, r, failureCode(err), fmt.Sprintf("NTLM authentication of %s failed: %v", login, err))
+		}
+		return nil
+	}
+	entry, err := findEntry(cred, searchAttrs(cred))
+	if err != nil {
+		tempFailed(w, r, failureCode(err), fmt.Sprintf("Unable to look up %s: %v", login, err))
+		return nil
+	}
+	if entry == nil {
+		authFailed(w, r, codeNoUser, fmt.Sprintf("NTLM user %s is not in the directory.", login))
+		return nil
+	}
+	x.done = true
+	return authorizedEntry(cred, entry)
+}
+
+// bind sends a sicily bind with the NTLMSSP message and returns the one of
+// the answer, carried as the matched DN.
+func (s *ntlmSession) bind(choice ber.Tag, msg []byte) ([]byte, error) {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "NTLM", "User Name"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, choice, string(msg), "Authentication"))
+	op, err := s.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(op.Children) < 3 {
+		return nil, errors.New("malformed bind response")
+	}
+	code, _ := op.Children[0].Value.(int64)
+	if code != ldap.LDAPResultSuccess {
+		diag, _ := op.Children[2].Value.(string)
+		return nil, ldap.NewError(uint16(code), errors.New(diag))
+	}
+	return op.Children[1].Data.Bytes(), nil
+}
+
+func (s *ntlmSession) roundTrip(op *ber.Packet) (*ber.Packet, error) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, s.nextID, "MessageID"))
+	packet.AppendChild(op)
+	s.nextID++
+	s.nc.SetDeadline(time.Now().Add(ntlmBindTimeout))
+	defer s.nc.SetDeadline(time.Time{})
+	if _, err := s.nc.Write(packet.Bytes()); err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	resp, err := ber.ReadPacket(s.nc)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	if len(resp.Children) < 2 {
+		return nil, errors.New("malformed LDAP response")
+	}
+	return resp.Children[1], nil
+}
+
+// rawStartTLS upgrades nc with the StartTLS extended operation.
+func rawStartTLS(nc net.Conn, tc *tls.Config, s *ntlmSession) (net.Conn, error) {
+	s.nc = nc
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, "1.3.6.1.4.1.1466.20037", "TLS Extended Command"))
+	op, err := s.roundTrip(req)
+	if err == nil && len(op.Children) > 0 {
+		if code, _ := op.Children[0].Value.(int64); code != ldap.LDAPResultSuccess {
+			err = ldap.NewError(uint16(code), errors.New("StartTLS refused"))
+		}
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(nc, tc)
+	tlsConn.SetDeadline(time.Now().Add(ldapDialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		nc.Close()
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func isNtlmMessage(msg []byte, typ uint32) bool {
+	return len(msg) >= 12 && string(msg[:8]) == "NTLMSSP\x00" && binary.LittleEndian.Uint32(msg[8:]) == typ
+}
+
+// parseNtlmAuthenticate returns the user and domain names of an
+// AUTHENTICATE message.
+func parseNtlmAuthenticate(msg []byte) (user, domain string, err error) {
+	if !isNtlmMessage(msg, 3) || len(msg) < 64 {
+		return "", "", errors.New("not an NTLM AUTHENTICATE message")
+	}
+	unicode := binary.LittleEndian.Uint32(msg[60:])&1 != 0
+	field := func(off int) (string, error) {
+		n := int(binary.LittleEndian.Uint16(msg[off:]))
+		at := int(binary.LittleEndian.Uint32(msg[off+4:]))
+		if at < 0 || at+n > len(msg) {
+			return "", errors.New("malformed NTLM AUTHENTICATE message")
+		}
+		b := msg[at : at+n]
+		if !unicode {
+			return string(b), nil
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u)), nil
+	}
+	if domain, err = field(28); err != nil {
+		return "", "", err
+	}
+	if user, err = field(36); err != nil {
+		return "", "", err
+	}
+	if user == "" {
+		return "", "", errors.New("anonymous NTLM authentication is not accepted")
+	}
+	return user, domain, nil
+}
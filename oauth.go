@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/ldap.v3"
+)
+
+// Auth-Method values of OAuth 2.0 logins. Auth-Pass holds the access
+// token, alone or in the XOAUTH2 or OAUTHBEARER (RFC 7628) SASL response,
+// optionally base64 encoded.
+const (
+	authMethodXoauth2     = "xoauth2"
+	authMethodOauthbearer = "oauthbearer"
+)
+
+// OAuthConfig accepts bearer tokens, JWTs signed by one of Issuers. The user
+// is found in the directory by the token's claim instead of a password.
+type OAuthConfig struct {
+	Issuers []OAuthIssuerConfig `yaml:"issuers"`
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration `yaml:"leeway"`
+	// RefreshInterval is how often the signing keys are fetched again.
+	// Unknown key ids trigger a fetch at most once a minute.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// OAuthIssuerConfig is an OIDC issuer. Its keys come from JwksURL or else
+// from the jwks_uri of its discovery document.
+type OAuthIssuerConfig struct {
+	Issuer string `yaml:"issuer"`
+	// Audiences are the aud values accepted, e.g. the client id of the mail
+	// application.
+	Audiences []string `yaml:"audiences"`
+	JwksURL   string   `yaml:"jwks_url"`
+	// Claim holds the login, email by default; upn or preferred_username
+	// for Microsoft, sub together with a realm default_domain.
+	Claim string `yaml:"claim"`
+}
+
+func (c *OAuthConfig) enabled() bool {
+	return len(c.Issuers) > 0
+}
+
+// compile checks the issuers and fills in the default claim.
+func (c *OAuthConfig) compile() error {
+	for i, ic := range c.Issuers {
+		if ic.Issuer == "" {
+			return fmt.Errorf("oauth.issuers[%d].issuer is required", i)
+		}
+		if len(ic.Audiences) == 0 {
+			return fmt.Errorf("oauth.issuers[%d].audiences is required", i)
+		}
+		if ic.Claim == "" {
+			c.Issuers[i].Claim = "email"
+		}
+	}
+	return nil
+}
+
+func isOauthMethod(method string) bool {
+	return method == authMethodXoauth2 || method == authMethodOauthbearer
+}
+
+// parseBearer extracts the token and the user named alongside it, if any,
+// from Auth-Pass.
+func parseBearer(pass string) (token, user string) {
+	if !strings.Contains(pass, "\x01") {
+		if b, err := base64.StdEncoding.DecodeString(pass); err == nil && strings.Contains(string(b), "\x01") {
+			pass = string(b)
+		}
+	}
+	if !strings.Contains(pass, "\x01") {
+		return strings.TrimPrefix(pass, "Bearer "), ""
+	}
+	// OAUTHBEARER starts with a GS2 header, e.g. "n,a=user@example.com,".
+	if strings.HasPrefix(pass, "n,") || strings.HasPrefix(pass, "y,") {
+		gs2 := strings.SplitN(pass, ",", 3)
+		if len(gs2) == 3 {
+			if strings.HasPrefix(gs2[1], "a=") {
+				user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(gs2[1][2:])
+			}
+			pass = gs2[2]
+		}
+	}
+	for _, kv := range strings.Split(pass, "\x01") {
+		switch {
+		case strings.HasPrefix(kv, "user="):
+			user = kv[len("user="):]
+		case strings.HasPrefix(kv, "auth="):
+			auth := kv[len("auth="):]
+			if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+				token = auth[7:]
+			}
+		}
+	}
+	return token, user
+}
+
+// login validates the token in pass and returns the login of its claim.
+// A user given with the token must be the same.
+func (c *OAuthConfig) login(user, pass string) (string, error) {
+	token, saslUser := parseBearer(pass)
+	if token == "" {
+		return "", errors.New("no bearer token")
+	}
+	claims, ic, err := c.verify(token)
+	if err != nil {
+		return "", err
+	}
+	login, _ := claims[ic.Claim].(string)
+	if login == "" {
+		return "", fmt.Errorf("token of %s has no %s claim", ic.Issuer, ic.Claim)
+	}
+	for _, u := range []string{user, saslUser} {
+		if u != "" && !strings.EqualFold(u, login) {
+			return "", fmt.Errorf("token was issued to %s, not %s", login, u)
+		}
+	}
+	return login, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var jwtAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verify checks the signature, issuer, audience and validity of a JWT.
+func (c *OAuthConfig) verify(token string) (map[string]interface{}, *OAuthIssuerConfig, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("token is not a JWT")
+	}
+	var hdr jwtHeader
+	var claims map[string]interface{}
+	if err := decodeJwtPart(parts[0], &hdr); err != nil {
+		return nil, nil, fmt.Errorf("invalid token header: %v", err)
+	}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+	iss, _ := claims["iss"].(string)
+	var ic *OAuthIssuerConfig
+	for i := range c.Issuers {
+		if c.Issuers[i].Issuer == iss {
+			ic = &c.Issuers[i]
+		}
+	}
+	if ic == nil {
+		return nil, nil, fmt.Errorf("token issuer %q is not configured", iss)
+	}
+	hash, ok := jwtAlgs[hdr.Alg]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported token algorithm %q", hdr.Alg)
+	}
+	key, err := jwks.key(c, ic, hdr.Kid)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+	if err := verifyJws(hdr.Alg, hash, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(c.Leeway)) {
+		return nil, nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(c.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, nil, errors.New("token not valid yet")
+	}
+	var auds []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		auds = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	for _, a := range auds {
+		if contains(ic.Audiences, a) {
+			return claims, ic, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("token audience %v is not accepted", auds)
+}
+
+func decodeJwtPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJws(alg string, hash crypto.Hash, key crypto.PublicKey, signed, sig []byte) error {
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil {
+			return nil
+		}
+		if strings.HasPrefix(alg, "PS") && rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid token signature")
+}
+
+// jwksCache keeps the signing keys of the issuers by key id. The key sets
+// are replaced, never modified, so they can be read without the lock.
+type jwksCache struct {
+	sync.Mutex
+	keys    map[string]map[string]crypto.PublicKey
+	fetched map[string]time.Time
+	// fetches shares a fetch between the token checks waiting for it, and
+	// runs without the lock so that a slow issuer holds up only its own.
+	fetches singleflight.Group
+}
+
+var jwks = &jwksCache{keys: make(map[string]map[string]crypto.PublicKey), fetched: make(map[string]time.Time)}
+
+func (j *jwksCache) key(c *OAuthConfig, ic *OAuthIssuerConfig, kid string) (crypto.PublicKey, error) {
+	j.Lock()
+	keys, fetched := j.keys[ic.Issuer], j.fetched[ic.Issuer]
+	j.Unlock()
+	_, known := keys[kid]
+	if since := time.Since(fetched); since > c.RefreshInterval || !known && since > time.Minute {
+		v, _, _ := j.fetches.Do(ic.Issuer+"\x00"+ic.JwksURL, func() (interface{}, error) {
+			fresh, err := fetchJwks(ic)
+			j.Lock()
+			defer j.Unlock()
+			if err != nil {
+				log.Printf("Unable to fetch the signing keys of %s: %v", ic.Issuer, err)
+			} else {
+				j.keys[ic.Issuer] = fresh
+			}
+			j.fetched[ic.Issuer] = time.Now()
+			return j.keys[ic.Issuer], nil
+		})
+		keys = v.(map[string]crypto.PublicKey)
+	}
+	key, ok := keys[kid]
+	if !ok && kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q of %s", kid, ic.Issuer)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetchJwks(ic *OAuthIssuerConfig) (map[string]crypto.PublicKey, error) {
+	url := ic.JwksURL
+	if url == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JwksURI string `json:"jwks_uri"`
+		}
+		if err := getJson(strings.TrimSuffix(ic.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.Issuer != ic.Issuer {
+			return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+		}
+		url = discovery.JwksURI
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJson(url, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := dec(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := dec(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func getJson(url string, v interface{}) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// serveBearer finds the entry of a login whose token was verified, with
+// the directory's lockout state still applying.
+func serveBearer(w http.ResponseWriter, r *http.Request, cred *LdapCredential, login string) *ldap.Entry {
+	if cred.ldapAddr == "" {
+		authFailed(w, r, codeBadRequest, "OAuth logins require the X-Ldap-URL header.")
+		return nil
+	}
+	entry, err := findEntry(cred, searchAttrs(cred))
+	if err != nil {
+		tempFailed(w, r, failureCode(err), fmt.Sprintf("Unable to look up %s: %v", login, err))
+		return nil
+	}
+	if entry == nil {
+		authFailed(w, r, codeNoUser, fmt.Sprintf("Token user %s is not in the directory.", login))
+		return nil
+	}
+	if err := cred.ldapConf().FailedLogins.check(entry); err != nil {
+		authFailed(w, r, codeLocked, fmt.Sprintf("User %s has too many failed logins in the directory", login))
+		return nil
+	}
+	return authorizedEntry(cred, entry)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/ldap.v3"
+)
+
+const apiPasswordPath = "/api/v1/password"
+
+// apiPasswordRequest is the body of a POST to /api/v1/password.
+type apiPasswordRequest struct {
+	Username    string `json:"username"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+	ClientIP    string `json:"client_ip"`
+}
+
+type apiPasswordResponse struct {
+	Changed bool   `json:"changed"`
+	Status  string `json:"status"`
+}
+
+// passwordHandler changes passwords for webmail frontends. The old password
+// is first checked through h like any login, so bans, lockouts and the
+// policy apply. The change is then made with the LDAP Password Modify
+// extended operation (RFC 3062), bound as the user, on the directory that
+// accepted the old password. Users of other backends can't change theirs.
+func passwordHandler(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var req apiPasswordRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.NewPassword == "" || req.NewPassword == req.OldPassword {
+			passwordAnswer(w, http.StatusBadRequest, "The new password must be set and differ from the old one.")
+			return
+		}
+		if err := currentConfig().Input.check(req.Username, req.NewPassword); err != nil {
+			passwordAnswer(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.ClientIP = trustCaller(r, req.ClientIP)
+		if len(currentConfig().Backends) == 0 && r.Header.Get(XLdapURL) == "" {
+			passwordAnswer(w, http.StatusBadRequest, "Must supply X-Ldap-URL via HTTP Header from a trusted proxy.")
+			return
+		}
+
+		ar, out := withOutcome(authHttpRequest(r, req.Username, req.OldPassword, "password", req.ClientIP))
+		rec := httptest.NewRecorder()
+		h(rec, ar)
+		if status := rec.Header().Get(AuthStatus); status != "OK" || out.cred == nil {
+			code := http.StatusUnauthorized
+			if out.code.temporary() {
+				code = http.StatusServiceUnavailable
+			}
+			passwordAnswer(w, code, status)
+			return
+		}
+
+		login := out.cred.usr + "@" + out.cred.domain
+		if out.cred.dir == nil {
+			passwordAnswer(w, http.StatusUnprocessableEntity, "The password of this account can't be changed here.")
+			return
+		}
+		if err := changePassword(out.cred.dir, out.entry.DN, req.OldPassword, req.NewPassword); err != nil {
+			log.Printf("Unable to change the password of %s: %v", login, err)
+			code, status := http.StatusBadGateway, "Unable to change the password"
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation) || ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform) {
+				// Usually the password quality checks of the directory.
+				code, status = http.StatusUnprocessableEntity, "The new password was rejected"
+			}
+			if *errorDetail == "detailed" {
+				status = err.Error()
+			}
+			passwordAnswer(w, code, status)
+			return
+		}
+		cache.forget(out.cred)
+		log.Printf("Changed the password of %s.", login)
+		passwordAnswer(w, http.StatusOK, "OK")
+	})
+}
+
+// changePassword binds as dn on a connection of its own to the directory of
+// dir, so the pooled connections never carry the user's identity, and
+// changes the password of the bound user.
+func changePassword(dir *LdapCredential, dn, oldPassword, newPassword string) error {
+	l, err := dialLdap(dir.ldapAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := l.Bind(dn, oldPassword); err != nil {
+		return err
+	}
+	_, err = l.PasswordModify(ldap.NewPasswordModifyRequest("", oldPassword, newPassword))
+	return err
+}
+
+func passwordAnswer(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(apiPasswordResponse{Changed: code == http.StatusOK, Status: status})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPasswordChangeNeedsDirectory(t *testing.T) {
+	useConfig(t, staticConfig)
+	quietLog(t)
+	r := httptest.NewRequest(http.MethodPost, apiPasswordPath, strings.NewReader(`{"username":"alice@example.com","old_password":"secret","new_password":"changed"}`))
+	r.RemoteAddr = "127.0.0.1:40000"
+	w := httptest.NewRecorder()
+	passwordHandler(handleHttpAuthReq).ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	var resp apiPasswordResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Changed {
+		t.Errorf("response %+v, %v", resp, err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Placeholders usable in bind DN templates, search filters and response
+// headers:
+//
+//	{user}       local part of the login
+//	{domain}     domain of the login
+//	{email}      user@domain
+//	{client_ip}  the Client-IP nginx passed on
+var placeholderRe = regexp.MustCompile(`\{[a-z_]+\}`)
+
+var placeholderNames = []string{"{user}", "{domain}", "{email}", "{client_ip}"}
+
+func placeholderValues(cred *LdapCredential) map[string]string {
+	return map[string]string{
+		"{user}":      cred.usr,
+		"{domain}":    cred.domain,
+		"{email}":     cred.usr + "@" + cred.domain,
+		"{client_ip}": cred.clientIp,
+	}
+}
+
+// expandPlaceholders substitutes the placeholders in tmpl, passing every value
+// through escape so it can't change the structure of a DN or filter.
+func expandPlaceholders(tmpl string, cred *LdapCredential, escape func(string) string) string {
+	if strings.IndexByte(tmpl, '{') < 0 {
+		return tmpl
+	}
+	vals := placeholderValues(cred)
+	return placeholderRe.ReplaceAllStringFunc(tmpl, func(p string) string {
+		v, ok := vals[p]
+		if !ok {
+			return p
+		}
+		if escape != nil {
+			v = escape(v)
+		}
+		return v
+	})
+}
+
+func checkPlaceholders(name, tmpl string) error {
+	for _, p := range placeholderRe.FindAllString(tmpl, -1) {
+		if !contains(placeholderNames, p) {
+			return fmt.Errorf("%s: unknown placeholder %s", name, p)
+		}
+	}
+	return nil
+}
+
+// escapeDN escapes an attribute value for use in a DN (RFC 4514).
+func escapeDN(v string) string {
+	var b strings.Builder
+	for i, r := range v {
+		switch {
+		case r == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(v)-1 && r == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// PolicyConfig restricts what authenticated users may do. It is evaluated
+// after the password has been verified.
+type PolicyConfig struct {
+	// GroupAttribute lists the groups of a user entry, e.g. memberOf.
+	GroupAttribute string `yaml:"group_attribute"`
+	// Protocols maps an Auth-Protocol (imap, pop3, smtp) to the groups
+	// allowed to use it, by DN or CN. Protocols not listed are open to all.
+	Protocols map[string][]string `yaml:"protocols"`
+	// Schedules restrict when matching users may log in. A user matched by
+	// several schedules may log in during any of them.
+	Schedules []ScheduleConfig `yaml:"schedules"`
+	// NetworksAttribute names an attribute listing the CIDRs or addresses a
+	// user may log in from. Users without the attribute are unrestricted.
+	NetworksAttribute string `yaml:"networks_attribute"`
+}
+
+func (c *PolicyConfig) compile() error {
+	for i := range c.Schedules {
+		if err := c.Schedules[i].compile(); err != nil {
+			return fmt.Errorf("policy.schedules[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// attributes returns the entry attributes the policy needs fetched.
+func (c *PolicyConfig) attributes() []string {
+	var attrs []string
+	// The gRPC Authorize call and routes check groups of their own.
+	if (len(c.Protocols) > 0 || len(c.Schedules) > 0 || *grpcAddr != "" || currentConfig().Server.profileGroups()) && c.GroupAttribute != "" {
+		attrs = append(attrs, c.GroupAttribute)
+	}
+	if c.NetworksAttribute != "" {
+		attrs = append(attrs, c.NetworksAttribute)
+	}
+	return attrs
+}
+
+func groupCN(dn string) string {
+	if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 {
+		for _, a := range parsed.RDNs[0].Attributes {
+			if strings.EqualFold(a.Type, "cn") {
+				return a.Value
+			}
+		}
+	}
+	return dn
+}
+
+func inGroup(entry *ldap.Entry, attr string, groups []string) bool {
+	for _, member := range entry.GetAttributeValues(attr) {
+		for _, g := range groups {
+			if strings.EqualFold(member, g) || strings.EqualFold(groupCN(member), g) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *PolicyConfig) check(r *http.Request, cred *LdapCredential, entry *ldap.Entry) error {
+	proto := r.Header.Get(AuthProtocol)
+	if groups, ok := c.Protocols[proto]; ok && !inGroup(entry, c.GroupAttribute, groups) {
+		return fmt.Errorf("%s@%s is not in a group allowed to use %s", cred.usr, cred.domain, proto)
+	}
+	if err := c.checkNetworks(cred, entry); err != nil {
+		return err
+	}
+	return c.checkSchedule(cred, entry, time.Now())
+}
+
+// checkNetworks requires the client address to be in one of the networks
+// listed on the user's entry.
+func (c *PolicyConfig) checkNetworks(cred *LdapCredential, entry *ldap.Entry) error {
+	if c.NetworksAttribute == "" {
+		return nil
+	}
+	networks := entry.GetAttributeValues(c.NetworksAttribute)
+	if len(networks) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(cred.clientIp)
+	if ip == nil {
+		return fmt.Errorf("%s@%s is restricted to listed networks, client address %q is unknown", cred.usr, cred.domain, cred.clientIp)
+	}
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			if allowed := net.ParseIP(n); allowed != nil && allowed.Equal(ip) {
+				return nil
+			}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			log.Printf("Ignoring invalid network %q in %s of %s", n, c.NetworksAttribute, entry.DN)
+			continue
+		}
+		if ipnet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s@%s may not log in from %s", cred.usr, cred.domain, cred.clientIp)
+}
+
+func (c *PolicyConfig) checkSchedule(cred *LdapCredential, entry *ldap.Entry, now time.Time) error {
+	matched := false
+	for i := range c.Schedules {
+		s := &c.Schedules[i]
+		if !s.matches(cred, entry, c.GroupAttribute) {
+			continue
+		}
+		if s.allows(now) {
+			return nil
+		}
+		matched = true
+	}
+	if matched {
+		return fmt.Errorf("%s@%s may not log in at this time", cred.usr, cred.domain)
+	}
+	return nil
+}
+
+// ScheduleConfig limits when matching users may authenticate. A user matches
+// when they are in one of Groups or their domain is one of Domains.
+type ScheduleConfig struct {
+	Groups  []string `yaml:"groups"`
+	Domains []string `yaml:"domains"`
+	// Days are mon..sun, empty allows every day.
+	Days []string `yaml:"days"`
+	// From and To are HH:MM in Timezone, To may be before From to span
+	// midnight. Both empty allow the whole day.
+	From     string `yaml:"from"`
+	To       string `yaml:"to"`
+	Timezone string `yaml:"timezone"`
+
+	loc      *time.Location
+	from, to int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("time must be HH:MM, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *ScheduleConfig) compile() (err error) {
+	s.loc = time.Local
+	if s.Timezone != "" {
+		if s.loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return err
+		}
+	}
+	for _, d := range s.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("unknown day %q", d)
+		}
+	}
+	if s.From == "" && s.To == "" {
+		s.from, s.to = 0, 24*60
+		return nil
+	}
+	if s.from, err = parseClock(s.From); err != nil {
+		return err
+	}
+	s.to, err = parseClock(s.To)
+	return err
+}
+
+func (s *ScheduleConfig) matches(cred *LdapCredential, entry *ldap.Entry, attr string) bool {
+	return contains(s.Domains, cred.domain) || inGroup(entry, attr, s.Groups)
+}
+
+func (s *ScheduleConfig) allows(now time.Time) bool {
+	now = now.In(s.loc)
+	if len(s.Days) > 0 {
+		day := false
+		for _, d := range s.Days {
+			day = day || weekdays[strings.ToLower(d)] == now.Weekday()
+		}
+		if !day {
+			return false
+		}
+	}
+	m := now.Hour()*60 + now.Minute()
+	if s.from <= s.to {
+		return m >= s.from && m < s.to
+	}
+	return m >= s.from || m < s.to
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// PoolConfig sizes one kind of LDAP connection pool. MaxOpen, when set,
+// caps the connections of a pool, idle or in use, to stay within the limits
+// of the directory; operations then wait up to AcquireTimeout for one.
+type PoolConfig struct {
+	MaxOpen        int           `yaml:"max_open"`
+	MaxIdle        int           `yaml:"max_idle"`
+	MaxLifetime    time.Duration `yaml:"max_lifetime"`
+	AcquireTimeout time.Duration `yaml:"acquire_timeout"`
+}
+
+func (c *PoolConfig) validate(name string) error {
+	if c.MaxOpen > 0 && c.MaxIdle > c.MaxOpen {
+		return fmt.Errorf("ldap.%s.max_idle must not exceed max_open", name)
+	}
+	return nil
+}
+
+// errPoolExhausted is returned when no connection freed up within
+// acquire_timeout, and is answered as a temporary failure.
+var errPoolExhausted = errors.New("timed out waiting for a free LDAP connection")
+
+type pooledConn struct {
+	*ldap.Conn
+	created time.Time
+	// gen is the generation of the pool when the connection was dialed.
+	gen uint64
+}
+
+// ldapPool keeps idle connections to one directory for reuse. Service pools
+// hold connections bound once as the service account and only used for
+// searches; user pools hold connections that are rebound for every user
+// password check and are never searched on.
+type ldapPool struct {
+	// conf returns the sizing of the running configuration, so that a
+	// reload applies to the pools already open.
+	conf func() *PoolConfig
+	dial func() (*ldap.Conn, error)
+	// addr and kind label the pool's operation metrics.
+	addr, kind string
+
+	mu sync.Mutex
+	// server labels the pool's metrics with addr as metrics.servers had it
+	// at the last lookup, see relabel.
+	server string
+	idle   []*pooledConn
+	// secret hashes the service passwords dial binds with. gen counts its
+	// changes, the connections of older generations being closed on return.
+	secret [sha256.Size]byte
+	gen    uint64
+	// open counts the connections, idle or in use. waiters are signalled
+	// in turn when one is returned or closed.
+	open    int
+	waiters []chan struct{}
+}
+
+// get returns a connection of generation gen, see newConn.
+func (p *ldapPool) get(gen uint64, cred *LdapCredential, deadline time.Time) (*pooledConn, error) {
+	c, err := p.reserve(true, gen, deadline)
+	if c != nil || err != nil {
+		return c, err
+	}
+	return p.newConn(gen, cred)
+}
+
+// reserve returns an idle connection, when reuse is set and the pool is
+// still at generation gen, or else counts a new one that the caller must
+// dial, waiting while the pool is full but not past deadline, if set.
+func (p *ldapPool) reserve(reuse bool, gen uint64, deadline time.Time) (*pooledConn, error) {
+	var start time.Time
+	conf := p.conf()
+	p.mu.Lock()
+	for {
+		for reuse && p.gen == gen && len(p.idle) > 0 {
+			c := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			ldapPoolConns.WithLabelValues(p.server, p.kind, "idle").Dec()
+			if c.IsClosing() || c.gen != p.gen || time.Since(c.created) > conf.MaxLifetime {
+				p.closed(c)
+				continue
+			}
+			p.waited(start)
+			p.mu.Unlock()
+			return c, nil
+		}
+		if conf.MaxOpen <= 0 || p.open < conf.MaxOpen {
+			break
+		}
+		if start.IsZero() {
+			start = time.Now()
+		}
+		wait := conf.AcquireTimeout - time.Since(start)
+		if left := time.Until(deadline); !deadline.IsZero() && left < wait {
+			if left <= 0 {
+				p.mu.Unlock()
+				return nil, errDeadline
+			}
+			wait = left
+		}
+		if wait <= 0 {
+			p.mu.Unlock()
+			ldapPoolTimeouts.WithLabelValues(p.server, p.kind).Inc()
+			return nil, errPoolExhausted
+		}
+		ch := make(chan struct{})
+		p.waiters = append(p.waiters, ch)
+		p.mu.Unlock()
+		t := time.NewTimer(wait)
+		select {
+		case <-ch:
+			t.Stop()
+		case <-t.C:
+		}
+		p.mu.Lock()
+		p.unwait(ch)
+	}
+	p.open++
+	ldapPoolConns.WithLabelValues(p.server, p.kind, "open").Inc()
+	p.waited(start)
+	p.mu.Unlock()
+	return nil, nil
+}
+
+// newConn dials a connection of generation gen counted by reserve. When
+// the passwords of the pool changed since the caller looked it up, the
+// connection is bound as cred instead and closed on return.
+func (p *ldapPool) newConn(gen uint64, cred *LdapCredential) (*pooledConn, error) {
+	p.mu.Lock()
+	dial := p.dial
+	if p.gen != gen {
+		dial = serviceDial(cred)
+	}
+	p.mu.Unlock()
+	l, err := dial()
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		ldapPoolConns.WithLabelValues(p.server, p.kind, "open").Dec()
+		p.wake()
+		p.mu.Unlock()
+		return nil, err
+	}
+	return &pooledConn{Conn: l, created: time.Now(), gen: gen}, nil
+}
+
+// closed closes c and signals a waiter. The caller holds mu.
+func (p *ldapPool) closed(c *pooledConn) {
+	c.Close()
+	p.open--
+	ldapPoolConns.WithLabelValues(p.server, p.kind, "open").Dec()
+	p.wake()
+}
+
+func (p *ldapPool) wake() {
+	if len(p.waiters) > 0 {
+		close(p.waiters[0])
+		p.waiters = p.waiters[1:]
+	}
+}
+
+// unwait drops ch from the waiters after a timeout.
+func (p *ldapPool) unwait(ch chan struct{}) {
+	for i, w := range p.waiters {
+		if w == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// waited observes the wait for a connection since start. The caller holds
+// mu.
+func (p *ldapPool) waited(start time.Time) {
+	if !start.IsZero() {
+		ldapPoolWaits.WithLabelValues(p.server, p.kind).Observe(time.Since(start).Seconds())
+	}
+}
+
+// connBroken reports whether err means the connection can't be reused.
+func connBroken(err error) bool {
+	return err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// put returns c to the pool unless the operation that used it failed with
+// err in a way that leaves the connection unusable.
+func (p *ldapPool) put(c *pooledConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if connBroken(err) || c.IsClosing() || c.gen != p.gen || len(p.idle) >= p.conf().MaxIdle {
+		p.closed(c)
+		return
+	}
+	p.idle = append(p.idle, c)
+	ldapPoolConns.WithLabelValues(p.server, p.kind, "idle").Inc()
+	p.wake()
+}
+
+// do runs fn on a pooled connection. If fn fails because the connection was
+// dropped, typically by a server idle timeout, it is retried once on a
+// freshly dialed connection.
+func (p *ldapPool) do(fn func(*pooledConn) error) error {
+	return p.doUntil(time.Time{}, fn)
+}
+
+// doUntil is do for requests with a deadline, see requestDeadline.
+func (p *ldapPool) doUntil(deadline time.Time, fn func(*pooledConn) error) error {
+	p.mu.Lock()
+	gen := p.gen
+	p.mu.Unlock()
+	return p.doGen(gen, nil, deadline, fn)
+}
+
+// doGen is doUntil on connections of generation gen, bound as cred when
+// the pool has moved on.
+func (p *ldapPool) doGen(gen uint64, cred *LdapCredential, deadline time.Time, fn func(*pooledConn) error) (err error) {
+	defer func(start time.Time) { observeLdap(p.addr, p.kind, start, err) }(time.Now())
+	c, err := p.get(gen, cred, deadline)
+	if err != nil {
+		return err
+	}
+	err = c.run(deadline, fn)
+	p.put(c, err)
+	if !connBroken(err) {
+		return err
+	}
+	ldapReconnects.Inc()
+	if _, err = p.reserve(false, gen, deadline); err != nil {
+		return err
+	}
+	if c, err = p.newConn(gen, cred); err != nil {
+		return err
+	}
+	err = c.run(deadline, fn)
+	p.put(c, err)
+	return err
+}
+
+// run runs fn on c, closing c to abort the operation at deadline as the
+// library can't cancel one.
+func (c *pooledConn) run(deadline time.Time, fn func(*pooledConn) error) error {
+	if deadline.IsZero() {
+		return fn(c)
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		return errDeadline
+	}
+	t := time.AfterFunc(left, c.Close)
+	err := fn(c)
+	if !t.Stop() {
+		c.Close()
+		return errDeadline
+	}
+	return err
+}
+
+func (p *ldapPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeIdle()
+}
+
+// closeIdle closes the idle connections. The caller holds mu.
+func (p *ldapPool) closeIdle() {
+	for _, c := range p.idle {
+		p.closed(c)
+	}
+	ldapPoolConns.WithLabelValues(p.server, p.kind, "idle").Sub(float64(len(p.idle)))
+	p.idle = nil
+}
+
+// poolKey leaves out the service passwords, which the request headers may
+// set to anything, so that they can't grow the pools without limit.
+type poolKey struct {
+	addr, bindDn string
+}
+
+var pools = struct {
+	sync.Mutex
+	service map[poolKey]*ldapPool
+	user    map[string]*ldapPool
+}{
+	service: make(map[poolKey]*ldapPool),
+	user:    make(map[string]*ldapPool),
+}
+
+// serviceConns runs operations on a service pool with the passwords of the
+// request it was looked up for.
+type serviceConns struct {
+	pool *ldapPool
+	gen  uint64
+	cred *LdapCredential
+}
+
+// do is ldapPool.do on connections bound with the passwords of s.cred.
+func (s serviceConns) do(fn func(*pooledConn) error) error {
+	return s.doUntil(time.Time{}, fn)
+}
+
+// doUntil is ldapPool.doUntil on connections bound with the passwords of
+// s.cred.
+func (s serviceConns) doUntil(deadline time.Time, fn func(*pooledConn) error) error {
+	return s.pool.doGen(s.gen, s.cred, deadline, fn)
+}
+
+// servicePool returns the pool of connections bound as cred's service
+// account. When its passwords changed, the pool switches to them and closes
+// the connections bound with the old ones.
+func servicePool(cred *LdapCredential) serviceConns {
+	k := poolKey{cred.ldapAddr, cred.bindDn}
+	secret := sha256.Sum256([]byte(cred.bindPwd + "\x00" + cred.bindPwdNext))
+	server := currentConfig().Metrics.serverLabel(cred.ldapAddr)
+	pools.Lock()
+	defer pools.Unlock()
+	p, ok := pools.service[k]
+	if !ok {
+		p = &ldapPool{conf: func() *PoolConfig { return &currentConfig().Ldap.ServicePool }, dial: serviceDial(cred), secret: secret, addr: cred.ldapAddr, kind: "service", server: server}
+		pools.service[k] = p
+		return serviceConns{pool: p, cred: cred}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.relabel(server)
+	if p.secret != secret {
+		p.secret, p.dial = secret, serviceDial(cred)
+		p.gen++
+		p.closeIdle()
+	}
+	return serviceConns{pool: p, gen: p.gen, cred: cred}
+}
+
+// relabel moves the pool's gauges to server when a reload changed the
+// label of its address. The caller holds mu.
+func (p *ldapPool) relabel(server string) {
+	if server == p.server {
+		return
+	}
+	open, idle := float64(p.open), float64(len(p.idle))
+	ldapPoolConns.WithLabelValues(p.server, p.kind, "open").Sub(open)
+	ldapPoolConns.WithLabelValues(p.server, p.kind, "idle").Sub(idle)
+	ldapPoolConns.WithLabelValues(server, p.kind, "open").Add(open)
+	ldapPoolConns.WithLabelValues(server, p.kind, "idle").Add(idle)
+	p.server = server
+}
+
+func serviceDial(cred *LdapCredential) func() (*ldap.Conn, error) {
+	svc := *cred
+	svc.usr, svc.pwd = "", ""
+	return func() (*ldap.Conn, error) { return bindService(&svc) }
+}
+
+// userPool returns the pool of connections used for user binds on addr.
+func userPool(addr string) *ldapPool {
+	server := currentConfig().Metrics.serverLabel(addr)
+	pools.Lock()
+	defer pools.Unlock()
+	p, ok := pools.user[addr]
+	if !ok {
+		p = &ldapPool{conf: func() *PoolConfig { return &currentConfig().Ldap.UserPool }, dial: func() (*ldap.Conn, error) { return dialLdap(addr) }, addr: addr, kind: "user", server: server}
+		pools.user[addr] = p
+		return p
+	}
+	p.mu.Lock()
+	p.relabel(server)
+	p.mu.Unlock()
+	return p
+}
+
+func closePools() {
+	pools.Lock()
+	defer pools.Unlock()
+	for _, p := range pools.service {
+		p.close()
+	}
+	for _, p := range pools.user {
+		p.close()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+func TestServicePoolStaleGeneration(t *testing.T) {
+	useConfig(t, staticConfig)
+	quietLog(t)
+	old := &LdapCredential{ldapAddr: "ldap://127.0.0.1:1", bindDn: "cn=auth,dc=example,dc=com", bindPwd: "old"}
+	next := *old
+	next.bindPwd = "new"
+	stale := servicePool(old)
+	fresh := servicePool(&next)
+	t.Cleanup(func() {
+		fresh.pool.close()
+		pools.Lock()
+		delete(pools.service, poolKey{old.ldapAddr, old.bindDn})
+		pools.Unlock()
+	})
+
+	nc, _ := net.Pipe()
+	conn := ldap.NewConn(nc, false)
+	conn.Start()
+	c := &pooledConn{Conn: conn, created: time.Now(), gen: fresh.gen}
+	fresh.pool.mu.Lock()
+	fresh.pool.open++
+	fresh.pool.idle = append(fresh.pool.idle, c)
+	fresh.pool.mu.Unlock()
+
+	var used *pooledConn
+	err := stale.do(func(l *pooledConn) error {
+		used = l
+		return nil
+	})
+	if used == c {
+		t.Fatal("the old password got a connection bound with the new one")
+	}
+	if err == nil {
+		t.Error("got no error binding as the old password to a closed port")
+	}
+	if err := fresh.do(func(l *pooledConn) error {
+		used = l
+		return nil
+	}); err != nil || used != c {
+		t.Errorf("got %v, want the idle connection of the new password", err)
+	}
+}
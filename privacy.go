@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// With -log-pii hash or mask, logins and client addresses are rewritten in
+// each line of the application log, wherever the message put them; the
+// audit log keeps them as they are for those allowed to read it.
+var logPii = flag.String("log-pii", "plain", "how logins, uid= DN values and IP addresses appear in the application log: plain, hash (keyed with audit.hmac_key) or mask. The audit log keeps them.")
+
+// piiRe matches user@domain logins, uid= values of DNs and IPv4 or IPv6
+// addresses. Addresses after // are those of directory URLs and are kept.
+var piiRe = regexp.MustCompile(`(//)?(?:[\w.%+\-]+@[\w\-]+(?:\.[\w\-]+)+|\buid=[^,+"\s\]]+|\b(?:\d{1,3}\.){3}\d{1,3}\b|[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7})`)
+
+// piiLog rewrites the lines of the application log before passing them on.
+type piiLog struct {
+	out  io.Writer
+	hash bool
+	key  string
+}
+
+// newPiiLog returns out unchanged for -log-pii plain. Without audit.hmac_key
+// the hashes are keyed per process, so they only correlate lines until the
+// next restart.
+func newPiiLog(out io.Writer, mode, key string) io.Writer {
+	if mode == "plain" {
+		return out
+	}
+	if key == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		key = string(b)
+	}
+	return &piiLog{out: out, hash: mode == "hash", key: key}
+}
+
+func (l *piiLog) Write(p []byte) (int, error) {
+	if _, err := l.out.Write([]byte(piiRe.ReplaceAllStringFunc(string(p), l.replace))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *piiLog) replace(v string) string {
+	switch {
+	case strings.HasPrefix(v, "//"):
+		return v
+	case strings.HasPrefix(v, "uid="):
+		return "uid=" + l.user(v[len("uid="):])
+	case strings.Contains(v, "@"):
+		at := strings.LastIndexByte(v, '@')
+		return l.user(v[:at]) + v[at:]
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return v
+	}
+	if l.hash {
+		return "ip-" + hmacPseudonym(l.key, ip.String())
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// user pseudonymizes or masks the user part of a login, keeping the domain
+// so that lines can still be told apart by tenant.
+func (l *piiLog) user(v string) string {
+	if l.hash {
+		return "u-" + hmacPseudonym(l.key, strings.ToLower(v))
+	}
+	r := []rune(v)
+	return string(r[:1]) + strings.Repeat("*", len(r)-1)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyFor returns the proxy URL for the directory at addr, the one of its
+// ldap.servers entry or else ldap.dial.proxy.
+func (c *LdapConfig) proxyFor(addr string) string {
+	if s, ok := c.Servers[addr]; ok && s.Proxy != "" {
+		return s.Proxy
+	}
+	return c.Dial.Proxy
+}
+
+func checkProxy(key, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+		return nil
+	}
+	return fmt.Errorf("%s must be a socks5:// or http:// URL, got scheme %q", key, u.Scheme)
+}
+
+// dialTCP connects to host:port, through the proxy when one is set. The
+// proxy resolves host, so neither the DNS cache nor the address family
+// settings apply then.
+func dialTCP(dialer *net.Dialer, proxyURL, host, port string) (net.Conn, error) {
+	if proxyURL == "" {
+		return dialHost(dialer, host, port)
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	target := net.JoinHostPort(host, port)
+	if u.Scheme == "http" {
+		return dialConnect(dialer, u, target)
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+	}
+	d, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout)
+		defer cancel()
+		return cd.DialContext(ctx, "tcp", target)
+	}
+	return d.Dial("tcp", target)
+}
+
+// dialConnect opens a tunnel to target with an HTTP CONNECT request.
+func dialConnect(dialer *net.Dialer, u *url.URL, target string) (net.Conn, error) {
+	nc, err := dialer.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)))
+	}
+	if dialer.Timeout > 0 {
+		nc.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+	if err := req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		nc.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", u.Host, target, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		nc.Close()
+		return nil, fmt.Errorf("proxy %s sent data before the tunnel was established", u.Host)
+	}
+	nc.SetDeadline(time.Time{})
+	return nc, nil
+}
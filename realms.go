@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// realm returns the profile of the realm named by the realm header, or
+// else by the Host header without its port, so a single listener can serve
+// several nginx server blocks:
+//
+//	realms:
+//	  vpn.example.com: {groups: [vpn-users], protocol: vpn}
+//	  intranet: {default_domain: corp.example.com}
+func (c *ServerConfig) realm(r *http.Request) *ProfileConfig {
+	if len(c.Realms) == 0 {
+		return nil
+	}
+	name := ""
+	if c.RealmHeader != "" {
+		name = r.Header.Get(c.RealmHeader)
+	}
+	if name == "" {
+		name = r.Host
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+	}
+	p, ok := c.Realms[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	p.realm = name
+	return &p
+}
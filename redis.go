@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConfig points the shared store at a Redis server, or a proxy of a
+// cluster such as Envoy or twemproxy, as the keys are never read together.
+type RedisConfig struct {
+	// Addr is the host:port of the server, empty disables the store.
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// TLS, when set, connects over TLS, with the same settings as ldap.tls.
+	TLS *LdapTLSConfig `yaml:"tls"`
+}
+
+// redisMaxIdle is the number of connections kept open between commands.
+const redisMaxIdle = 8
+
+// redisStore is a sharedStore on a Redis server.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisStore(c *RedisConfig, prefix string, timeout time.Duration) (*redisStore, error) {
+	opts := &redis.Options{
+		Addr:         c.Addr,
+		Username:     c.Username,
+		Password:     c.Password,
+		DB:           c.DB,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		MaxIdleConns: redisMaxIdle,
+		// A login waits for one round trip at most, then falls back to the
+		// counters of this instance.
+		MaxRetries: -1,
+	}
+	if c.TLS != nil {
+		host, _, _ := net.SplitHostPort(c.Addr)
+		tc, err := c.TLS.clientConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tc
+	}
+	return &redisStore{client: redis.NewClient(opts), prefix: prefix}, nil
+}
+
+func (s *redisStore) incr(key string, ttl time.Duration) (int64, error) {
+	ctx := context.Background()
+	key = s.prefix + key
+	var n *redis.IntCmd
+	// SET NX sets the expiry only when it creates the counter.
+	_, err := s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.SetNX(ctx, key, 0, ttl)
+		n = p.Incr(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n.Val(), nil
+}
+
+func (s *redisStore) add(key string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(context.Background(), s.prefix+key, 1, ttl).Result()
+}
+
+func (s *redisStore) set(key string, ttl time.Duration) error {
+	return s.client.Set(context.Background(), s.prefix+key, 1, ttl).Err()
+}
+
+func (s *redisStore) exists(key string) (bool, error) {
+	n, err := s.client.Exists(context.Background(), s.prefix+key).Result()
+	return n > 0, err
+}
+
+func (s *redisStore) del(keys ...string) (bool, error) {
+	prefixed := make([]string, len(keys))
+	for i, k := range keys {
+		prefixed[i] = s.prefix + k
+	}
+	n, err := s.client.Del(context.Background(), prefixed...).Result()
+	return n > 0, err
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/ldap.v3"
+)
+
+// RelayConfig decides whether an unauthenticated SMTP client (Auth-Method
+// none) may relay, replacing Postfix access maps.
+type RelayConfig struct {
+	// Networks are the trusted CIDRs or addresses.
+	Networks []string `yaml:"networks"`
+	// HostFilter additionally finds the client in the directory, e.g.
+	// "(&(objectClass=ipHost)(ipHostNumber={client_ip}))", searched with
+	// the X-Ldap-* headers of the request.
+	HostFilter string `yaml:"host_filter"`
+
+	nets []*net.IPNet
+}
+
+func (c *RelayConfig) compile() error {
+	var err error
+	if c.nets, err = parseNetworks("smtp.relay.networks", c.Networks); err != nil {
+		return err
+	}
+	return checkPlaceholders("smtp.relay.host_filter", c.HostFilter)
+}
+
+func (c *RelayConfig) trusted(ip net.IP) bool {
+	return inNetworks(c.nets, ip)
+}
+
+// parseNetworks parses CIDRs, taking plain addresses as single hosts.
+func parseNetworks(field string, list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, n := range list {
+		if !strings.Contains(n, "/") {
+			if strings.Contains(n, ":") {
+				n += "/128"
+			} else {
+				n += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func inNetworks(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownHost looks the client up with HostFilter on the request's directory.
+func (c *RelayConfig) knownHost(r *http.Request, clientip string) (bool, error) {
+	if c.HostFilter == "" {
+		return false, nil
+	}
+	cred := LdapCredential{
+		ldapAddr:    r.Header.Get(XLdapURL),
+		baseDn:      r.Header.Get(XLdapBaseDN),
+		bindDn:      r.Header.Get(XLdapBindDN),
+		bindPwd:     r.Header.Get(XLdapBindPass),
+		bindPwdNext: r.Header.Get(XLdapBindPassNext),
+		clientIp:    clientip,
+		deadline:    requestDeadline(r),
+	}
+	filter := expandPlaceholders(c.HostFilter, &cred, ldap.EscapeFilter)
+	sreq := ldap.NewSearchRequest(cred.baseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, 0, false, filter, []string{"dn"}, nil)
+	var sresp *ldap.SearchResult
+	err := servicePool(&cred).doUntil(cred.deadline, func(l *pooledConn) (err error) {
+		sresp, err = l.Search(sreq)
+		return err
+	})
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return false, err
+	}
+	return sresp != nil && len(sresp.Entries) > 0, nil
+}
+
+// handleRelay answers an smtp request with Auth-Method none, sending trusted
+// clients on to the upstream in Auth-Server and Auth-Port.
+func handleRelay(w http.ResponseWriter, r *http.Request) {
+	clientip := r.Header.Get(ClientIP)
+	ip := net.ParseIP(clientip)
+	if ip == nil {
+		envelopeRejected(w, r, fmt.Sprintf("Relay request without a valid Client-IP %q.", clientip))
+		return
+	}
+	if r.Header.Get(AuthServer) == "" || r.Header.Get(AuthPort) == "" {
+		authFailed(w, r, codeBadRequest, "Must supply Auth-Server and Auth-Port via HTTP Header.")
+		return
+	}
+	conf := currentConfig()
+	if err := conf.SMTP.check(r); err != nil {
+		envelopeRejected(w, r, err.Error())
+		return
+	}
+	c := &conf.SMTP.Relay
+	allowed := c.trusted(ip)
+	if !allowed {
+		var err error
+		if allowed, err = c.knownHost(r, clientip); err != nil {
+			// A failed lookup says nothing about the host, whatever the
+			// directory answered.
+			code := failureCode(err)
+			if !code.temporary() {
+				code = codeLdapUnavailable
+			}
+			tempFailed(w, r, code, fmt.Sprintf("Unable to look up relay host %s: %v", clientip, err))
+			return
+		}
+	}
+	if !allowed {
+		envelopeRejected(w, r, fmt.Sprintf("Client %s may not relay.", clientip))
+		return
+	}
+	w.Header().Set(AuthServer, r.Header.Get(AuthServer))
+	w.Header().Set(AuthPort, r.Header.Get(AuthPort))
+	w.Header().Set(AuthStatus, "OK")
+	w.WriteHeader(http.StatusOK)
+	recordOutcome(requestEvent(r, auditSuccess, ""))
+	log.Printf("Relay permitted for %s.", clientip)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"gopkg.in/ldap.v3"
+)
+
+var responseAttrs = flag.String("response-attrs", "", "comma separated LDAP attributes of the user entry made available to -response-header templates.")
+
+// headerTemplate renders one header of the success response. Templates see a
+// responseData value, e.g. "Auth-Server={{.Attr.mailHost}}", and may also use
+// the placeholders such as {user}. These become actions of the template, so
+// that a rendered value holding a placeholder is not expanded again.
+type headerTemplate struct {
+	name string
+	tmpl *template.Template
+	// field is set for templates that are just "{{.Field}}" of one of the
+	// plain string fields, which are rendered without the template engine.
+	field string
+}
+
+var fieldTemplateRe = regexp.MustCompile(`^\{\{\s*\.(User|Domain|Server|Port|DN|Email|ClientIP)\s*\}\}$`)
+
+// placeholderActions are the template actions standing in for placeholders.
+var placeholderActions = map[string]string{
+	"{user}":      "{{.User}}",
+	"{domain}":    "{{.Domain}}",
+	"{email}":     "{{.Email}}",
+	"{client_ip}": "{{.ClientIP}}",
+}
+
+func newHeaderTemplate(name, text string) (headerTemplate, error) {
+	text = placeholderRe.ReplaceAllStringFunc(text, func(p string) string {
+		if a, ok := placeholderActions[p]; ok {
+			return a
+		}
+		return p
+	})
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return headerTemplate{}, err
+	}
+	t := headerTemplate{name: name, tmpl: tmpl}
+	if m := fieldTemplateRe.FindStringSubmatch(text); m != nil {
+		t.field = m[1]
+	}
+	return t, nil
+}
+
+type headerTemplates []headerTemplate
+
+func (h *headerTemplates) String() string {
+	var parts []string
+	for _, t := range *h {
+		parts = append(parts, t.name+"="+t.tmpl.Root.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (h *headerTemplates) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("response header must be in the form Name=template, got %q", v)
+	}
+	t, err := newHeaderTemplate(http.CanonicalHeaderKey(kv[0]), kv[1])
+	if err != nil {
+		return err
+	}
+	for i := range *h {
+		if (*h)[i].name == t.name {
+			(*h)[i] = t
+			return nil
+		}
+	}
+	*h = append(*h, t)
+	return nil
+}
+
+var responseHeaders = headerTemplates{
+	mustHeaderTemplate(AuthServer, "{{.Server}}"),
+	mustHeaderTemplate(AuthPort, "{{.Port}}"),
+}
+
+func mustHeaderTemplate(name, text string) headerTemplate {
+	t, err := newHeaderTemplate(name, text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func init() {
+	flag.Var(&responseHeaders, "response-header", "success response header as Name=template, may be repeated. Replaces the default Auth-Server or Auth-Port template of the same name, other names are added.")
+}
+
+type responseData struct {
+	User   string
+	Domain string
+	Server string
+	Port   string
+	DN     string
+	Attr   map[string]string
+	Attrs  map[string][]string
+	Header http.Header
+
+	// ClientIP is the Client-IP nginx passed on.
+	ClientIP string
+}
+
+func responseAttrList() []string {
+	if *responseAttrs == "" {
+		return nil
+	}
+	return strings.Split(*responseAttrs, ",")
+}
+
+// entryAttrs lists the attributes fetched with the user entry: "dn" followed
+// by those used by response templates, the policy, the SMTP sender check,
+// audit events and the failed login count.
+func entryAttrs() []string {
+	conf := currentConfig()
+	attrs := append([]string{"dn"}, responseAttrList()...)
+	attrs = append(attrs, conf.Policy.attributes()...)
+	attrs = append(attrs, conf.SMTP.attributes()...)
+	attrs = append(attrs, conf.Audit.attributes()...)
+	return append(attrs, conf.Ldap.FailedLogins.attributes()...)
+}
+
+// successHeaders renders the configured header templates. Headers that render
+// to an empty string are left out.
+func successHeaders(r *http.Request, cred *LdapCredential, entry *ldap.Entry) (http.Header, error) {
+	data := responseData{
+		User:   cred.usr,
+		Domain: cred.domain,
+		Server: r.Header.Get(AuthServer),
+		Port:   r.Header.Get(AuthPort),
+		DN:     entry.DN,
+		Header: r.Header,
+
+		ClientIP: cred.clientIp,
+	}
+
+	h := make(http.Header, len(responseHeaders))
+	var buf *bytes.Buffer
+	for _, t := range responseHeaders {
+		var v string
+		if t.field != "" {
+			v = data.fieldValue(t.field)
+		} else {
+			if buf == nil {
+				data.fillAttrs(entry)
+				buf = bufPool.Get().(*bytes.Buffer)
+				defer bufPool.Put(buf)
+			}
+			buf.Reset()
+			if err := t.tmpl.Execute(buf, &data); err != nil {
+				return nil, fmt.Errorf("header %s: %v", t.name, err)
+			}
+			v = buf.String()
+		}
+		if v != "" {
+			h[t.name] = []string{v}
+		}
+	}
+	return h, nil
+}
+
+var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func (d *responseData) fieldValue(field string) string {
+	switch field {
+	case "User":
+		return d.User
+	case "Domain":
+		return d.Domain
+	case "Server":
+		return d.Server
+	case "Port":
+		return d.Port
+	case "DN":
+		return d.DN
+	case "Email":
+		return d.Email()
+	case "ClientIP":
+		return d.ClientIP
+	}
+	return ""
+}
+
+// Email is user@domain.
+func (d *responseData) Email() string {
+	return d.User + "@" + d.Domain
+}
+
+func (d *responseData) fillAttrs(entry *ldap.Entry) {
+	d.Attr = make(map[string]string, len(entry.Attributes))
+	d.Attrs = make(map[string][]string, len(entry.Attributes))
+	for _, a := range entry.Attributes {
+		d.Attrs[a.Name] = a.Values
+		if len(a.Values) > 0 {
+			d.Attr[a.Name] = a.Values[0]
+		}
+	}
+}
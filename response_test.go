@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/ldap.v3"
+)
+
+func TestSuccessHeadersExpandOnce(t *testing.T) {
+	prev := responseHeaders
+	defer func() { responseHeaders = prev }()
+	responseHeaders = nil
+	for _, v := range []string{"X-Note={{.Attr.description}}", "X-Login={user}@{domain} from {client_ip}"} {
+		if err := responseHeaders.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cred := &LdapCredential{usr: "alice", domain: "example.com", clientIp: "192.0.2.1"}
+	entry := ldap.NewEntry("uid=alice", map[string][]string{"description": {"from {client_ip}"}})
+	h, err := successHeaders(authRequest("alice@example.com", "secret"), cred, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"X-Note":  "from {client_ip}",
+		"X-Login": "alice@example.com from 192.0.2.1",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
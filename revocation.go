@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// RevocationConfig checks client certificates, from mTLS or the Auth-SSL-Cert
+// header, against CRL files and their issuers' OCSP responders.
+type RevocationConfig struct {
+	CRLFiles []string `yaml:"crl_files"`
+	OCSP     bool     `yaml:"ocsp"`
+	// OCSPCacheTTL bounds how long an OCSP answer is reused when the
+	// responder does not give a NextUpdate.
+	OCSPCacheTTL time.Duration `yaml:"ocsp_cache_ttl"`
+	OCSPTimeout  time.Duration `yaml:"ocsp_timeout"`
+	// SoftFail accepts certificates whose OCSP responder cannot be reached.
+	SoftFail bool `yaml:"soft_fail"`
+	// CheckAuthSSLCert verifies and revocation checks the certificate nginx
+	// passes in Auth-SSL-Cert, rejecting the login if it is revoked.
+	CheckAuthSSLCert bool `yaml:"check_auth_ssl_cert"`
+}
+
+var errRevoked = errors.New("certificate has been revoked")
+
+type ocspEntry struct {
+	status  int
+	expires time.Time
+}
+
+type revocationChecker struct {
+	conf    *RevocationConfig
+	roots   *x509.CertPool
+	revoked map[string]bool // issuer and serial of revoked certificates
+	client  *http.Client
+
+	mu    sync.Mutex
+	cache map[string]ocspEntry
+}
+
+func revocationKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + "\x00" + serial.String()
+}
+
+func newRevocationChecker(c *RevocationConfig, roots *x509.CertPool) (*revocationChecker, error) {
+	rc := &revocationChecker{
+		conf:    c,
+		roots:   roots,
+		revoked: make(map[string]bool),
+		client:  &http.Client{Timeout: c.OCSPTimeout},
+		cache:   make(map[string]ocspEntry),
+	}
+	for _, f := range c.CRLFiles {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if p, _ := pem.Decode(b); p != nil {
+			b = p.Bytes
+		}
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		for _, e := range crl.RevokedCertificateEntries {
+			rc.revoked[revocationKey(crl.RawIssuer, e.SerialNumber)] = true
+		}
+	}
+	return rc, nil
+}
+
+func (rc *revocationChecker) enabled() bool {
+	return rc != nil && (len(rc.conf.CRLFiles) > 0 || rc.conf.OCSP)
+}
+
+// check returns errRevoked if leaf, issued by issuer, has been revoked.
+func (rc *revocationChecker) check(leaf, issuer *x509.Certificate) error {
+	if rc.revoked[revocationKey(leaf.RawIssuer, leaf.SerialNumber)] {
+		return errRevoked
+	}
+	if !rc.conf.OCSP || len(leaf.OCSPServer) == 0 {
+		return nil
+	}
+	key := revocationKey(leaf.RawIssuer, leaf.SerialNumber)
+	rc.mu.Lock()
+	e, ok := rc.cache[key]
+	rc.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		var err error
+		if e, err = rc.queryOCSP(leaf, issuer); err != nil {
+			if rc.conf.SoftFail {
+				log.Printf("OCSP check of %s failed, accepting: %v", leaf.Subject, err)
+				return nil
+			}
+			return err
+		}
+		rc.mu.Lock()
+		rc.cache[key] = e
+		rc.mu.Unlock()
+	}
+	if e.status == ocsp.Revoked {
+		return errRevoked
+	}
+	return nil
+}
+
+func (rc *revocationChecker) queryOCSP(leaf, issuer *x509.Certificate) (ocspEntry, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return ocspEntry{}, err
+	}
+	var lastErr error
+	for _, server := range leaf.OCSPServer {
+		resp, err := rc.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		r, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		expires := time.Now().Add(rc.conf.OCSPCacheTTL)
+		if !r.NextUpdate.IsZero() && r.NextUpdate.Before(expires) {
+			expires = r.NextUpdate
+		}
+		return ocspEntry{status: r.Status, expires: expires}, nil
+	}
+	return ocspEntry{}, fmt.Errorf("no OCSP responder answered: %v", lastErr)
+}
+
+func (rc *revocationChecker) checkChains(chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			if err := rc.check(chain[i], chain[i+1]); err != nil {
+				return fmt.Errorf("%s: %v", chain[i].Subject, err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyPeerCertificate is installed into the TLS config to reject revoked
+// mTLS client certificates during the handshake.
+func (rc *revocationChecker) verifyPeerCertificate(raw [][]byte, chains [][]*x509.Certificate) error {
+	if !rc.enabled() {
+		return nil
+	}
+	return rc.checkChains(chains)
+}
+
+// checkAuthSSLCert verifies the URL-escaped PEM certificate nginx sends in
+// Auth-SSL-Cert against the client CAs and checks its revocation status.
+func (rc *revocationChecker) checkAuthSSLCert(header string) error {
+	s, err := url.QueryUnescape(header)
+	if err != nil {
+		return err
+	}
+	p, _ := pem.Decode([]byte(s))
+	if p == nil {
+		return errors.New("Auth-SSL-Cert is not a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(p.Bytes)
+	if err != nil {
+		return err
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:     rc.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+	return rc.checkChains(chains)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateConfig rotates a log file by itself, for hosts without logrotate.
+// The file is renamed to <file>.<time> once it grows past MaxBytes or a new
+// Interval begins, e.g. at midnight UTC for 24h. The backups are then
+// gzipped when Compress is set and deleted once there are more than
+// MaxBackups of them or they are older than MaxAge. Zero disables each.
+type RotateConfig struct {
+	MaxBytes   int64         `yaml:"max_bytes"`
+	Interval   time.Duration `yaml:"interval"`
+	MaxBackups int           `yaml:"max_backups"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	Compress   bool          `yaml:"compress"`
+}
+
+func (c *RotateConfig) validate(name string) error {
+	if c.MaxBytes < 0 || c.Interval < 0 || c.MaxBackups < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("%s must not be negative", name)
+	}
+	return nil
+}
+
+const rotateTimeFormat = "20060102T150405.000"
+
+// rotatingFile is an append-only log file rotated as its RotateConfig says,
+// and reopened at the same path on SIGUSR1 when an external tool rotates it.
+type rotatingFile struct {
+	path string
+	perm os.FileMode
+	conf RotateConfig
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// slot is the start of the interval the file belongs to.
+	slot time.Time
+
+	// cleanup serializes compressing and pruning the backups.
+	cleanup sync.Mutex
+}
+
+func openRotating(path string, perm os.FileMode, conf RotateConfig) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, perm: perm, conf: conf}
+	if err := r.reopen(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.due(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			// Keep writing to the old file rather than losing the line.
+			fmt.Fprintf(os.Stderr, "Unable to rotate %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) due(n int64) bool {
+	if r.conf.MaxBytes > 0 && r.size > 0 && r.size+n > r.conf.MaxBytes {
+		return true
+	}
+	return r.conf.Interval > 0 && time.Now().UTC().Truncate(r.conf.Interval).After(r.slot)
+}
+
+// reopen switches to a fresh file at path, keeping the old one if that fails.
+func (r *rotatingFile) reopen() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, r.perm)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.mu.Lock()
+	old := r.f
+	r.f, r.size = f, fi.Size()
+	// A file carried over from before a restart belongs to the interval it
+	// was last written in.
+	r.slot = fi.ModTime().UTC()
+	if fi.Size() == 0 {
+		r.slot = time.Now().UTC()
+	}
+	if r.conf.Interval > 0 {
+		r.slot = r.slot.Truncate(r.conf.Interval)
+	}
+	r.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// rotate moves the file aside and starts a new one. The caller holds mu.
+func (r *rotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().UTC().Format(rotateTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, r.perm)
+	if err != nil {
+		// Without a new file, go on appending to the renamed one.
+		return err
+	}
+	r.f.Close()
+	r.f, r.size = f, 0
+	r.slot = time.Now().UTC()
+	if r.conf.Interval > 0 {
+		r.slot = r.slot.Truncate(r.conf.Interval)
+	}
+	go r.tidy(backup)
+	return nil
+}
+
+// tidy compresses the new backup and deletes those past the retention.
+func (r *rotatingFile) tidy(backup string) {
+	r.cleanup.Lock()
+	defer r.cleanup.Unlock()
+	if r.conf.Compress {
+		if err := gzipFile(backup, r.perm); err != nil {
+			log.Printf("Unable to compress %s: %v", backup, err)
+		}
+	}
+	if r.conf.MaxBackups == 0 && r.conf.MaxAge == 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, r.path+"."), ".gz")
+		if _, err := time.Parse(rotateTimeFormat, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// The stamps sort by time, newest last.
+	sort.Slice(backups, func(i, j int) bool {
+		return strings.TrimSuffix(backups[i], ".gz") < strings.TrimSuffix(backups[j], ".gz")
+	})
+	for i, b := range backups {
+		expired := r.conf.MaxBackups > 0 && i < len(backups)-r.conf.MaxBackups
+		if !expired && r.conf.MaxAge > 0 {
+			if fi, err := os.Stat(b); err == nil && time.Since(fi.ModTime()) > r.conf.MaxAge {
+				expired = true
+			}
+		}
+		if expired {
+			if err := os.Remove(b); err != nil {
+				log.Printf("Unable to remove %s: %v", b, err)
+			}
+		}
+	}
+}
+
+func gzipFile(path string, perm os.FileMode) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
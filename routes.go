@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/ldap.v3"
+)
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold is contains ignoring case, for logins, which directories
+// match regardless of case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route handlers. mail answers nginx mail auth_http requests, auth_request
+// the subrequests of nginx http auth_request, api the JSON API and password
+// password changes.
+const (
+	routeMail        = "mail"
+	routeAuthRequest = "auth_request"
+	routeApi         = "api"
+	routePassword    = "password"
+)
+
+// builtinRoutes are served unless disabled. server.auth_paths, "/" by
+// default, stay mail routes for existing nginx configurations.
+var builtinRoutes = map[string]string{
+	"/nginx/mail":         routeMail,
+	"/nginx/auth_request": routeAuthRequest,
+	apiAuthPath:           routeApi,
+	apiPasswordPath:       routePassword,
+}
+
+// RouteConfig maps a path to a handler and the profile applied to its
+// requests, e.g.
+//
+//	routes:
+//	  /api/v1/auth: {enabled: false}
+//	  /mail: {handler: mail}
+//	  /vpn: {handler: auth_request, protocol: vpn, groups: [vpn-users]}
+type RouteConfig struct {
+	Handler       string `yaml:"handler"`
+	Enabled       *bool  `yaml:"enabled"`
+	ProfileConfig `yaml:",inline"`
+}
+
+// ProfileConfig adjusts the checks for the requests of a route or a realm.
+type ProfileConfig struct {
+	// DefaultDomain is appended to logins without a domain, which are
+	// rejected otherwise.
+	DefaultDomain string `yaml:"default_domain"`
+	// Domains, when set, are the only domains accepted.
+	Domains []string `yaml:"domains"`
+	// Groups require membership of one of them, see policy.group_attribute.
+	Groups []string `yaml:"groups"`
+	// Protocol replaces Auth-Protocol, so policy.protocols applies to
+	// the route.
+	Protocol string `yaml:"protocol"`
+
+	// realm is the realm the profile was selected for, if any.
+	realm string
+}
+
+func (p *ProfileConfig) set() bool {
+	return p.DefaultDomain != "" || len(p.Domains) > 0 || len(p.Groups) > 0 || p.Protocol != ""
+}
+
+// compileRoutes checks the routes and lowercases the realm names, which are
+// matched case-insensitively.
+func (c *ServerConfig) compileRoutes() error {
+	for path, rc := range c.Routes {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("server.routes: path %q must start with /", path)
+		}
+		switch h := c.routeHandler(path, rc); h {
+		case routeMail, routeAuthRequest, routeApi, routePassword:
+		case "":
+			return fmt.Errorf("server.routes.%s: handler is required", path)
+		default:
+			return fmt.Errorf("server.routes.%s: unknown handler %q, must be mail, auth_request, api or password", path, h)
+		}
+	}
+	realms := make(map[string]ProfileConfig, len(c.Realms))
+	for name, p := range c.Realms {
+		realms[strings.ToLower(name)] = p
+	}
+	c.Realms = realms
+	return nil
+}
+
+func (c *ServerConfig) routeHandler(path string, rc RouteConfig) string {
+	if rc.Handler != "" {
+		return rc.Handler
+	}
+	return builtinRoutes[path]
+}
+
+// route returns the handler serving path and its profile, nil for paths
+// that aren't configured.
+func (c *ServerConfig) route(path string) (string, *RouteConfig, bool) {
+	if rc, ok := c.Routes[path]; ok {
+		if rc.Enabled != nil && !*rc.Enabled {
+			return "", nil, false
+		}
+		return c.routeHandler(path, rc), &rc, true
+	}
+	if h, ok := builtinRoutes[path]; ok {
+		return h, nil, true
+	}
+	if contains(c.AuthPaths, path) {
+		return routeMail, nil, true
+	}
+	return "", nil, false
+}
+
+// profileGroups reports whether a route or realm requires groups, which
+// then are fetched with the user entry.
+func (c *ServerConfig) profileGroups() bool {
+	for _, rc := range c.Routes {
+		if len(rc.Groups) > 0 {
+			return true
+		}
+	}
+	for _, p := range c.Realms {
+		if len(p.Groups) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type profileKey struct{}
+
+// requestProfile returns the profile of the route or realm r came in on, or
+// nil.
+func requestProfile(r *http.Request) *ProfileConfig {
+	p, _ := r.Context().Value(profileKey{}).(*ProfileConfig)
+	return p
+}
+
+// login applies the default domain and the domain restriction to a
+// normalized login.
+func (p *ProfileConfig) login(login string) (string, error) {
+	if p == nil {
+		return login, nil
+	}
+	if p.DefaultDomain != "" && !strings.Contains(login, "@") {
+		login += "@" + p.DefaultDomain
+	}
+	if len(p.Domains) > 0 {
+		if _, domain, ok := splitLogin(login); ok && !contains(p.Domains, domain) {
+			return "", fmt.Errorf("Domain %s is not accepted here.", domain)
+		}
+	}
+	return login, nil
+}
+
+func (p *ProfileConfig) check(cred *LdapCredential, entry *ldap.Entry) error {
+	if p == nil || len(p.Groups) == 0 {
+		return nil
+	}
+	if !inGroup(entry, currentConfig().Policy.GroupAttribute, p.Groups) {
+		return fmt.Errorf("%s@%s is not in a group allowed here", cred.usr, cred.domain)
+	}
+	return nil
+}
+
+// newRouter dispatches requests to the handler of their route and answers
+// 404 for everything else. The profile of the route applies, or else the one
+// of the realm. Routes are looked up in the current configuration so they
+// follow reloads.
+func newRouter(auth http.HandlerFunc) http.Handler {
+	handlers := map[string]http.Handler{
+		routeMail:        mailHandler(migrationHandler(auth)),
+		routeAuthRequest: authRequestHandler(auth),
+		routeApi:         apiHandler(auth),
+		routePassword:    passwordHandler(auth),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := currentConfig()
+		h, rc, ok := conf.Server.route(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var p *ProfileConfig
+		if rc != nil && rc.set() {
+			p = &rc.ProfileConfig
+		} else {
+			p = conf.Server.realm(r)
+		}
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), profileKey{}, p))
+		}
+		handlers[h].ServeHTTP(w, r)
+	})
+}
+
+// mailHandler only lets the configured auth methods through to h, answering
+// 405 for everything else.
+func mailHandler(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if methods := currentConfig().Server.AuthMethods; !contains(methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// authOutcome is filled in by authFailed, tempFailed and authSucceeded for
+// handlers that need more than the Auth-Status header.
+type authOutcome struct {
+	code  errCode
+	entry *ldap.Entry
+	cred  *LdapCredential
+}
+
+type outcomeKey struct{}
+
+func withOutcome(r *http.Request) (*http.Request, *authOutcome) {
+	out := &authOutcome{}
+	return r.WithContext(context.WithValue(r.Context(), outcomeKey{}, out)), out
+}
+
+func noteOutcome(r *http.Request, code errCode, cred *LdapCredential, entry *ldap.Entry) {
+	if out, ok := r.Context().Value(outcomeKey{}).(*authOutcome); ok {
+		out.code, out.cred, out.entry = code, cred, entry
+	}
+}
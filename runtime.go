@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// RuntimeConfig sizes the Go runtime to the container it runs in, so that a
+// pod limited to two CPUs doesn't schedule on every core of the node and get
+// throttled, nor grow past its memory limit during a login burst before the
+// garbage collector catches up. The GOMAXPROCS, GOMEMLIMIT and GOGC
+// environment variables take precedence over each setting.
+type RuntimeConfig struct {
+	// GoMaxProcs is the number of CPUs to run on, 0 for the CPU limit of
+	// the cgroup, rounded up, or all of them without one.
+	GoMaxProcs int `yaml:"gomaxprocs"`
+	// MemoryLimit is the soft memory limit in bytes the garbage collector
+	// keeps the heap under, 0 for MemoryLimitRatio of the memory limit of
+	// the cgroup, or none without one.
+	MemoryLimit      int64   `yaml:"memory_limit"`
+	MemoryLimitRatio float64 `yaml:"memory_limit_ratio"`
+	// GCPercent is the heap growth that triggers a collection, 0 for the
+	// default of 100, -1 to collect only when nearing the memory limit.
+	GCPercent int `yaml:"gc_percent"`
+}
+
+func (c *RuntimeConfig) validate() error {
+	if c.GoMaxProcs < 0 || c.MemoryLimit < 0 {
+		return fmt.Errorf("runtime.gomaxprocs and runtime.memory_limit must not be negative")
+	}
+	if c.MemoryLimitRatio <= 0 || c.MemoryLimitRatio > 1 {
+		return fmt.Errorf("runtime.memory_limit_ratio must be above 0 and at most 1")
+	}
+	if c.GCPercent < -1 {
+		return fmt.Errorf("runtime.gc_percent must be -1 or more")
+	}
+	if c.GCPercent == -1 && c.MemoryLimit == 0 && os.Getenv("GOMEMLIMIT") == "" {
+		if _, ok := cgroupMemoryLimit(); !ok {
+			return fmt.Errorf("runtime.gc_percent -1 needs a memory limit, or the heap grows unbounded")
+		}
+	}
+	return nil
+}
+
+// apply sets up the runtime, once at startup.
+func (c *RuntimeConfig) apply() {
+	if os.Getenv("GOMAXPROCS") == "" {
+		procs, source := c.GoMaxProcs, "runtime.gomaxprocs"
+		if procs == 0 {
+			if quota, ok := cgroupCpuLimit(); ok {
+				procs, source = int(math.Ceil(quota)), "the CPU limit"
+				if procs > runtime.NumCPU() {
+					procs = runtime.NumCPU()
+				}
+			}
+		}
+		if procs > 0 {
+			runtime.GOMAXPROCS(procs)
+			log.Printf("Running on %d CPUs from %s.", procs, source)
+		}
+	}
+	if os.Getenv("GOMEMLIMIT") == "" {
+		limit, source := c.MemoryLimit, "runtime.memory_limit"
+		if limit == 0 {
+			if max, ok := cgroupMemoryLimit(); ok {
+				limit, source = int64(float64(max)*c.MemoryLimitRatio), fmt.Sprintf("%g of the memory limit", c.MemoryLimitRatio)
+			}
+		}
+		if limit > 0 {
+			debug.SetMemoryLimit(limit)
+			log.Printf("Memory limit set to %d MiB from %s.", limit>>20, source)
+		}
+	}
+	if os.Getenv("GOGC") == "" && c.GCPercent != 0 {
+		debug.SetGCPercent(c.GCPercent)
+	}
+}
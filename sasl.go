@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/ldap.v3"
+)
+
+var errUnknownSaslSession = errors.New("unknown or expired SASL session")
+
+// saslUnavailable is returned by saslRequest when the directory couldn't be
+// reached, to be answered as a temporary failure.
+type saslUnavailable struct {
+	err error
+}
+
+func (e saslUnavailable) Error() string {
+	return e.err.Error()
+}
+
+// saslExchange carries one step between the API, which speaks SASL, and the
+// auth_http handler, which checks the user. For SCRAM-SHA-256 first is set
+// on the first step and session on the second, for NTLM ntlm on the second;
+// the first NTLM step doesn't reach the handler.
+type saslExchange struct {
+	// mechanism is the Auth-Method of the step.
+	mechanism string
+	msg       []byte
+
+	first   *scramClientFirst
+	session *scramSession
+	ntlm    *ntlmSession
+
+	id        string
+	challenge string
+	done      bool
+}
+
+type saslKey struct{}
+
+func requestSasl(r *http.Request) *saslExchange {
+	x, _ := r.Context().Value(saslKey{}).(*saslExchange)
+	return x
+}
+
+// saslRequest turns one step of an exchange into the auth_http request for
+// the handler. The first step starts a session, the second one names it.
+// The request is nil when the step was answered without the handler.
+func saslRequest(r *http.Request, mechanism, session string, msg []byte, protocol, clientIp string) (*http.Request, *saslExchange, error) {
+	x := &saslExchange{msg: msg}
+	var user string
+	var err error
+	switch {
+	case strings.EqualFold(mechanism, saslScramSha256):
+		x.mechanism = authMethodScram
+		user, err = x.scramStep(session, msg)
+	case strings.EqualFold(mechanism, saslNtlm) && currentConfig().NTLM.Enabled:
+		x.mechanism = authMethodNtlm
+		user, err = x.ntlmStep(r, session, msg)
+	default:
+		return nil, nil, fmt.Errorf("unsupported SASL mechanism %q", mechanism)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == "" {
+		return nil, x, nil
+	}
+	ar := authHttpRequest(r, user, base64.StdEncoding.EncodeToString(msg), protocol, clientIp)
+	ar.Header.Set(AuthMethod, x.mechanism)
+	return ar.WithContext(context.WithValue(ar.Context(), saslKey{}, x)), x, nil
+}
+
+// release closes the directory connection that the second NTLM step took
+// out of the sessions. Callers defer it once saslRequest succeeded, as the
+// handler may reject the request before serveNtlm ever sees it.
+func (x *saslExchange) release() {
+	if x != nil && x.ntlm != nil {
+		x.ntlm.nc.Close()
+	}
+}
+
+// serveSasl runs the step of x for cred, returning the entry once the user
+// is authenticated, or nil after answering the request itself.
+func serveSasl(w http.ResponseWriter, r *http.Request, x *saslExchange, cred *LdapCredential, login string) *ldap.Entry {
+	if cred.ldapAddr == "" {
+		authFailed(w, r, codeBadRequest, "SASL exchanges require the X-Ldap-URL header.")
+		return nil
+	}
+	if x.mechanism == authMethodNtlm {
+		return serveNtlm(w, r, x, cred, login)
+	}
+	return serveScram(w, r, x, cred, login)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// SCRAM-SHA-256 (RFC 7677) lets API clients prove they know the password
+// without sending it. The directory holds the stored and server keys in the
+// RFC 5803 form "{SCRAM-SHA-256}<iterations>:<salt>$<StoredKey>:<ServerKey>",
+// read from ldap.scram_attribute with the service account.
+const (
+	saslScramSha256  = "SCRAM-SHA-256"
+	authMethodScram  = "scram-sha-256"
+	scramScheme      = "{SCRAM-SHA-256}"
+	scramSessionTTL  = time.Minute
+	scramFakeIterate = 4096
+)
+
+// scramSession is the state kept between the two steps of an exchange. The
+// steps must reach the same daemon.
+type scramSession struct {
+	key                           string
+	login                         string
+	gs2, clientFirst, serverFirst string
+	nonce                         string
+	storedKey, serverKey          []byte
+	entry                         *ldap.Entry
+	expires                       time.Time
+}
+
+var scramSessions = struct {
+	sync.Mutex
+	m map[string]*scramSession
+}{m: make(map[string]*scramSession)}
+
+// scramSecret derives the salts of users without SCRAM credentials, so
+// the first step doesn't tell whether a user exists.
+var scramSecret = make([]byte, 32)
+
+type scramClientFirst struct {
+	gs2, bare, user, nonce string
+}
+
+// parseScramClientFirst parses "n,,n=user,r=nonce". Channel binding isn't
+// supported as the daemon doesn't see the client's TLS connection.
+func parseScramClientFirst(msg string) (*scramClientFirst, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("malformed client-first message")
+	}
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, errors.New("channel binding is not supported")
+	default:
+		return nil, errors.New("malformed GS2 header")
+	}
+	first := &scramClientFirst{gs2: parts[0] + "," + parts[1] + ",", bare: parts[2]}
+	for _, attr := range strings.Split(parts[2], ",") {
+		switch {
+		case strings.HasPrefix(attr, "n="):
+			first.user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attr[2:])
+		case strings.HasPrefix(attr, "r="):
+			first.nonce = attr[2:]
+		case strings.HasPrefix(attr, "m="):
+			return nil, errors.New("unsupported mandatory extension")
+		}
+	}
+	if first.user == "" || first.nonce == "" {
+		return nil, errors.New("client-first message lacks the username or nonce")
+	}
+	return first, nil
+}
+
+// scramStep parses the message of a step, returning the user.
+func (x *saslExchange) scramStep(session string, msg []byte) (string, error) {
+	if session == "" {
+		first, err := parseScramClientFirst(string(msg))
+		if err != nil {
+			return "", err
+		}
+		x.first = first
+		return first.user, nil
+	}
+	scramSessions.Lock()
+	s, ok := scramSessions.m[session]
+	delete(scramSessions.m, session)
+	scramSessions.Unlock()
+	if !ok || time.Now().After(s.expires) {
+		return "", errUnknownSaslSession
+	}
+	x.session = s
+	return s.login, nil
+}
+
+// serveScram runs the step of x for cred. It returns the entry once the
+// client proved the password, or nil after answering the request itself.
+func serveScram(w http.ResponseWriter, r *http.Request, x *saslExchange, cred *LdapCredential, login string) *ldap.Entry {
+	if x.first != nil {
+		scramChallenge(w, r, x, cred, login)
+		return nil
+	}
+	s := x.session
+	failed := &cred.ldapConf().FailedLogins
+	err := errors.New("the session belongs to another user or directory")
+	if s.key == cacheKey(cred) {
+		err = s.verify(x, string(x.msg))
+	}
+	if err != nil {
+		if s.entry != nil && err == errInvalidPassword {
+			failed.failed(cred, s.entry)
+		}
+		authFailed(w, r, codeBadPassword, fmt.Sprintf("SCRAM authentication of %s failed: %v", login, err))
+		return nil
+	}
+	failed.succeeded(cred, s.entry)
+	return authorizedEntry(cred, s.entry)
+}
+
+// scramChallenge looks the user up and answers the server-first message.
+func scramChallenge(w http.ResponseWriter, r *http.Request, x *saslExchange, cred *LdapCredential, login string) {
+	entry, err := findEntry(cred, append(searchAttrs(cred), cred.ldapConf().ScramAttribute))
+	if err != nil {
+		tempFailed(w, r, failureCode(err), fmt.Sprintf("Unable to read the SCRAM credentials of %s: %v", login, err))
+		return
+	}
+	if entry != nil {
+		if err := cred.ldapConf().FailedLogins.check(entry); err != nil {
+			authFailed(w, r, codeLocked, fmt.Sprintf("User %s has too many failed logins in the directory", login))
+			return
+		}
+	}
+	s := &scramSession{key: cacheKey(cred), login: r.Header.Get(AuthUser), gs2: x.first.gs2, clientFirst: x.first.bare, expires: time.Now().Add(scramSessionTTL)}
+	var salt []byte
+	iterations := 0
+	if entry != nil {
+		for _, v := range entry.GetAttributeValues(cred.ldapConf().ScramAttribute) {
+			if iterations, salt, s.storedKey, s.serverKey, err = parseScramStored(v); err == nil {
+				s.entry = entry
+				break
+			}
+		}
+	}
+	if s.entry == nil {
+		if cred.debug {
+			logDebug(cred, "No SCRAM-SHA-256 credentials for %s, answering with a decoy", login)
+		}
+		mac := hmac.New(sha256.New, scramSecret)
+		mac.Write([]byte(s.key))
+		salt, iterations = mac.Sum(nil)[:16], scramFakeIterate
+	}
+	nonce := make([]byte, 18)
+	id := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		tempFailed(w, r, codeTemporary, err.Error())
+		return
+	}
+	rand.Read(id)
+	s.nonce = x.first.nonce + base64.RawStdEncoding.EncodeToString(nonce)
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(iterations)
+
+	x.id, x.challenge = hex.EncodeToString(id), s.serverFirst
+	now := time.Now()
+	scramSessions.Lock()
+	for k, old := range scramSessions.m {
+		if now.After(old.expires) {
+			delete(scramSessions.m, k)
+		}
+	}
+	scramSessions.m[x.id] = s
+	scramSessions.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseScramStored parses an RFC 5803 value.
+func parseScramStored(v string) (iterations int, salt, storedKey, serverKey []byte, err error) {
+	if len(v) < len(scramScheme) || !strings.EqualFold(v[:len(scramScheme)], scramScheme) {
+		return 0, nil, nil, nil, errors.New("not a SCRAM-SHA-256 value")
+	}
+	v = v[len(scramScheme):]
+	i, j := strings.IndexByte(v, ':'), strings.IndexByte(v, '$')
+	k := strings.LastIndexByte(v, ':')
+	if i < 0 || j < i || k < j {
+		return 0, nil, nil, nil, errors.New("malformed SCRAM-SHA-256 value")
+	}
+	if iterations, err = strconv.Atoi(v[:i]); err != nil || iterations <= 0 {
+		return 0, nil, nil, nil, errors.New("malformed SCRAM-SHA-256 iteration count")
+	}
+	if salt, err = base64.StdEncoding.DecodeString(v[i+1 : j]); err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if storedKey, err = base64.StdEncoding.DecodeString(v[j+1 : k]); err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if serverKey, err = base64.StdEncoding.DecodeString(v[k+1:]); err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if len(storedKey) != sha256.Size || len(serverKey) != sha256.Size {
+		return 0, nil, nil, nil, errors.New("SCRAM-SHA-256 keys must be 32 bytes")
+	}
+	return iterations, salt, storedKey, serverKey, nil
+}
+
+var errMalformedScram = errors.New("malformed client-final message")
+
+// verify checks the proof of the client-final message
+// "c=<gs2>,r=<nonce>,p=<proof>" and sets the server-final message.
+func (s *scramSession) verify(x *saslExchange, msg string) error {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return errMalformedScram
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return errMalformedScram
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(s.gs2)) || attrs[1] != "r="+s.nonce {
+		return errors.New("channel binding or nonce mismatch")
+	}
+	if s.entry == nil {
+		return errInvalidPassword
+	}
+	authMessage := []byte(s.clientFirst + "," + s.serverFirst + "," + withoutProof)
+	clientKey := hmacSha256(s.storedKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i] // ClientSignature XOR ClientProof
+	}
+	stored := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(stored[:], s.storedKey) != 1 {
+		return errInvalidPassword
+	}
+	x.challenge = "v=" + base64.StdEncoding.EncodeToString(hmacSha256(s.serverKey, authMessage))
+	x.done = true
+	return nil
+}
+
+func hmacSha256(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func init() {
+	if _, err := rand.Read(scramSecret); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v3"
+)
+
+// LdapConfig controls how users are looked up in the directory.
+type LdapConfig struct {
+	// UserAttributes are matched against the local part of the login.
+	UserAttributes []string `yaml:"user_attributes"`
+	// EmailAttributes are matched against the full user@domain login.
+	EmailAttributes []string `yaml:"email_attributes"`
+	// ObjectClass restricts the search to entries of this class, empty
+	// matches any class.
+	ObjectClass  string `yaml:"object_class"`
+	Scope        string `yaml:"scope"`
+	DerefAliases string `yaml:"deref_aliases"`
+	// Filter replaces the filter built from the attributes above, e.g.
+	// "(&(objectClass=inetOrgPerson)(mail={email}))".
+	Filter string `yaml:"filter"`
+	// BindDnTemplate skips the search and binds directly as e.g.
+	// "uid={user},ou=people,dc=example,dc=com".
+	BindDnTemplate string `yaml:"bind_dn_template"`
+	// PasswordCheck is bind (default), compare or local.
+	PasswordCheck string `yaml:"password_check"`
+	// ScramAttribute holds the {SCRAM-SHA-256} credentials of users for
+	// SCRAM on the API, userPassword by default.
+	ScramAttribute string `yaml:"scram_attribute"`
+
+	TLS       LdapTLSConfig               `yaml:"tls"`
+	Servers   map[string]LdapServerConfig `yaml:"servers"`
+	LastLogin LastLoginConfig             `yaml:"last_login"`
+	// FailedLogins shares lockouts through the directory.
+	FailedLogins FailedLoginsConfig `yaml:"failed_logins"`
+	// DirectoryLockout is how long no binds are sent for users the
+	// directory reported as locked out.
+	DirectoryLockout time.Duration `yaml:"directory_lockout"`
+	// DNS caches the addresses of the servers.
+	DNS  DNSConfig  `yaml:"dns"`
+	Dial DialConfig `yaml:"dial"`
+	// UnlockAttributes are reset by /admin/unlock: "attr" is deleted and
+	// "attr=value" replaced, e.g. pwdAccountLockedTime for ppolicy or
+	// lockoutTime=0 for Active Directory.
+	UnlockAttributes []string `yaml:"unlock_attributes"`
+
+	// Domains override the service accounts per login domain.
+	Domains map[string]LdapDomainConfig `yaml:"domains"`
+
+	ServicePool PoolConfig `yaml:"service_pool"`
+	UserPool    PoolConfig `yaml:"user_pool"`
+}
+
+var (
+	ldapScopes = map[string]int{
+		"base": ldap.ScopeBaseObject,
+		"one":  ldap.ScopeSingleLevel,
+		"sub":  ldap.ScopeWholeSubtree,
+	}
+	ldapDerefAliases = map[string]int{
+		"never":     ldap.NeverDerefAliases,
+		"searching": ldap.DerefInSearching,
+		"finding":   ldap.DerefFindingBaseObj,
+		"always":    ldap.DerefAlways,
+	}
+)
+
+func (c *LdapConfig) validate() error {
+	if _, ok := ldapScopes[c.Scope]; !ok {
+		return fmt.Errorf("ldap.scope must be base, one or sub, got %q", c.Scope)
+	}
+	if _, ok := ldapDerefAliases[c.DerefAliases]; !ok {
+		return fmt.Errorf("ldap.deref_aliases must be never, searching, finding or always, got %q", c.DerefAliases)
+	}
+	if err := checkPasswordCheck(c.PasswordCheck); err != nil {
+		return err
+	}
+	if err := c.ServicePool.validate("service_pool"); err != nil {
+		return err
+	}
+	if err := c.UserPool.validate("user_pool"); err != nil {
+		return err
+	}
+	if err := c.Dial.validate(); err != nil {
+		return err
+	}
+	for addr, s := range c.Servers {
+		if err := checkProxy("ldap.servers."+addr+".proxy", s.Proxy); err != nil {
+			return err
+		}
+	}
+	if err := c.validateDomains(); err != nil {
+		return err
+	}
+	if err := c.FailedLogins.validate(); err != nil {
+		return err
+	}
+	if err := checkPlaceholders("ldap.filter", c.Filter); err != nil {
+		return err
+	}
+	return checkPlaceholders("ldap.bind_dn_template", c.BindDnTemplate)
+}
+
+// usesClientIp reports whether the lookup of a user depends on the address
+// of the client.
+func (c *LdapConfig) usesClientIp() bool {
+	return strings.Contains(c.Filter, "{client_ip}") || strings.Contains(c.BindDnTemplate, "{client_ip}")
+}
+
+func (c *LdapConfig) userSearch(baseDn string, cred *LdapCredential, attrs []string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(
+		baseDn,
+		ldapScopes[c.Scope],
+		ldapDerefAliases[c.DerefAliases],
+		0,
+		0,
+		false,
+		c.userFilter(cred),
+		attrs,
+		nil,
+	)
+}
+
+func (c *LdapConfig) userFilter(cred *LdapCredential) string {
+	if c.Filter != "" {
+		return expandPlaceholders(c.Filter, cred, ldap.EscapeFilter)
+	}
+	var b strings.Builder
+	b.WriteString("(&")
+	if c.ObjectClass != "" {
+		b.WriteString("(objectClass=" + ldap.EscapeFilter(c.ObjectClass) + ")")
+	}
+	b.WriteString("(|")
+	for _, a := range c.UserAttributes {
+		b.WriteString("(" + a + "=" + ldap.EscapeFilter(cred.usr) + ")")
+	}
+	for _, a := range c.EmailAttributes {
+		b.WriteString("(" + a + "=" + ldap.EscapeFilter(cred.usr+"@"+cred.domain) + ")")
+	}
+	b.WriteString("))")
+	return b.String()
+}
+
+// findEntry reads the attrs of the user entry with the service account,
+// without checking a password. It returns nil when the user doesn't exist.
+func findEntry(cred *LdapCredential, attrs []string) (*ldap.Entry, error) {
+	conf := cred.ldapConf()
+	sreq := conf.userSearch(cred.baseDn, cred, attrs)
+	if conf.BindDnTemplate != "" {
+		dn := expandPlaceholders(conf.BindDnTemplate, cred, escapeDN)
+		sreq = ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", attrs, nil)
+	}
+	var sresp *ldap.SearchResult
+	err := servicePool(cred).doUntil(cred.deadline, func(l *pooledConn) (err error) {
+		sresp, err = l.Search(sreq)
+		return err
+	})
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sresp.Entries) != 1 {
+		return nil, nil
+	}
+	return sresp.Entries[0], nil
+}
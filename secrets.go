@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v2"
+)
+
+var ageIdentity = flag.String("age-identity", os.Getenv("SOPS_AGE_KEY_FILE"), "age identity file decrypting age: values in the configuration.")
+
+// ageValueRe matches a config value encrypted for -age-identity, written as
+// "age:" and the base64 of the binary age file, e.g. from
+// `age -r age1... | base64 -w0`.
+var ageValueRe = regexp.MustCompile(`\bage:[A-Za-z0-9+/]+=*`)
+
+// decryptConfig returns the plain text of a config file. Files encrypted with
+// SOPS, recognized by their top-level sops key, are passed through
+// `sops --decrypt`. Inline age: values are then replaced by their quoted
+// plain text on the same line, so error line numbers stay accurate.
+func decryptConfig(path string, b []byte) ([]byte, error) {
+	var meta struct {
+		Sops interface{} `yaml:"sops"`
+	}
+	if yaml.Unmarshal(b, &meta) == nil && meta.Sops != nil {
+		out, err := exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", path).Output()
+		if err != nil {
+			if ee, ok := err.(*exec.ExitError); ok {
+				return nil, fmt.Errorf("sops: %v: %s", err, bytes.TrimSpace(ee.Stderr))
+			}
+			return nil, fmt.Errorf("sops: %v", err)
+		}
+		b = out
+	}
+	if !ageValueRe.Match(b) {
+		return b, nil
+	}
+	ids, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var failed error
+	b = ageValueRe.ReplaceAllFunc(b, func(v []byte) []byte {
+		plain, err := decryptAge(ids, v[len("age:"):])
+		if err != nil {
+			failed = err
+			return v
+		}
+		q, _ := json.Marshal(string(plain))
+		return q
+	})
+	return b, failed
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	if *ageIdentity == "" {
+		return nil, fmt.Errorf("config has age: values but no -age-identity")
+	}
+	f, err := os.Open(*ageIdentity)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
+
+func decryptAge(ids []age.Identity, enc []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(string(enc))
+	if err != nil {
+		return nil, fmt.Errorf("age value: %v", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(raw), ids...)
+	if err != nil {
+		return nil, fmt.Errorf("age value: %v", err)
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionsConfig caps how often and from how many addresses one user may
+// log in within Window, catching hijacked accounts used from many places at
+// once. A zero maximum disables that limit.
+type SessionsConfig struct {
+	MaxLogins int           `yaml:"max_logins"`
+	MaxIPs    int           `yaml:"max_ips"`
+	Window    time.Duration `yaml:"window"`
+	// Exempt users, e.g. shared mailboxes polled by many clients.
+	Exempt []string `yaml:"exempt"`
+}
+
+type sessionLogin struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip,omitempty"`
+}
+
+// sessionTracker remembers the recent successful logins of each user.
+type sessionTracker struct {
+	mu     sync.Mutex
+	logins map[string][]sessionLogin
+	exempt map[string]time.Time
+}
+
+var sessions = &sessionTracker{
+	logins: make(map[string][]sessionLogin),
+	exempt: make(map[string]time.Time),
+}
+
+func (c *SessionsConfig) enabled() bool {
+	return c.MaxLogins > 0 || c.MaxIPs > 0
+}
+
+// admit records a login of user from ip unless it would exceed the limits,
+// across all instances when they share a store.
+func (t *sessionTracker) admit(c *SessionsConfig, user, ip string) error {
+	if !c.enabled() || contains(c.Exempt, user) {
+		return nil
+	}
+	t.mu.Lock()
+	exempt := time.Now().Before(t.exempt[user])
+	t.mu.Unlock()
+	if exempt {
+		return nil
+	}
+	// t.mu is not held across the round trips to the store.
+	ok, err := admitShared(c, user, ip)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	recent := t.prune(user, now, c.Window)
+	if !ok {
+		err = admitLocal(c, user, ip, recent)
+	}
+	if err != nil {
+		return err
+	}
+	t.logins[user] = append(recent, sessionLogin{Time: now, ClientIP: ip})
+	return nil
+}
+
+func admitLocal(c *SessionsConfig, user, ip string, recent []sessionLogin) error {
+	if c.MaxLogins > 0 && len(recent) >= c.MaxLogins {
+		return fmt.Errorf("%s logged in %d times within %v", user, len(recent), c.Window)
+	}
+	if c.MaxIPs > 0 && ip != "" {
+		ips := map[string]bool{ip: true}
+		for _, l := range recent {
+			if l.ClientIP != "" {
+				ips[l.ClientIP] = true
+			}
+		}
+		if len(ips) > c.MaxIPs {
+			return fmt.Errorf("%s logged in from %d addresses within %v", user, len(ips), c.Window)
+		}
+	}
+	return nil
+}
+
+// admitShared applies the limits with the counters of the shared store. It
+// reports false without a store or while it fails, leaving the decision to
+// this instance. The store counts refused logins too, in windows fixed from
+// the first login rather than sliding ones.
+func admitShared(c *SessionsConfig, user, ip string) (bool, error) {
+	if shared == nil {
+		return false, nil
+	}
+	exempt, err := shared.exists("session-exempt:" + user)
+	if !storeOk(err) {
+		return false, nil
+	}
+	if exempt {
+		return true, nil
+	}
+	if c.MaxLogins > 0 {
+		n, err := shared.incr("session-logins:"+user, c.Window)
+		if !storeOk(err) {
+			return false, nil
+		}
+		if n > int64(c.MaxLogins) {
+			return true, fmt.Errorf("%s logged in %d times within %v", user, c.MaxLogins, c.Window)
+		}
+	}
+	if c.MaxIPs > 0 && ip != "" {
+		key := "session-ip:" + user + "\x00" + ip
+		fresh, err := shared.add(key, c.Window)
+		if !storeOk(err) {
+			return false, nil
+		}
+		if !fresh {
+			return true, nil
+		}
+		n, err := shared.incr("session-ips:"+user, c.Window)
+		if !storeOk(err) {
+			return false, nil
+		}
+		if n > int64(c.MaxIPs) {
+			// Forget the address, so that it is refused again next time.
+			_, err := shared.del(key)
+			storeOk(err)
+			return true, fmt.Errorf("%s logged in from more than %d addresses within %v", user, c.MaxIPs, c.Window)
+		}
+	}
+	return true, nil
+}
+
+// prune drops logins older than window, t.mu must be held.
+func (t *sessionTracker) prune(user string, now time.Time, window time.Duration) []sessionLogin {
+	recent := t.logins[user]
+	i := 0
+	for i < len(recent) && now.Sub(recent[i].Time) > window {
+		i++
+	}
+	recent = recent[i:]
+	if len(recent) == 0 {
+		delete(t.logins, user)
+	}
+	return recent
+}
+
+func (t *sessionTracker) snapshot(window time.Duration) map[string][]sessionLogin {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	m := make(map[string][]sessionLogin, len(t.logins))
+	for user := range t.logins {
+		if recent := t.prune(user, now, window); len(recent) > 0 {
+			m[user] = append([]sessionLogin(nil), recent...)
+		}
+	}
+	return m
+}
+
+// handleSessions serves the session tracker. GET lists recent logins,
+// DELETE with a user query parameter forgets them, and POST with user and an
+// optional duration (default 1h) exempts the user from the limits.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	user := currentConfig().Normalize.username(r.URL.Query().Get("user"))
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions.snapshot(currentConfig().Sessions.Window))
+	case http.MethodDelete:
+		sessions.mu.Lock()
+		_, found := sessions.logins[user]
+		delete(sessions.logins, user)
+		delete(sessions.exempt, user)
+		sessions.mu.Unlock()
+		if shared != nil {
+			deleted, err := shared.del("session-logins:"+user, "session-ips:"+user, "session-exempt:"+user)
+			found = storeOk(err) && deleted || found
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		d := time.Hour
+		if v := r.URL.Query().Get("duration"); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if user == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+		sessions.mu.Lock()
+		sessions.exempt[user] = time.Now().Add(d)
+		sessions.mu.Unlock()
+		if shared != nil {
+			storeOk(shared.set("session-exempt:"+user, d))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
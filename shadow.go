@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ShadowConfig authenticates a sample of requests a second time against a
+// candidate configuration, such as a new directory server or filter, and
+// reports where its decision differs. The shadow never affects responses.
+type ShadowConfig struct {
+	// Backends are the candidate backends, empty uses those of the request
+	// headers like the main chain does without backends.
+	Backends []BackendConfig `yaml:"backends"`
+	// Ldap replaces the ldap section for the shadow when set. Fields left
+	// out take the built-in defaults, not those of the main ldap section.
+	Ldap *LdapConfig `yaml:"ldap"`
+	// SampleRate is the fraction of requests shadowed, 0 disables shadowing.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	chain []chainLink
+}
+
+var shadowComparisons = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "httpauth2ldap_shadow_comparisons_total",
+	Help: "Shadow authentications by outcome: match, mismatch, error or skipped.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(shadowComparisons)
+}
+
+// UnmarshalYAML starts a shadow ldap section from the defaults.
+func (c *ShadowConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ShadowConfig
+	p := plain(*c)
+	if err := defaultLdapSection(unmarshal, &p.Ldap); err != nil {
+		return err
+	}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	*c = ShadowConfig(p)
+	return nil
+}
+
+// defaultLdapSection points *l at the default ldap settings if the section
+// being unmarshalled has an ldap key and *l is still unset.
+func defaultLdapSection(unmarshal func(interface{}) error, l **LdapConfig) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if _, ok := raw["ldap"]; ok && *l == nil {
+		d := defaultConfig().Ldap
+		*l = &d
+	}
+	return nil
+}
+
+func (c *ShadowConfig) compile() error {
+	if c.SampleRate <= 0 {
+		return nil
+	}
+	if c.Ldap != nil {
+		if err := c.Ldap.validate(); err != nil {
+			return err
+		}
+	}
+	var err error
+	c.chain, err = newChain(c.Backends)
+	return err
+}
+
+// compare authenticates cred against the shadow configuration in the
+// background and reports whether it agrees with the primary decision. A
+// failed login is not shadowed on a directory of the primary chain, whose
+// password policy would count the failure against the user a second time.
+func (c *ShadowConfig) compare(cred *LdapCredential, primaryOK bool) {
+	if c.SampleRate <= 0 || c.chain == nil || rand.Float64() >= c.SampleRate {
+		return
+	}
+	if !primaryOK && c.bindsPrimary(cred) {
+		shadowComparisons.WithLabelValues("skipped").Inc()
+		return
+	}
+	shadow := *cred
+	shadow.ldap, shadow.chain, shadow.timings, shadow.debug = c.Ldap, nil, nil, false
+	shadow.shadow = true
+	go func() {
+		entry, err := runChain(c.chain, &shadow)
+		switch {
+		case entry == nil && err != errUserNotFound && !definitiveFailure(err):
+			shadowComparisons.WithLabelValues("error").Inc()
+			log.Printf("Shadow authentication of %s@%s failed: %v", shadow.usr, shadow.domain, err)
+		case (entry != nil) != primaryOK:
+			shadowComparisons.WithLabelValues("mismatch").Inc()
+			log.Printf("Shadow mismatch for %s@%s: primary ok=%v, shadow ok=%v (%v)", shadow.usr, shadow.domain, primaryOK, entry != nil, err)
+		default:
+			shadowComparisons.WithLabelValues("match").Inc()
+		}
+	}()
+}
+
+// bindsPrimary reports whether the shadow chain reaches a directory that the
+// primary chain authenticated cred against.
+func (c *ShadowConfig) bindsPrimary(cred *LdapCredential) bool {
+	primary := []string{cred.ldapAddr}
+	for _, b := range currentConfig().Backends {
+		if b.Type == "ldap" {
+			primary = append(primary, b.URL)
+		}
+	}
+	for _, l := range c.chain {
+		switch b := l.backend.(type) {
+		case requestBackend:
+			return true
+		case *ldapBackend:
+			if contains(primary, b.conf.URL) {
+				return true
+			}
+		}
+	}
+	return false
+}
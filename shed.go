@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxInflight = flag.Int("max-inflight", 0, "maximum concurrent LDAP authentications before requests are answered with a temporary failure, 0 means unlimited.")
+	shedLatency = flag.Duration("shed-latency", 0, "average LDAP latency above which new requests are answered with a temporary failure, 0 disables.")
+	retryWait   = flag.Int("retry-wait", 3, "seconds nginx is asked to wait (Auth-Wait) before retrying after a temporary failure.")
+)
+
+// loadShedder rejects work up front when the directory is overloaded rather
+// than letting requests queue until nginx runs out of connections.
+type loadShedder struct {
+	inflight int64
+	latency  int64 // moving average of LDAP latency in nanoseconds
+}
+
+var shedder loadShedder
+
+// acquire reports whether a new LDAP authentication may start; if so the
+// caller must call release when it finishes.
+func (s *loadShedder) acquire() bool {
+	n := atomic.AddInt64(&s.inflight, 1)
+	if *maxInflight > 0 && n > int64(*maxInflight) {
+		atomic.AddInt64(&s.inflight, -1)
+		return false
+	}
+	// Keep letting one request through so the latency average can recover.
+	if *shedLatency > 0 && n > 1 && time.Duration(atomic.LoadInt64(&s.latency)) > *shedLatency {
+		atomic.AddInt64(&s.inflight, -1)
+		return false
+	}
+	return true
+}
+
+func (s *loadShedder) release(d time.Duration) {
+	atomic.AddInt64(&s.inflight, -1)
+	for {
+		old := atomic.LoadInt64(&s.latency)
+		avg := old + (int64(d)-old)/8
+		if atomic.CompareAndSwapInt64(&s.latency, old, avg) {
+			return
+		}
+	}
+}
+
+// tempFailed tells nginx to retry later instead of treating the login as
+// invalid credentials.
+func tempFailed(w http.ResponseWriter, r *http.Request, code errCode, err string) {
+	log.Printf("Temporarily failed authentication (%s)%s due to: %s", code, traceFields(r), err)
+	recordOutcome(requestEvent(r, auditTempFail, code))
+	noteOutcome(r, code, nil, nil)
+	status := currentConfig().Messages.failureMessage(r, reasonTemporaryFailure)
+	if *errorDetail == "detailed" {
+		status = err
+	}
+	w.Header().Set(AuthStatus, statusWithCode(status, code))
+	w.Header().Set(AuthWait, fmt.Sprint(*retryWait))
+	if r.Header.Get(AuthProtocol) == "smtp" {
+		w.Header().Set(AuthErrorCode, "451 4.3.0")
+	}
+	w.WriteHeader(http.StatusOK)
+}
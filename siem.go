@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Stable ArcSight CEF and QRadar LEEF renderings of audit events, so SIEMs
+// can map fields without parsing free-form log lines.
+
+const siemVendor, siemProduct, siemVersion = "httpauth2ldap", "httpauth2ldap", "1.0"
+
+var siemEventIDs = map[string]string{
+	auditSuccess:  "100",
+	auditFailure:  "200",
+	auditTempFail: "300",
+}
+
+var cefSeverities = map[string]int{
+	auditSuccess:  1,
+	auditFailure:  5,
+	auditTempFail: 3,
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+func formatCEF(ev auditEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(siemVendor),
+		cefHeaderEscaper.Replace(siemProduct),
+		siemVersion,
+		siemEventIDs[ev.Result],
+		cefHeaderEscaper.Replace("Authentication "+ev.Result),
+		cefSeverities[ev.Result])
+	ext := [][2]string{
+		{"rt", fmt.Sprint(ev.Time.UnixNano() / 1e6)},
+		{"outcome", ev.Result},
+		{"reason", ev.Reason},
+		{"cs4Label", "code"},
+		{"cs4", ev.Code},
+		{"suser", ev.User},
+		{"src", ev.ClientIP},
+		{"app", ev.Protocol},
+		{"cs1Label", "domain"},
+		{"cs1", ev.Domain},
+		{"cs2Label", "authMethod"},
+		{"cs2", ev.Method},
+	}
+	ext = append(ext, attributeExtensions(ev)...)
+	var parts []string
+	for _, kv := range ext {
+		if kv[1] != "" {
+			parts = append(parts, kv[0]+"="+cefValueEscaper.Replace(kv[1]))
+		}
+	}
+	b.WriteString(strings.Join(parts, " "))
+	return b.String()
+}
+
+func formatLEEF(ev auditEvent) string {
+	ext := [][2]string{
+		{"devTime", ev.Time.Format("Jan 02 2006 15:04:05.000 MST")},
+		{"cat", "authentication"},
+		{"outcome", ev.Result},
+		{"reason", ev.Reason},
+		{"code", ev.Code},
+		{"usrName", ev.User},
+		{"domain", ev.Domain},
+		{"src", ev.ClientIP},
+		{"proto", ev.Protocol},
+		{"authMethod", ev.Method},
+	}
+	ext = append(ext, attributeExtensions(ev)...)
+	var parts []string
+	for _, kv := range ext {
+		if kv[1] != "" {
+			parts = append(parts, kv[0]+"="+leefValueEscaper.Replace(kv[1]))
+		}
+	}
+	return fmt.Sprintf("LEEF:1.0|%s|%s|%s|%s|%s", siemVendor, siemProduct, siemVersion, siemEventIDs[ev.Result], strings.Join(parts, "\t"))
+}
+
+// attributeExtensions renders the entry attributes of ev as extension keys
+// named after them, sorted, with multiple values joined by commas.
+func attributeExtensions(ev auditEvent) [][2]string {
+	names := make([]string, 0, len(ev.Attributes))
+	for name := range ev.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ext := make([][2]string, len(names))
+	for i, name := range names {
+		ext[i] = [2]string{name, strings.Join(ev.Attributes[name], ",")}
+	}
+	return ext
+}
+
+func formatAuditEvent(format string, ev auditEvent) ([]byte, error) {
+	switch format {
+	case "cef":
+		return []byte(formatCEF(ev)), nil
+	case "leef":
+		return []byte(formatLEEF(ev)), nil
+	}
+	return json.Marshal(ev)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/ldap.v3"
+)
+
+// SmtpConfig checks the SMTP envelope nginx passes in the Auth-SMTP-*
+// headers, making the daemon a small submission policy service.
+type SmtpConfig struct {
+	// RecipientDomains, when set, are the only (lowercase) domains mail may
+	// be sent to.
+	RecipientDomains []string `yaml:"recipient_domains"`
+	// MaxRecipients limits the RCPT TO addresses per message, 0 is no limit.
+	MaxRecipients int `yaml:"max_recipients"`
+	// CheckHelo rejects HELO names that are empty, unqualified, localhost or
+	// bare IP addresses outside of brackets.
+	CheckHelo bool `yaml:"check_helo"`
+	// EnforceSender requires MAIL FROM to be the login or one of the
+	// addresses in SenderAttributes of the user's entry.
+	EnforceSender    bool     `yaml:"enforce_sender"`
+	SenderAttributes []string `yaml:"sender_attributes"`
+	// RejectCode is sent as Auth-Error-Code when the envelope is refused.
+	RejectCode string `yaml:"reject_code"`
+
+	Relay RelayConfig `yaml:"relay"`
+	Dnsbl DnsblConfig `yaml:"dnsbl"`
+}
+
+// envelopeAddress extracts the address from a raw "MAIL FROM:<a@b> SIZE=1"
+// or "RCPT TO:<a@b>" command, or returns the value unchanged.
+func envelopeAddress(v string) string {
+	v = strings.TrimSpace(v)
+	if i := strings.IndexByte(v, ':'); i >= 0 && strings.IndexByte(v[:i], '@') < 0 {
+		v = strings.TrimSpace(v[i+1:])
+	}
+	if strings.HasPrefix(v, "<") {
+		if i := strings.IndexByte(v, '>'); i > 0 {
+			return v[1:i]
+		}
+	}
+	if i := strings.IndexByte(v, ' '); i >= 0 {
+		v = v[:i]
+	}
+	return v
+}
+
+func smtpRecipients(r *http.Request) []string {
+	var rcpts []string
+	for _, v := range r.Header.Values(AuthSMTPTo) {
+		for _, a := range strings.Split(v, ",") {
+			if a = envelopeAddress(a); a != "" {
+				rcpts = append(rcpts, a)
+			}
+		}
+	}
+	return rcpts
+}
+
+func saneHelo(helo string) bool {
+	helo = strings.TrimSpace(helo)
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		return net.ParseIP(strings.TrimPrefix(helo[1:len(helo)-1], "IPv6:")) != nil
+	}
+	if net.ParseIP(helo) != nil || strings.EqualFold(helo, "localhost") || strings.HasPrefix(strings.ToLower(helo), "localhost.") {
+		return false
+	}
+	return strings.Contains(helo, ".")
+}
+
+// check returns why the envelope of an smtp request is refused, if it is.
+func (c *SmtpConfig) check(r *http.Request) error {
+	if r.Header.Get(AuthProtocol) != "smtp" {
+		return nil
+	}
+	if c.CheckHelo && !saneHelo(r.Header.Get(AuthSMTPHelo)) {
+		return fmt.Errorf("bad HELO %q", r.Header.Get(AuthSMTPHelo))
+	}
+	rcpts := smtpRecipients(r)
+	if c.MaxRecipients > 0 && len(rcpts) > c.MaxRecipients {
+		return fmt.Errorf("%d recipients exceed the limit of %d", len(rcpts), c.MaxRecipients)
+	}
+	if len(c.RecipientDomains) > 0 {
+		for _, rcpt := range rcpts {
+			at := strings.LastIndexByte(rcpt, '@')
+			if at < 0 || !contains(c.RecipientDomains, strings.ToLower(rcpt[at+1:])) {
+				return fmt.Errorf("recipient %s is not in an allowed domain", rcpt)
+			}
+		}
+	}
+	return nil
+}
+
+// attributes returns the entry attributes the sender check needs fetched.
+func (c *SmtpConfig) attributes() []string {
+	if !c.EnforceSender {
+		return nil
+	}
+	return c.SenderAttributes
+}
+
+// checkSender refuses a MAIL FROM that isn't one of the user's addresses. The
+// null sender is allowed.
+func (c *SmtpConfig) checkSender(r *http.Request, cred *LdapCredential, entry *ldap.Entry) error {
+	if !c.EnforceSender || r.Header.Get(AuthProtocol) != "smtp" {
+		return nil
+	}
+	from := envelopeAddress(r.Header.Get(AuthSMTPFrom))
+	if from == "" || strings.EqualFold(from, cred.usr+"@"+cred.domain) {
+		return nil
+	}
+	for _, a := range c.SenderAttributes {
+		for _, v := range entry.GetAttributeValues(a) {
+			if strings.EqualFold(from, v) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s@%s may not send as %s", cred.usr, cred.domain, from)
+}
+
+// envelopeRejected refuses the message with the SMTP reply code nginx
+// forwards to the client.
+func envelopeRejected(w http.ResponseWriter, r *http.Request, err string) {
+	w.Header().Set(AuthErrorCode, currentConfig().SMTP.RejectCode)
+	authFailed(w, r, codeEnvelopeRejected, err)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "gopkg.in/ldap.v3"
+
+// staticBackend authenticates users listed with hashed passwords in the
+// configuration, for monitoring probes and appliances that shouldn't exist
+// in LDAP. Hashes use the userPassword schemes, e.g. {SSHA} or bcrypt.
+type staticBackend struct {
+	conf *BackendConfig
+}
+
+func (b *staticBackend) name() string { return b.conf.Name }
+
+func (b *staticBackend) authenticate(cred *LdapCredential) (*ldap.Entry, error) {
+	hashed, ok := b.conf.Domains[cred.domain][cred.usr]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	if !checkHashedPassword(hashed, cred.pwd) {
+		return nil, errInvalidPassword
+	}
+	return &ldap.Entry{DN: cred.usr + "@" + cred.domain}, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsConfig optionally persists per-user login statistics across restarts.
+type StatsConfig struct {
+	File         string        `yaml:"file"`
+	SaveInterval time.Duration `yaml:"save_interval"`
+}
+
+type userStats struct {
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastIP      string    `json:"last_ip,omitempty"`
+	Successes   uint64    `json:"successes"`
+	Failures    uint64    `json:"failures"`
+}
+
+// loginStats answers "when did this mailbox last authenticate?".
+type loginStats struct {
+	mu    sync.Mutex
+	users map[string]*userStats
+}
+
+var stats = &loginStats{users: make(map[string]*userStats)}
+
+// observe records a login. Only a success adds a user, so that failures
+// with made-up names can't grow the statistics and their file.
+func (s *loginStats) observe(ev auditEvent) {
+	if ev.User == "" || ev.Result == auditTempFail {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[ev.User]
+	if !ok {
+		if ev.Result != auditSuccess {
+			return
+		}
+		u = &userStats{}
+		s.users[ev.User] = u
+	}
+	if ev.Result == auditSuccess {
+		u.LastSuccess = ev.Time
+		u.LastIP = ev.ClientIP
+		u.Successes++
+	} else {
+		u.LastFailure = ev.Time
+		u.Failures++
+	}
+}
+
+func (s *loginStats) get(user string) (userStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[user]
+	if !ok {
+		return userStats{}, false
+	}
+	return *u, true
+}
+
+func (s *loginStats) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(b, &s.users)
+}
+
+func (s *loginStats) save(path string) error {
+	s.mu.Lock()
+	b, err := json.Marshal(s.users)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *loginStats) saveEvery(path string, d time.Duration) {
+	for range time.Tick(d) {
+		if err := s.save(path); err != nil {
+			log.Printf("Unable to save login statistics: %v", err)
+		}
+	}
+}
+
+// handleUserStats serves GET /admin/users/<user@domain>.
+func handleUserStats(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(r.URL.Path, "/admin/users/")
+	u, ok := stats.get(currentConfig().Normalize.username(user))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
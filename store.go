@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// StoreConfig shares the lockout counters, honeypot bans and session limits
+// between the instances behind one load balancer, so that an attacker
+// spreading guesses across them is counted once. Each instance still keeps
+// its own counters, which the admin API lists and which take over while the
+// store is unreachable.
+type StoreConfig struct {
+	Redis    RedisConfig    `yaml:"redis"`
+	Memcache MemcacheConfig `yaml:"memcache"`
+	// Prefix namespaces the keys, so that several fleets can share a store.
+	Prefix string `yaml:"prefix"`
+	// Timeout bounds each round trip to the store.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *StoreConfig) validate() error {
+	if c.Redis.Addr != "" && len(c.Memcache.Servers) > 0 {
+		return fmt.Errorf("store.redis and store.memcache are mutually exclusive")
+	}
+	if (c.Redis.Addr != "" || len(c.Memcache.Servers) > 0) && c.Timeout <= 0 {
+		return fmt.Errorf("store.timeout must be positive")
+	}
+	return nil
+}
+
+// sharedStore holds expiring keys and counters on behalf of all instances.
+type sharedStore interface {
+	// incr increments the counter at key and returns its new value. A new
+	// counter expires after ttl, which later increments don't extend, so
+	// that it counts within a window fixed from its first increment.
+	incr(key string, ttl time.Duration) (int64, error)
+	// add sets key to expire after ttl unless it is already set, and reports
+	// whether it was.
+	add(key string, ttl time.Duration) (bool, error)
+	// set sets key to expire after ttl.
+	set(key string, ttl time.Duration) error
+	exists(key string) (bool, error)
+	// del deletes keys and reports whether any of them was set.
+	del(keys ...string) (bool, error)
+	Close() error
+}
+
+// shared is nil without a store, leaving all state per instance.
+var shared sharedStore
+
+func newSharedStore(c *StoreConfig) (sharedStore, error) {
+	if c.Redis.Addr != "" {
+		return newRedisStore(&c.Redis, c.Prefix, c.Timeout)
+	}
+	if len(c.Memcache.Servers) > 0 {
+		return newMemcacheStore(&c.Memcache, c.Prefix, c.Timeout)
+	}
+	return nil, nil
+}
+
+// storeDown is set while the store fails, so that an outage is logged once
+// rather than on every login.
+var storeDown int32
+
+// storeOk reports whether err is nil, logging when the store goes down or
+// comes back.
+func storeOk(err error) bool {
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&storeDown, 0, 1) {
+			log.Printf("Shared store failed, falling back to the counters of this instance: %v", err)
+		}
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&storeDown, 1, 0) {
+		log.Printf("Shared store is back.")
+	}
+	return true
+}
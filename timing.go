@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var slowRequest = flag.Duration("slow-request", time.Second, "log a warning with per-stage timings for authentications taking longer than this, 0 disables it.")
+
+// stageTimings collects how long the stages of one authentication took. A
+// nil *stageTimings records nothing.
+type stageTimings struct {
+	mu     sync.Mutex
+	start  time.Time
+	n      int
+	stages [8]stageTiming
+}
+
+// stageTiming is kept unformatted so that fast requests don't pay for it.
+type stageTiming struct {
+	name string
+	took time.Duration
+}
+
+func newStageTimings() *stageTimings {
+	return &stageTimings{start: time.Now()}
+}
+
+// add records that stage, begun at start, just finished.
+func (t *stageTimings) add(stage string, start time.Time) {
+	if t == nil {
+		return
+	}
+	took := time.Since(start)
+	t.mu.Lock()
+	if t.n < len(t.stages) {
+		t.stages[t.n] = stageTiming{stage, took}
+		t.n++
+	}
+	t.mu.Unlock()
+}
+
+// logIfSlow warns about the request of login if it exceeded -slow-request.
+func (t *stageTimings) logIfSlow(login string, r *http.Request) {
+	took := time.Since(t.start)
+	if *slowRequest <= 0 || took < *slowRequest {
+		return
+	}
+	t.mu.Lock()
+	stages := make([]string, t.n)
+	for i, st := range t.stages[:t.n] {
+		stages[i] = fmt.Sprintf("%s=%v", st.name, st.took.Round(time.Microsecond))
+	}
+	t.mu.Unlock()
+	logWarn("Slow authentication of %s took %v:%s %s", login, took.Round(time.Microsecond), traceFields(r), strings.Join(stages, " "))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig serves the auth listener over HTTPS, optionally requiring nginx
+// to present a client certificate.
+type TLSConfig struct {
+	TLSParams         `yaml:",inline"`
+	CertFile          string           `yaml:"cert_file"`
+	KeyFile           string           `yaml:"key_file"`
+	ClientCAFile      string           `yaml:"client_ca_file"`
+	RequireClientCert bool             `yaml:"require_client_cert"`
+	Revocation        RevocationConfig `yaml:"revocation"`
+	ACME              ACMEConfig       `yaml:"acme"`
+	// ReloadInterval is how often CertFile and KeyFile are checked for
+	// changes. They are also reloaded on SIGHUP.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// ACMEConfig obtains and renews the listener certificate from an ACME CA such
+// as Let's Encrypt instead of CertFile and KeyFile.
+type ACMEConfig struct {
+	Hosts        []string `yaml:"hosts"`
+	Email        string   `yaml:"email"`
+	CacheDir     string   `yaml:"cache_dir"`
+	DirectoryURL string   `yaml:"directory_url"`
+	// HTTPChallengeAddr serves HTTP-01 challenges, e.g. ":80". Without it
+	// only TLS-ALPN-01 is used, which needs the listener on port 443.
+	HTTPChallengeAddr string `yaml:"http_challenge_addr"`
+}
+
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != "" || len(c.ACME.Hosts) > 0
+}
+
+func (c *ACMEConfig) manager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Hosts...),
+		Email:      c.Email,
+	}
+	if c.CacheDir != "" {
+		m.Cache = autocert.DirCache(c.CacheDir)
+	}
+	if c.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	if c.HTTPChallengeAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(c.HTTPChallengeAddr, m.HTTPHandler(nil)))
+		}()
+	}
+	return m
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+func (c *TLSConfig) serverConfig(rc *revocationChecker) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if err := c.TLSParams.apply(tc); err != nil {
+		return nil, err
+	}
+	if c.CertFile != "" {
+		r, err := newCertReloader(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		go r.watch(c.ReloadInterval)
+		tc.GetCertificate = r.getCertificate
+	} else if len(c.ACME.Hosts) > 0 {
+		m := c.ACME.manager()
+		tc.GetCertificate = m.GetCertificate
+		tc.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		tc.VerifyPeerCertificate = rc.verifyPeerCertificate
+	}
+	return tc, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSParams are the protocol settings shared by the HTTPS listener and the
+// LDAPS/StartTLS client connections.
+type TLSParams struct {
+	// MinVersion is one of 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites are Go names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// They only apply up to TLS 1.2; TLS 1.3 suites are not configurable.
+	CipherSuites []string `yaml:"cipher_suites"`
+	// Curves are X25519, P256, P384 or P521 in order of preference.
+	Curves []string `yaml:"curves"`
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+)
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	return 0, false
+}
+
+func (p *TLSParams) apply(tc *tls.Config) error {
+	if p.MinVersion != "" {
+		v, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %q", p.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+	for _, name := range p.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return fmt.Errorf("unknown cipher suite %q", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	for _, name := range p.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("unknown curve %q", name)
+		}
+		tc.CurvePreferences = append(tc.CurvePreferences, id)
+	}
+	return nil
+}
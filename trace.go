@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+const (
+	Traceparent = "Traceparent"
+	Tracestate  = "Tracestate"
+)
+
+var traceparentRe = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// traceContext is the W3C trace context of a request. spanID identifies
+// the handling of the request by this daemon, parentID the caller's span.
+type traceContext struct {
+	traceID, spanID, parentID, flags, state string
+}
+
+type traceKey struct{}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTraceContext continues the trace in the traceparent header nginx
+// passed on, or starts a new one.
+func newTraceContext(r *http.Request) *traceContext {
+	tc := &traceContext{spanID: randomHex(8), flags: "00"}
+	if m := traceparentRe.FindStringSubmatch(r.Header.Get(Traceparent)); m != nil && m[1] != "00000000000000000000000000000000" {
+		tc.traceID, tc.parentID, tc.flags = m[1], m[2], m[3]
+		tc.state = r.Header.Get(Tracestate)
+	} else {
+		tc.traceID = randomHex(16)
+	}
+	return tc
+}
+
+// traceparent renders tc as the header for calls made on behalf of the
+// request.
+func (tc *traceContext) traceparent() string {
+	return "00-" + tc.traceID + "-" + tc.spanID + "-" + tc.flags
+}
+
+func withTrace(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, newTraceContext(r)))
+}
+
+// requestTrace returns the trace context of r, nil outside of withTrace.
+func requestTrace(r *http.Request) *traceContext {
+	tc, _ := r.Context().Value(traceKey{}).(*traceContext)
+	return tc
+}
+
+// traceFields describes the trace of r for log lines.
+func traceFields(r *http.Request) string {
+	tc := requestTrace(r)
+	if tc == nil {
+		return ""
+	}
+	return " trace_id=" + tc.traceID + " span_id=" + tc.spanID
+}
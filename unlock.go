@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gopkg.in/ldap.v3"
+)
+
+// unlockResult reports what POST /admin/unlock cleared.
+type unlockResult struct {
+	User      string   `json:"user"`
+	Local     bool     `json:"local"`
+	Directory []string `json:"directory,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// handleUnlock clears the local lockout of ?user= and, with directory=true,
+// the lockout attributes of the user's entry: those of ldap.failed_logins
+// and ldap.unlock_attributes. The directory is the one of the X-Ldap-*
+// headers of the admin request, or else every ldap backend.
+func handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	login := currentConfig().Normalize.username(r.URL.Query().Get("user"))
+	usr, domain, ok := splitLogin(login)
+	if !ok {
+		http.Error(w, "user must be a user@domain login", http.StatusBadRequest)
+		return
+	}
+	res := unlockResult{User: login, Local: userFailures.reset(login)}
+	if r.URL.Query().Get("directory") == "true" {
+		for _, cred := range unlockTargets(r, usr, domain) {
+			dn, err := unlockDirectory(&cred)
+			if err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", cred.ldapAddr, err))
+				continue
+			}
+			if dn != "" {
+				res.Directory = append(res.Directory, cred.ldapAddr+" "+dn)
+			}
+		}
+	}
+	log.Printf("Unlocked %s from %s, local: %v, directory: %v", login, r.RemoteAddr, res.Local, res.Directory)
+	w.Header().Set("Content-Type", "application/json")
+	if len(res.Errors) > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func unlockTargets(r *http.Request, usr, domain string) []LdapCredential {
+	if url := r.Header.Get(XLdapURL); url != "" {
+		return []LdapCredential{{
+			ldapAddr: url,
+			baseDn:   r.Header.Get(XLdapBaseDN),
+			bindDn:   r.Header.Get(XLdapBindDN),
+			bindPwd:  r.Header.Get(XLdapBindPass),
+			usr:      usr,
+			domain:   domain,
+		}}
+	}
+	var creds []LdapCredential
+	for _, b := range currentConfig().Backends {
+		if b.Type == "ldap" {
+			creds = append(creds, LdapCredential{ldapAddr: b.URL, baseDn: b.BaseDN, bindDn: b.BindDN, bindPwd: b.BindPassword, bindPwdNext: b.BindPasswordNext, usr: usr, domain: domain})
+		}
+	}
+	return creds
+}
+
+// unlockAttributes returns the attributes to delete and those to replace,
+// from "attr" and "attr=value" entries.
+func (c *LdapConfig) unlockAttributes() (del []string, replace map[string]string) {
+	replace = make(map[string]string)
+	del = append(del, c.FailedLogins.attributes()...)
+	for _, a := range c.UnlockAttributes {
+		if kv := strings.SplitN(a, "=", 2); len(kv) == 2 {
+			replace[kv[0]] = kv[1]
+		} else {
+			del = append(del, a)
+		}
+	}
+	return del, replace
+}
+
+// unlockDirectory looks the user up as the service account and resets the
+// lockout attributes present on the entry. It returns the DN, or "" when the
+// directory doesn't know the user.
+func unlockDirectory(cred *LdapCredential) (string, error) {
+	conf := &currentConfig().Ldap
+	del, replace := conf.unlockAttributes()
+	attrs := append([]string{"dn"}, del...)
+	for a := range replace {
+		attrs = append(attrs, a)
+	}
+	sreq := conf.userSearch(cred.baseDn, cred, attrs)
+	var sresp *ldap.SearchResult
+	err := servicePool(cred).do(func(l *pooledConn) (err error) {
+		sresp, err = l.Search(sreq)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(sresp.Entries) != 1 {
+		return "", nil
+	}
+	entry := sresp.Entries[0]
+	// Binds may be sent again, whether or not there are attributes to reset.
+	unlocked := unlockDirectoryUser(cred.ldapAddr, entry.DN)
+
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	for _, a := range del {
+		if len(entry.GetAttributeValues(a)) > 0 {
+			req.Delete(a, nil)
+		}
+	}
+	for a, v := range replace {
+		if vals := entry.GetAttributeValues(a); len(vals) > 0 && !(len(vals) == 1 && vals[0] == v) {
+			req.Replace(a, []string{v})
+		}
+	}
+	if len(req.Changes) == 0 {
+		if !unlocked {
+			return "", nil
+		}
+		return entry.DN, nil
+	}
+	err = servicePool(cred).do(func(l *pooledConn) error {
+		return l.Modify(req)
+	})
+	if err != nil {
+		return "", err
+	}
+	return entry.DN, nil
+}
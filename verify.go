@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/ldap.v3"
+)
+
+var errInvalidPassword = errors.New("password does not match")
+
+// verifyPassword checks cred's password for the entry dn in the configured
+// way: a user bind, an LDAP Compare against userPassword on the service
+// connection, which leaves the directory's bind-based lockout policy alone,
+// or by reading userPassword and checking its hash locally, for read-only
+// replicas that refuse user binds.
+func verifyPassword(cred *LdapCredential, dn string) error {
+	switch cred.ldapConf().PasswordCheck {
+	case "local":
+		sreq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", []string{"userPassword"}, nil)
+		var sresp *ldap.SearchResult
+		err := servicePool(cred).doUntil(cred.deadline, func(l *pooledConn) (err error) {
+			sresp, err = l.Search(sreq)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(sresp.Entries) == 1 {
+			for _, stored := range sresp.Entries[0].GetAttributeValues("userPassword") {
+				if checkHashedPassword(stored, cred.pwd) {
+					return nil
+				}
+			}
+		}
+		return errInvalidPassword
+	case "compare":
+		var match bool
+		err := servicePool(cred).doUntil(cred.deadline, func(l *pooledConn) (err error) {
+			match, err = l.Compare(dn, "userPassword", cred.pwd)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !match {
+			return errInvalidPassword
+		}
+		return nil
+	default:
+		return bindUser(cred, dn)
+	}
+}
+
+func checkPasswordCheck(mode string) error {
+	switch mode {
+	case "bind", "compare", "local":
+		return nil
+	}
+	return fmt.Errorf("ldap.password_check must be bind, compare or local, got %q", mode)
+}